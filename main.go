@@ -1,36 +1,97 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	icopy "github.com/evijayan2/icopy/src"
+	"github.com/mattn/go-isatty"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	scan          = flag.Bool("scan", false, "Scan and generate md5sum files. (true/false)")
-	video         = flag.Bool("video", false, "Read video creation date time metadata. (true/false)")
-	image         = flag.Bool("image", false, "Read image creation date time metadata. (true/false)")
-	remove_source = flag.Bool("removesource", false, "Remove source files after copying. (true/false)")
-	outdir_fmt    = flag.String("dirformat", "NOF", "DATE or YEAR-MONTH or NOF (No Format/Preserve Original)")
-	outdir        = flag.String("out", ".", "Output directory")
-	indir         = flag.String("in", "", "Input directory")
-	recursive     = flag.Bool("recursive", false, "Recursively copy files. (true/false)")
-	forceCopy     = flag.Bool("force", false, "Force copy of files. (true/false)")
-	overwrite     = flag.String("overwrite", "no", "Overwrite existing files. (yes/no/ask)")
-	useFastHash   = flag.Bool("fast-hash", true, "Use partial hashing for large files (>50MB). (true/false)")
-	numWorkers    = flag.Int("workers", 10, "Number of parallel workers. (default 10)")
+	scan           = flag.Bool("scan", false, "Scan and generate md5sum files. (true/false)")
+	video          = flag.Bool("video", false, "Only copy or scan videos, as -media=video. Combines with -image. (true/false)")
+	image          = flag.Bool("image", false, "Only copy or scan images, as -media=image. Combines with -video. (true/false)")
+	media          = flag.String("media", icopy.MediaAll, "Media to copy or scan, comma separated: image, video, audio, sidecar or all.")
+	remove_source  = flag.Bool("removesource", false, "Remove source files after copying. (true/false)")
+	indir          = flag.String("in", "", "Input directory")
+	recursive      = flag.Bool("recursive", false, "Recursively copy files. (true/false)")
+	followSymlinks = flag.Bool("follow-symlinks", false, "With -recursive, enter symbolic links to directories in the source. (true/false)")
+	forceCopy      = flag.Bool("force", false, "Force copy of files. (true/false)")
+	overwrite      = flag.String("overwrite", "no", "Overwrite existing files. (yes/no/ask)")
+	onConflict     = flag.String("on-conflict", "", "When a different file has the same name: skip, rename, overwrite, version or ask. (default from -overwrite)")
+	renameSuffix   = flag.String("rename-suffix", icopy.SuffixCounter, "What -on-conflict=rename adds to the name. (counter/hash/time)")
+	rename         = flag.String("rename", "", "Template copies are named by, e.g. '{date:20060102_150405}_{subsec}_{camera}_{seq}.{ext}'. (default keep the name)")
+	fixExt         = flag.Bool("fix-ext", false, "Give copies whose content is not what their extension says, such as HEIC saved as .jpg, the right extension. (true/false)")
+	preserve       = flag.String("preserve", "", "Source attributes copies keep besides the modification time, comma separated: mode, owner, times, xattr, acl. (default none)")
+	minSize        = flag.String("min-size", "", "Leave out source files smaller than this, e.g. 1MB. (default no minimum)")
+	maxSize        = flag.String("max-size", "", "Leave out source files larger than this, e.g. 4GB. (default no maximum)")
+	since          = flag.String("since", "", "Only files taken on or after this date, e.g. 2024-03-01, or 7d for the last week. (default no limit)")
+	until          = flag.String("until", "", "Only files taken up to this date, e.g. 2024-03-31. (default no limit)")
+	xmpSidecar     = flag.Bool("xmp-sidecar", false, "Write <name>.xmp next to each renamed copy, recording its original name. (true/false)")
+	locale         = flag.String("locale", icopy.SystemLocale(), "Language of {monthname} and {monthabbr} in -dirformat, e.g. de or fr_FR. (default from LANG)")
+	event          = flag.String("event", "", "Event name for {event} in -dirformat, e.g. Wedding")
+	versionKeep    = flag.Int("version-keep", 0, "Versions to keep of each overwritten file. (default all)")
+	versionMaxAge  = flag.Duration("version-max-age", 0, "Drop versions of overwritten files older than this, e.g. 720h. (default never)")
+	useFastHash    = flag.Bool("fast-hash", true, "Use partial hashing for large files (>50MB). (true/false)")
+	perceptualHash = flag.Bool("perceptual-hash", false, "Record a perceptual hash of each image in the catalog, for \"icopy similar\". (true/false)")
+	essenceHash    = flag.Bool("essence-hash", false, "Also treat files whose image or media data is already in the output, with different metadata, as duplicates. (true/false)")
+	numWorkers     = flag.Int("workers", 0, "Number of parallel workers in every pool. 0 sizes each pool from its device. (default 0)")
+	mode           = flag.String("mode", "copy", "How files are placed in the output directory. (copy/hardlink/symlink/move)")
+	crossDevice    = flag.String("cross-device", "copy", "What -mode=hardlink does across filesystems. (copy/refuse)")
+	sortByDate     = flag.Bool("sort-by-date", true, "Copy files oldest first, once the source is read. Large imports are sorted on disk. false copies in walk order as files are found. (true/false)")
+	verify         = flag.Bool("verify", false, "Read back each copy and compare its MD5 with the source. (true/false)")
+	maxReadRate    = flag.String("max-read-rate", "", "Limit reads across all workers, e.g. 50MB/s. (default unlimited)")
+	maxWriteRate   = flag.String("max-write-rate", "", "Limit writes across all workers, e.g. 50MB/s. (default unlimited)")
+	maxFileRate    = flag.Float64("max-files-per-sec", 0, "Limit files opened per second across all workers. (default unlimited)")
+	controlSocket  = flag.String("control-socket", "", "Unix socket accepting \"read|write|files <rate>\" lines to change limits while running")
+
+	outdirs      stringList
+	outdir_fmts  stringList
+	sanitizers   stringList
+	includes     stringList
+	excludes     stringList
+	pool_workers stringList
 )
 
+func init() {
+	flag.Var(&outdirs, "out", "Output directory. Repeat to mirror to several destinations. (default .)")
+	flag.Var(&pool_workers, "pool-workers", "Workers for pools reading or writing under a path, as path=N. Repeatable.")
+	flag.Var(&outdir_fmts, "dirformat", "DATE or YEAR-MONTH or NOF (No Format/Preserve Original) or MIRROR (folders under -in), or a template such as {year}/{month:02}-{monthname}. Repeat to give each -out its own. (default NOF)")
+	flag.Var(&includes, "include", "Only read source files matching this glob, or re:<regexp>, e.g. '*.jpg' or 'DCIM/'. Repeatable.")
+	flag.Var(&excludes, "exclude", "Leave out source files matching this glob, or re:<regexp>, e.g. '*.thm' or 'MISC/'. Repeatable.")
+	flag.Var(&sanitizers, "sanitize", "Which names are valid in the output: auto (from its filesystem), posix or windows (exFAT/NTFS). Repeat to give each -out its own. (default auto)")
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.With().Caller().Logger()
@@ -41,7 +102,7 @@ func main() {
 	}
 	defer file.Close()
 
-	consoleWriter := zerolog.ConsoleWriter{Out: os.Stdout}
+	consoleWriter := terminalWriter{zerolog.ConsoleWriter{Out: os.Stdout}}
 	multi := zerolog.MultiLevelWriter(consoleWriter, file)
 	logger := zerolog.New(multi).
 		With().
@@ -49,32 +110,146 @@ func main() {
 		Caller().
 		Logger()
 
-	ctx := context.WithValue(context.Background(), "logger", logger)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "logger", logger))
+	defer cancel()
 
-	handleSigtem(ctx)
-	flag.Parse()
+	handleSigtem(ctx, cancel)
 
-	if *video && *image {
-		error(ctx, "Only one of -video or -image can be specified. Exiting.")
+	if len(os.Args) > 1 {
+		commands := map[string]func(context.Context, []string){
+			"scrub":    scrubCommand,
+			"similar":  similarCommand,
+			"plan":     planCommand,
+			"dedupe":   dedupeCommand,
+			"undo":     undoCommand,
+			"versions": versionsCommand,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			command(ctx, os.Args[2:])
+			exitIfInterrupted(ctx)
+			return
+		}
 	}
+	flag.Parse()
 
 	if *indir == "" {
-		error(ctx, "No input directory specified. Exiting.")
+		fail(ctx, "No input directory specified. Exiting.")
+	}
+
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+	if len(outdir_fmts) == 0 {
+		outdir_fmts = stringList{"NOF"}
+	}
+	if len(outdir_fmts) != 1 && len(outdir_fmts) != len(outdirs) {
+		fail(ctx, "Give -dirformat once, or once per -out. Exiting.")
+	}
+	if len(sanitizers) == 0 {
+		sanitizers = stringList{icopy.SanitizeAuto}
+	}
+	if len(sanitizers) != 1 && len(sanitizers) != len(outdirs) {
+		fail(ctx, "Give -sanitize once, or once per -out. Exiting.")
+	}
+	for _, policy := range sanitizers {
+		switch policy {
+		case icopy.SanitizeAuto, icopy.SanitizePosix, icopy.SanitizeWindows:
+		default:
+			fail(ctx, "Unknown -sanitize "+policy+". Exiting.")
+		}
+	}
+
+	layoutOptions := icopy.LayoutOptions{Locale: *locale, Event: *event}
+	for _, format := range outdir_fmts {
+		if _, err := icopy.ParseDirFormat(format, layoutOptions); err != nil {
+			fail(ctx, err.Error()+". Exiting.")
+		}
+	}
+	if *rename != "" {
+		if _, err := icopy.ParseNameFormat(*rename, layoutOptions); err != nil {
+			fail(ctx, err.Error()+". Exiting.")
+		}
 	}
 
-	imageFiles := []icopy.FileObject{}
-	erroredFiles := []icopy.ErroredFileObject{}
-	skippedFiles := []icopy.FileObject{}
+	destinations := []icopy.Destination{}
+	for i, dir := range outdirs {
+		destinations = append(destinations, icopy.Destination{Dir: dir, DateFmt: outdir_fmts[i%len(outdir_fmts)], Sanitize: sanitizers[i%len(sanitizers)]})
+	}
+
+	switch *mode {
+	case icopy.ModeCopy, icopy.ModeHardlink, icopy.ModeSymlink, icopy.ModeMove:
+	default:
+		fail(ctx, "Unknown -mode "+*mode+". Exiting.")
+	}
+
+	if *crossDevice != "copy" && *crossDevice != "refuse" {
+		fail(ctx, "Unknown -cross-device "+*crossDevice+". Exiting.")
+	}
+
+	switch *onConflict {
+	case "", icopy.ConflictSkip, icopy.ConflictRename, icopy.ConflictOverwrite, icopy.ConflictVersion, icopy.ConflictAsk:
+	default:
+		fail(ctx, "Unknown -on-conflict "+*onConflict+". Exiting.")
+	}
+
+	switch *renameSuffix {
+	case icopy.SuffixCounter, icopy.SuffixHash, icopy.SuffixTime:
+	default:
+		fail(ctx, "Unknown -rename-suffix "+*renameSuffix+". Exiting.")
+	}
+
+	preserveAttrs, err := icopy.ParsePreserve(*preserve)
+	if err != nil {
+		fail(ctx, "-preserve: "+err.Error()+". Exiting.")
+	}
+
+	filter, err := newFilter()
+	if err != nil {
+		fail(ctx, err.Error()+". Exiting.")
+	}
+
+	mediaTypes, mediaGiven, err := newMediaTypes()
+	if err != nil {
+		fail(ctx, "-media: "+err.Error()+". Exiting.")
+	}
+
+	if *mode == icopy.ModeSymlink && *remove_source {
+		fail(ctx, "-removesource would leave -mode=symlink links dangling. Exiting.")
+	}
+
+	summary := &icopy.CopySummary{}
 	matchedFiles := []icopy.MatchObject{}
 
+	throttle := newThrottle(ctx)
+	sizer := newWorkerSizer(ctx)
+
 	fp := icopy.FileProcessor{
-		Overwrite:    *overwrite,
-		ForceCopy:    *forceCopy,
-		Recursive:    *recursive,
-		DateFmt:      *outdir_fmt,
-		UseFastHash:  *useFastHash,
-		NumWorkers:   *numWorkers,
-		ProgressChan: nil, // Will be set if needed
+		Overwrite:         *overwrite,
+		OnConflict:        *onConflict,
+		RenameSuffix:      *renameSuffix,
+		Rename:            *rename,
+		Preserve:          preserveAttrs,
+		XMPSidecar:        *xmpSidecar,
+		Layout:            layoutOptions,
+		VersionRetention:  icopy.VersionRetention{Keep: *versionKeep, MaxAge: *versionMaxAge},
+		ForceCopy:         *forceCopy,
+		Recursive:         *recursive,
+		FollowLinks:       *followSymlinks,
+		DateFmt:           outdir_fmts[0],
+		UseFastHash:       *useFastHash,
+		UseEssenceHash:    *essenceHash,
+		UsePerceptualHash: *perceptualHash,
+		NumWorkers:        *numWorkers,
+		ProgressChan:      nil, // Will be set if needed
+		Mode:              *mode,
+		CrossDevice:       *crossDevice,
+		Verify:            *verify,
+		Unsorted:          !*sortByDate,
+		Filter:            filter,
+		MediaTypes:        mediaTypes,
+		FixExtensions:     *fixExt,
+		Throttle:          throttle,
+		Sizer:             sizer,
 	}
 
 	if *scan {
@@ -88,21 +263,27 @@ func main() {
 
 		options := icopy.ScanOptions{
 			Recursive:    *recursive,
+			FollowLinks:  *followSymlinks,
 			NumWorkers:   *numWorkers,
 			UseFastHash:  *useFastHash,
 			ProgressChan: progressChan,
+			Throttle:     throttle,
+			Sizer:        sizer,
+			Filter:       filter,
+		}
+		// Unless asked for media, a scan hashes every file.
+		if mediaGiven {
+			options.MediaTypes = mediaTypes
 		}
 
-		icopy.ScanFiles(ctx, *indir, *outdir, options)
-		matchedFiles = icopy.ValidateMd5sumFiles(ctx, "src", "dst")
+		icopy.ScanFilesMulti(ctx, *indir, outdirs, options)
+		for i := range outdirs {
+			matchedFiles = append(matchedFiles, icopy.ValidateMd5sumFiles(ctx, "src", icopy.DestPrefix(i))...)
+		}
 		close(stopChan)
 		wg.Wait()
-	} else if *video || *image {
-		if *video {
-			logger.Info().Msgf("Reading video creation time metadata")
-		} else {
-			logger.Info().Msgf("Reading image creation time metadata")
-		}
+	} else {
+		logger.Info().Msgf("Reading %s creation time metadata", strings.Join(mediaTypes, ", "))
 
 		var wg sync.WaitGroup
 		stopChan := make(chan struct{})
@@ -112,31 +293,45 @@ func main() {
 		wg.Add(1)
 		go showSpinner(stopChan, &wg, progressChan)
 
-		if *video {
-			imageFiles, erroredFiles, skippedFiles = fp.CopyVideoFiles(ctx, *indir, *outdir)
-		} else {
-			imageFiles, erroredFiles, skippedFiles = fp.CopyImageFiles(ctx, *indir, *outdir)
+		// Without a terminal to ask on, conflicts are answered no.
+		var promptChan chan icopy.ConflictRequest
+		if (*onConflict == icopy.ConflictAsk || (*onConflict == "" && *overwrite == "ask")) &&
+			(isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd())) {
+			promptChan = make(chan icopy.ConflictRequest)
+			fp.Prompt = promptChan
+			go promptConflicts(promptChan)
+		}
+
+		summary = fp.CopyMedia(ctx, *indir, destinations)
+		if promptChan != nil {
+			close(promptChan)
 		}
 		close(stopChan)
 		wg.Wait()
 
-		if len(imageFiles) == 0 {
-			if *video {
-				logger.Info().Msg("No valid video files found or copied.")
-			} else {
-				logger.Info().Msg("No valid image files found or copied.")
-			}
+		if summary.Copied == 0 {
+			logger.Info().Msgf("No valid %s files found or copied.", strings.Join(mediaTypes, ", "))
 		}
-	} else {
-		error(ctx, "No input specified. Exiting.")
 	}
 
 	PrintM(ctx, "Files matched", matchedFiles)
-	Print(ctx, "Files copied", imageFiles)
-	Print(ctx, "Skipped", skippedFiles)
-	PrintE(ctx, "Errors", erroredFiles)
+	PrintN(ctx, "Files copied", int64(summary.Copied))
+	PrintN(ctx, "Skipped", int64(summary.Skipped))
+	PrintE(ctx, "Errors", summary.Errors)
+	if n := summary.Errored - len(summary.Errors); n > 0 {
+		logger.Info().Msgf("... and %d more errors, listed in the log", n)
+	}
+	PrintN(ctx, "Excluded by filters", filter.Excluded())
+	PrintW(ctx, "Wrong extensions", summary, *fixExt)
+	if len(mediaTypes) > 1 && !*scan {
+		PrintT(ctx, mediaTypes, summary)
+	}
+	if len(outdirs) > 1 {
+		PrintD(ctx, outdirs, summary)
+	}
 
-	if *remove_source {
+	// An interrupted import leaves its sources for the next run to finish.
+	if *remove_source && ctx.Err() == nil {
 		logger.Info().Msg("Removing copied source files...")
 		removedFiles := icopy.RemoveSourceFile(*indir)
 
@@ -144,10 +339,449 @@ func main() {
 	}
 
 	os.RemoveAll("./badger")
+	removeControlSocket(*controlSocket)
+
+	fmt.Println("")
+	exitIfInterrupted(ctx)
+}
+
+// scrubCommand runs "icopy scrub", which re-hashes each output directory and
+// compares it with its catalog.
+func scrubCommand(ctx context.Context, args []string) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	fs.Var(&outdirs, "out", "Output directory to scrub. Repeatable. (default .)")
+	budget := fs.Duration("budget", 0, "Stop starting new files after this long, e.g. 2h. The next run resumes. (default unlimited)")
+	restart := fs.Bool("restart", false, "Start a new pass instead of resuming the last one. (true/false)")
+	fs.IntVar(numWorkers, "workers", 0, "Number of parallel workers. 0 sizes the pool from the device. (default 0)")
+	fs.Var(&pool_workers, "pool-workers", "Workers for pools reading under a path, as path=N. Repeatable.")
+	fs.StringVar(maxReadRate, "max-read-rate", "", "Limit reads across all workers, e.g. 50MB/s. (default unlimited)")
+	fs.Float64Var(maxFileRate, "max-files-per-sec", 0, "Limit files opened per second across all workers. (default unlimited)")
+	fs.StringVar(controlSocket, "control-socket", "", "Unix socket accepting \"read|files <rate>\" lines to change limits while running")
+	flag.Usage = fs.Usage
+	fs.Parse(args)
+
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+
+	var wg sync.WaitGroup
+	stopChan := make(chan struct{})
+	progressChan := make(chan string, 100)
+	wg.Add(1)
+	go showSpinner(stopChan, &wg, progressChan)
+
+	options := icopy.ScrubOptions{
+		Budget:       *budget,
+		Restart:      *restart,
+		NumWorkers:   *numWorkers,
+		ProgressChan: progressChan,
+		Throttle:     newThrottle(ctx),
+		Sizer:        newWorkerSizer(ctx),
+	}
+
+	problems := false
+	reports := []icopy.ScrubReport{}
+	for _, dir := range outdirs {
+		report, err := icopy.Scrub(ctx, dir, options)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to scrub %s", dir)
+			problems = true
+		}
+		reports = append(reports, report)
+	}
+	close(stopChan)
+	wg.Wait()
+
+	for i, report := range reports {
+		PrintS(ctx, outdirs[i], report)
+		if len(report.Corrupt) > 0 || len(report.Missing) > 0 || len(report.Errored) > 0 {
+			problems = true
+		}
+	}
+	removeControlSocket(*controlSocket)
+	fmt.Println("")
+	if problems {
+		os.Exit(1)
+	}
+}
+
+// similarCommand runs "icopy similar", which reports groups of visually
+// similar images in each output directory.
+func similarCommand(ctx context.Context, args []string) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	fs := flag.NewFlagSet("similar", flag.ExitOnError)
+	fs.Var(&outdirs, "out", "Output directory to search. Repeatable. (default .)")
+	threshold := fs.Int("threshold", icopy.DefaultSimilarThreshold, "Largest number of differing perceptual hash bits (of 64) for two images to be similar.")
+	fs.IntVar(numWorkers, "workers", 0, "Number of parallel workers. 0 sizes the pool from the device. (default 0)")
+	fs.Var(&pool_workers, "pool-workers", "Workers for pools reading under a path, as path=N. Repeatable.")
+	fs.StringVar(maxReadRate, "max-read-rate", "", "Limit reads across all workers, e.g. 50MB/s. (default unlimited)")
+	fs.Float64Var(maxFileRate, "max-files-per-sec", 0, "Limit files opened per second across all workers. (default unlimited)")
+	flag.Usage = fs.Usage
+	fs.Parse(args)
+
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+	if *threshold < 0 || *threshold > 64 {
+		fail(ctx, "-threshold must be between 0 and 64. Exiting.")
+	}
+
+	var wg sync.WaitGroup
+	stopChan := make(chan struct{})
+	progressChan := make(chan string, 100)
+	wg.Add(1)
+	go showSpinner(stopChan, &wg, progressChan)
+
+	options := icopy.SimilarOptions{
+		Threshold:    *threshold,
+		NumWorkers:   *numWorkers,
+		ProgressChan: progressChan,
+		Throttle:     newThrottle(ctx),
+		Sizer:        newWorkerSizer(ctx),
+	}
+
+	results := [][][]icopy.SimilarImage{}
+	for _, dir := range outdirs {
+		groups, err := icopy.FindSimilar(ctx, dir, options)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to search %s", dir)
+		}
+		results = append(results, groups)
+	}
+	close(stopChan)
+	wg.Wait()
+
+	for i, groups := range results {
+		PrintG(ctx, outdirs[i], groups)
+	}
+	fmt.Println("")
+}
+
+// planCommand runs "icopy plan", which picks the copy to keep from each
+// group of duplicates in the output directory and writes the plan to a file.
+func planCommand(ctx context.Context, args []string) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fs.Var(&outdirs, "out", "Output directory to plan for. (default .)")
+	group := fs.String("group", icopy.GroupExact, "Which duplicates to group. (exact/essence/perceptual)")
+	keep := fs.String("keep", icopy.DefaultKeepPolicy, "Rules for the copy to keep, in order: highest-resolution, largest, earliest, gps, original, prefer-dir=<path>")
+	planFile := fs.String("plan", "icopy-plan.json", "File to write the plan to")
+	threshold := fs.Int("threshold", icopy.DefaultSimilarThreshold, "Largest number of differing perceptual hash bits for -group=perceptual.")
+	fs.IntVar(numWorkers, "workers", 0, "Number of parallel workers. 0 sizes the pool from the device. (default 0)")
+	fs.Var(&pool_workers, "pool-workers", "Workers for pools reading under a path, as path=N. Repeatable.")
+	flag.Usage = fs.Usage
+	fs.Parse(args)
+
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+	if len(outdirs) > 1 {
+		fail(ctx, "plan works on one -out at a time. Exiting.")
+	}
+	switch *group {
+	case icopy.GroupExact, icopy.GroupEssence, icopy.GroupPerceptual:
+	default:
+		fail(ctx, "Unknown -group "+*group+". Exiting.")
+	}
+	policy, err := icopy.ParseKeepPolicy(*keep)
+	if err != nil {
+		fail(ctx, err.Error())
+	}
+
+	var wg sync.WaitGroup
+	stopChan := make(chan struct{})
+	progressChan := make(chan string, 100)
+	wg.Add(1)
+	go showSpinner(stopChan, &wg, progressChan)
+
+	plan, err := icopy.MakePlan(ctx, outdirs[0], icopy.PlanOptions{
+		Kind:         *group,
+		Policy:       policy,
+		Threshold:    *threshold,
+		NumWorkers:   *numWorkers,
+		ProgressChan: progressChan,
+		Sizer:        newWorkerSizer(ctx),
+	})
+	close(stopChan)
+	wg.Wait()
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("Failed to plan %s", outdirs[0])
+	}
+	if err := icopy.WritePlan(*planFile, plan); err != nil {
+		logger.Fatal().Err(err).Msgf("Failed to write %s", *planFile)
+	}
+
+	PrintP(ctx, plan)
+	logger.Info().Msgf("Plan written to %s", *planFile)
+	fmt.Println("")
+}
+
+// dedupeCommand runs "icopy dedupe", which removes exact duplicates from an
+// output directory or replaces them with links.
+func dedupeCommand(ctx context.Context, args []string) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	fs.Var(&outdirs, "out", "Output directory to deduplicate. (default .)")
+	action := fs.String("action", icopy.DedupeReport, "What to do with each duplicate. (report/hardlink/reflink/symlink/delete)")
+	keep := fs.String("keep", icopy.DefaultKeepPolicy, "Rules for the copy to keep, in order: highest-resolution, largest, earliest, gps, original, prefer-dir=<path>")
+	planFile := fs.String("plan", "", "Apply a plan written by \"icopy plan\" instead of making one")
+	fs.IntVar(numWorkers, "workers", 0, "Number of parallel workers. 0 sizes the pool from the device. (default 0)")
+	fs.Var(&pool_workers, "pool-workers", "Workers for pools reading under a path, as path=N. Repeatable.")
+	fs.StringVar(maxReadRate, "max-read-rate", "", "Limit reads across all workers, e.g. 50MB/s. (default unlimited)")
+	fs.Float64Var(maxFileRate, "max-files-per-sec", 0, "Limit files opened per second across all workers. (default unlimited)")
+	flag.Usage = fs.Usage
+	fs.Parse(args)
+
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+	if len(outdirs) > 1 {
+		fail(ctx, "dedupe works on one -out at a time. Exiting.")
+	}
+	switch *action {
+	case icopy.DedupeReport, icopy.DedupeHardlink, icopy.DedupeReflink, icopy.DedupeSymlink, icopy.DedupeDelete:
+	default:
+		fail(ctx, "Unknown -action "+*action+". Exiting.")
+	}
+	policy, err := icopy.ParseKeepPolicy(*keep)
+	if err != nil {
+		fail(ctx, err.Error())
+	}
+	options := icopy.DedupeOptions{
+		Action:     *action,
+		Policy:     policy,
+		NumWorkers: *numWorkers,
+		Throttle:   newThrottle(ctx),
+		Sizer:      newWorkerSizer(ctx),
+	}
+	if *planFile != "" {
+		plan, err := icopy.ReadPlan(*planFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("Failed to read %s", *planFile)
+		}
+		options.Plan = &plan
+	}
+
+	var wg sync.WaitGroup
+	stopChan := make(chan struct{})
+	progressChan := make(chan string, 100)
+	options.ProgressChan = progressChan
+	wg.Add(1)
+	go showSpinner(stopChan, &wg, progressChan)
+
+	result, err := icopy.Dedupe(ctx, outdirs[0], options)
+	close(stopChan)
+	wg.Wait()
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("Failed to deduplicate %s", outdirs[0])
+	}
+
+	PrintU(ctx, *action, result)
+	fmt.Println("")
+}
+
+// undoCommand runs "icopy undo", which reverses the journalled operations of
+// a run in an output directory.
+func undoCommand(ctx context.Context, args []string) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	fs.Var(&outdirs, "out", "Output directory whose run to undo. (default .)")
+	run := fs.String("run", "", "Run to undo, as shown by -list. (default the latest run not yet undone)")
+	list := fs.Bool("list", false, "List the runs in the journal instead of undoing one. (true/false)")
+	flag.Usage = fs.Usage
+	fs.Parse(args)
+
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+	if len(outdirs) > 1 {
+		fail(ctx, "undo works on one -out at a time. Exiting.")
+	}
+
+	if *list {
+		runs, err := icopy.ListRuns(outdirs[0])
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("Failed to read the journal of %s", outdirs[0])
+		}
+		PrintR(ctx, outdirs[0], runs)
+		fmt.Println("")
+		return
+	}
+
+	result, err := icopy.Undo(ctx, outdirs[0], *run)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("Failed to undo in %s", outdirs[0])
+	}
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("Undid run %s: %d operations, errors %d", result.Run, result.Undone, len(result.Errored))
+	logger.Info().Msg("------------------------------------------------------------")
+	PrintE(ctx, "Errors", result.Errored)
+	fmt.Println("")
+	if len(result.Errored) > 0 {
+		os.Exit(1)
+	}
+}
+
+// versionsCommand runs "icopy versions", which lists, restores and prunes the
+// earlier versions of files that copies replaced.
+func versionsCommand(ctx context.Context, args []string) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	fs.Var(&outdirs, "out", "Output directory whose versions to manage. (default .)")
+	restore := fs.String("restore", "", "Put a saved version of this file back in place")
+	name := fs.String("version", "", "Version to restore, as listed. (default the newest)")
+	prune := fs.Bool("prune", false, "Remove the versions -keep and -max-age do not keep. (true/false)")
+	keep := fs.Int("keep", 0, "Versions to keep of each file with -prune. (default all)")
+	maxAge := fs.Duration("max-age", 0, "Remove versions older than this with -prune, e.g. 720h. (default never)")
+	flag.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: icopy versions [flags] [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
 
+	if len(outdirs) == 0 {
+		outdirs = stringList{"."}
+	}
+	if len(outdirs) > 1 {
+		fail(ctx, "versions works on one -out at a time. Exiting.")
+	}
+	if *restore != "" && *prune {
+		fail(ctx, "Only one of -restore or -prune can be specified. Exiting.")
+	}
+	dir := outdirs[0]
+
+	switch {
+	case *restore != "":
+		v, err := icopy.RestoreVersion(dir, *restore, *name)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("Failed to restore %s", *restore)
+		}
+		logger.Info().Msgf("Restored %s from %s; undo with: icopy undo -out %s", v.Path, v.Saved.Format(time.RFC3339), dir)
+	case *prune:
+		pruned, err := icopy.PruneVersions(dir, fs.Arg(0), icopy.VersionRetention{Keep: *keep, MaxAge: *maxAge})
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to prune versions in %s", dir)
+		}
+		PrintV(ctx, "Pruned versions", pruned)
+	default:
+		versions, err := icopy.ListVersions(dir, fs.Arg(0))
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("Failed to list versions in %s", dir)
+		}
+		PrintV(ctx, "Versions", versions)
+	}
 	fmt.Println("")
 }
 
+// promptConflicts asks about each conflict the copy workers queue, one at a
+// time, with the spinner paused. A "to all" answer also settles the requests
+// that were already queued behind it.
+func promptConflicts(requests <-chan icopy.ConflictRequest) {
+	in := bufio.NewReader(os.Stdin)
+	all := ""
+	for req := range requests {
+		if all != "" {
+			req.Reply <- all
+			continue
+		}
+		terminalMu.Lock()
+		fmt.Print("\r\033[K")
+		answer := askConflict(in, req)
+		terminalMu.Unlock()
+		if answer == icopy.AnswerYesToAll || answer == icopy.AnswerNoToAll {
+			all = answer
+		}
+		req.Reply <- answer
+	}
+}
+
+// askConflict shows both files and reads an answer, unzip style. End of input
+// answers no.
+func askConflict(in *bufio.Reader, req icopy.ConflictRequest) string {
+	fmt.Printf("%s already exists and differs from %s\n", req.Existing.Path, req.Incoming.Path)
+	fmt.Printf("  existing: %s\n", describeConflictFile(req.Existing))
+	fmt.Printf("  incoming: %s\n", describeConflictFile(req.Incoming))
+	for {
+		fmt.Print("Replace? [y]es, [n]o, [r]ename, [A]ll, [N]one, [d]iff: ")
+		line, err := in.ReadString('\n')
+		switch strings.TrimSpace(line) {
+		case "y", "yes":
+			return icopy.AnswerYes
+		case "n", "no":
+			return icopy.AnswerNo
+		case "r", "rename":
+			return icopy.AnswerRename
+		case "A", "all":
+			return icopy.AnswerYesToAll
+		case "N", "none":
+			return icopy.AnswerNoToAll
+		case "d", "diff":
+			diffConflict(req)
+			continue
+		}
+		if err != nil {
+			fmt.Println("")
+			return icopy.AnswerNo
+		}
+	}
+}
+
+func describeConflictFile(f icopy.ConflictFile) string {
+	desc := fmt.Sprintf("%d bytes, %s, md5 %s", f.Size, f.DateTime.Format("2006-01-02 15:04:05"), f.Md5Sum)
+	if f.Width > 0 {
+		desc += fmt.Sprintf(", %dx%d", f.Width, f.Height)
+	}
+	return desc
+}
+
+// diffConflict lists what differs between the two files of a conflict.
+func diffConflict(req icopy.ConflictRequest) {
+	a, b := req.Existing, req.Incoming
+	if a.Size != b.Size {
+		fmt.Printf("  size:       %d => %d bytes (%+d)\n", a.Size, b.Size, b.Size-a.Size)
+	}
+	if !a.DateTime.Equal(b.DateTime) {
+		fmt.Printf("  date:       %s => %s (%s)\n", a.DateTime.Format(time.RFC3339), b.DateTime.Format(time.RFC3339), b.DateTime.Sub(a.DateTime))
+	}
+	if a.Width != b.Width || a.Height != b.Height {
+		fmt.Printf("  dimensions: %dx%d => %dx%d\n", a.Width, a.Height, b.Width, b.Height)
+	}
+	off, err := icopy.FirstDifference(a.Path, b.Path)
+	switch {
+	case err != nil:
+		fmt.Printf("  content:    %v\n", err)
+	case off >= 0:
+		fmt.Printf("  content:    first differs at byte %d\n", off)
+	default:
+		fmt.Println("  content:    identical")
+	}
+}
+
+// terminalMu is held by whatever is writing to the terminal, so that a
+// conflict prompt pauses the spinner and the log.
+var terminalMu sync.Mutex
+
+// terminalWriter writes log lines to the terminal once it is free, so that
+// they wait for an open conflict prompt to be answered rather than land in
+// the middle of it.
+type terminalWriter struct {
+	out io.Writer
+}
+
+func (w terminalWriter) Write(p []byte) (int, error) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	return w.out.Write(p)
+}
+
 func showSpinner(stopChan <-chan struct{}, wg *sync.WaitGroup, progressChan <-chan string) {
 	defer wg.Done()
 	spinner := []string{"|", "/", "-", "\\"}
@@ -170,15 +804,145 @@ func showSpinner(stopChan <-chan struct{}, wg *sync.WaitGroup, progressChan <-ch
 				lastMsg = msg
 			}
 		case <-ticker.C:
+			// A conflict prompt holds the terminal; skip frames until it is done.
+			if !terminalMu.TryLock() {
+				continue
+			}
 			// Print message + spinner
 			// Use \033[K to clear line tail if message shrinks
 			fmt.Printf("\r%s %s\033[K", lastMsg, spinner[i])
 			i = (i + 1) % len(spinner)
+			terminalMu.Unlock()
+		}
+	}
+}
+
+// newThrottle builds the shared rate limits from the flags, or returns nil
+// when nothing is limited so the copy path can take its fast route.
+func newThrottle(ctx context.Context) *icopy.Throttle {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	if *maxReadRate == "" && *maxWriteRate == "" && *maxFileRate == 0 && *controlSocket == "" {
+		return nil
+	}
+
+	readRate, err := icopy.ParseRate(*maxReadRate)
+	if err != nil {
+		fail(ctx, err.Error())
+	}
+	writeRate, err := icopy.ParseRate(*maxWriteRate)
+	if err != nil {
+		fail(ctx, err.Error())
+	}
+	throttle := icopy.NewThrottle(readRate, writeRate, *maxFileRate)
+
+	if *controlSocket != "" {
+		removeControlSocket(*controlSocket)
+		l, err := net.Listen("unix", *controlSocket)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("Failed to listen on %s", *controlSocket)
+		}
+		go throttle.ServeControl(ctx, l)
+	}
+	return throttle
+}
+
+// removeControlSocket removes the socket left at path by this or an earlier
+// run, and leaves anything that is not a socket alone.
+func removeControlSocket(path string) {
+	if path == "" {
+		return
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// newWorkerSizer parses the -pool-workers overrides.
+func newWorkerSizer(ctx context.Context) *icopy.WorkerSizer {
+	sizer := &icopy.WorkerSizer{Overrides: map[string]int{}}
+	for _, pw := range pool_workers {
+		i := strings.LastIndex(pw, "=")
+		if i <= 0 {
+			fail(ctx, "-pool-workers expects path=N, got "+pw+". Exiting.")
+		}
+		n, err := strconv.Atoi(pw[i+1:])
+		if err != nil || n <= 0 {
+			fail(ctx, "-pool-workers expects a positive worker count, got "+pw+". Exiting.")
+		}
+		sizer.Overrides[pw[:i]] = n
+	}
+	return sizer
+}
+
+// newFilter builds the source filter from -include, -exclude, -min-size,
+// -max-size, -since and -until, or returns nil when none is given.
+func newFilter() (*icopy.Filter, error) {
+	if len(includes) == 0 && len(excludes) == 0 && *minSize == "" && *maxSize == "" && *since == "" && *until == "" {
+		return nil, nil
+	}
+	filter := &icopy.Filter{}
+	for _, pattern := range includes {
+		if err := filter.Include(pattern); err != nil {
+			return nil, fmt.Errorf("-include: %w", err)
+		}
+	}
+	for _, pattern := range excludes {
+		if err := filter.Exclude(pattern); err != nil {
+			return nil, fmt.Errorf("-exclude: %w", err)
+		}
+	}
+	var err error
+	if filter.MinSize, err = icopy.ParseSize(*minSize); err != nil {
+		return nil, fmt.Errorf("-min-size: %w", err)
+	}
+	if filter.MaxSize, err = icopy.ParseSize(*maxSize); err != nil {
+		return nil, fmt.Errorf("-max-size: %w", err)
+	}
+	now := time.Now()
+	if *since != "" {
+		if filter.Since, err = icopy.ParseFilterDate(*since, now, false); err != nil {
+			return nil, fmt.Errorf("-since: %w", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = icopy.ParseFilterDate(*until, now, true); err != nil {
+			return nil, fmt.Errorf("-until: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+// newMediaTypes returns the media types -media, -image and -video ask for,
+// and whether any of them was given.
+func newMediaTypes() ([]string, bool, error) {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "media" {
+			given = true
+		}
+	})
+	if *image || *video {
+		// -image and -video narrow the default, and add to a given -media.
+		types := []string{}
+		if given {
+			var err error
+			if types, err = icopy.ParseMediaTypes(*media); err != nil {
+				return nil, true, err
+			}
+		}
+		if *image && !slices.Contains(types, icopy.MediaImage) {
+			types = append(types, icopy.MediaImage)
 		}
+		if *video && !slices.Contains(types, icopy.MediaVideo) {
+			types = append(types, icopy.MediaVideo)
+		}
+		return types, true, nil
 	}
+	types, err := icopy.ParseMediaTypes(*media)
+	return types, given, err
 }
 
-func error(ctx context.Context, msg string) {
+func fail(ctx context.Context, msg string) {
 	logger := ctx.Value("logger").(zerolog.Logger)
 	logger.Info().Msg(msg)
 	flag.Usage()
@@ -198,6 +962,16 @@ func Print(ctx context.Context, msg string, files []icopy.FileObject) {
 	}
 }
 
+func PrintN(ctx context.Context, msg string, n int64) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	if n > 0 {
+		logger.Info().Msg("")
+		logger.Info().Msg("------------------------------------------------------------")
+		logger.Info().Msgf("%s: %d", msg, n)
+		logger.Info().Msg("------------------------------------------------------------")
+	}
+}
+
 func PrintM(ctx context.Context, msg string, files []icopy.MatchObject) {
 	logger := ctx.Value("logger").(zerolog.Logger)
 	if len(files) > 0 {
@@ -224,14 +998,200 @@ func PrintE(ctx context.Context, msg string, files []icopy.ErroredFileObject) {
 	}
 }
 
-func handleSigtem(ctx context.Context) {
+func PrintD(ctx context.Context, dirs []string, summary *icopy.CopySummary) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msg("Per destination")
+	logger.Info().Msg("------------------------------------------------------------")
+	for _, dir := range dirs {
+		c := icopy.CopyCounts{}
+		if counts := summary.ByDestination[dir]; counts != nil {
+			c = *counts
+		}
+		logger.Info().Msgf("%s => copied %d, skipped %d, errors %d", dir, c.Copied, c.Skipped, c.Errored)
+	}
+}
+
+// PrintW lists the files whose content is not what their extension says.
+func PrintW(ctx context.Context, msg string, summary *icopy.CopySummary, fixed bool) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	if summary.WrongExtCount > 0 {
+		logger.Info().Msg("")
+		logger.Info().Msg("------------------------------------------------------------")
+		logger.Info().Msgf("%s: %d", msg, summary.WrongExtCount)
+		logger.Info().Msg("------------------------------------------------------------")
+		for _, f := range summary.WrongExt {
+			logger.Info().Msgf("File %s => %s ", path.Join(f.Path, f.Name), strings.ToUpper(f.Format))
+		}
+		if n := summary.WrongExtCount - len(summary.WrongExt); n > 0 {
+			logger.Info().Msgf("... and %d more", n)
+		}
+		if !fixed {
+			logger.Info().Msg("Copy with -fix-ext to give them the right extension.")
+		}
+	}
+}
+
+// PrintT breaks the files down by media type.
+func PrintT(ctx context.Context, types []string, summary *icopy.CopySummary) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msg("Per media type")
+	logger.Info().Msg("------------------------------------------------------------")
+	for _, t := range types {
+		c := icopy.CopyCounts{}
+		if counts := summary.ByMediaType[t]; counts != nil {
+			c = *counts
+		}
+		logger.Info().Msgf("%s => copied %d, skipped %d, errors %d", t, c.Copied, c.Skipped, c.Errored)
+	}
+}
+
+func PrintS(ctx context.Context, dir string, report icopy.ScrubReport) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("Scrub of %s: verified %d, corrupt %d, missing %d", dir, report.Verified, len(report.Corrupt), len(report.Missing))
+	logger.Info().Msg("------------------------------------------------------------")
+	for _, f := range report.Corrupt {
+		logger.Info().Msgf("Corrupt %s => expected %s, found %s ", f.Entry.Path, f.Expected, f.Md5Sum)
+	}
+	for _, f := range report.Missing {
+		logger.Info().Msgf("Missing %s ", f.Path)
+	}
+	for _, f := range report.Unexpected {
+		logger.Info().Msgf("Unexpected %s ", f)
+	}
+	if !report.Complete {
+		logger.Info().Msg("Stopped before the end of the catalog; the next scrub resumes where this one stopped.")
+	}
+	PrintE(ctx, "Errors", report.Errored)
+}
+
+func PrintG(ctx context.Context, dir string, groups [][]icopy.SimilarImage) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("Similar images in %s: %d groups", dir, len(groups))
+	logger.Info().Msg("------------------------------------------------------------")
+	for i, group := range groups {
+		logger.Info().Msgf("Group %d:", i+1)
+		for _, img := range group {
+			logger.Info().Msgf("  %dx%d %10d bytes  %s ", img.Width, img.Height, img.Size, img.Path)
+		}
+	}
+}
+
+func PrintP(ctx context.Context, plan icopy.Plan) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	discard := 0
+	for _, g := range plan.Groups {
+		discard += len(g.Discard)
+	}
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("Duplicate groups (%s): %d, files to discard: %d", plan.Kind, len(plan.Groups), discard)
+	logger.Info().Msg("------------------------------------------------------------")
+	for _, g := range plan.Groups {
+		logger.Info().Msgf("Keep %s (%s) ", g.Keep, g.Reason)
+		for _, d := range g.Discard {
+			logger.Info().Msgf("  Discard %s ", d)
+		}
+	}
+}
+
+func PrintU(ctx context.Context, action string, result icopy.DedupeResult) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	verb := "Deduplicated"
+	if action == icopy.DedupeReport {
+		verb = "Would deduplicate"
+	}
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("%s %d files (%s), reclaiming %s, skipped %d", verb, result.Deduped, action, formatSize(result.Reclaimed), len(result.Skipped))
+	logger.Info().Msg("------------------------------------------------------------")
+	PrintE(ctx, "Skipped", result.Skipped)
+	if action != icopy.DedupeReport && result.Deduped > 0 {
+		logger.Info().Msgf("Undo with: icopy undo -out %s -run %s", result.Plan.Root, result.Run)
+	}
+}
+
+func PrintR(ctx context.Context, dir string, runs []icopy.JournalRun) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("Runs in %s: %d", dir, len(runs))
+	logger.Info().Msg("------------------------------------------------------------")
+	for _, run := range runs {
+		ops := []string{}
+		for op, n := range run.Ops {
+			ops = append(ops, fmt.Sprintf("%s %d", op, n))
+		}
+		sort.Strings(ops)
+		state := ""
+		if run.Undone {
+			state = " (undone)"
+		}
+		logger.Info().Msgf("%s  %s%s ", run.ID, strings.Join(ops, ", "), state)
+	}
+}
+
+func PrintV(ctx context.Context, msg string, versions []icopy.Version) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Info().Msg("")
+	logger.Info().Msg("------------------------------------------------------------")
+	logger.Info().Msgf("%s: %d", msg, len(versions))
+	logger.Info().Msg("------------------------------------------------------------")
+	path := ""
+	for _, v := range versions {
+		if v.Path != path {
+			logger.Info().Msgf("%s:", v.Path)
+			path = v.Path
+		}
+		logger.Info().Msgf("  %s  %s  %10d bytes ", filepath.Base(v.File), v.Saved.Format(time.RFC3339), v.Size)
+	}
+}
+
+// formatSize renders a byte count with a binary unit, e.g. 1.5 GiB.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// handleSigtem cancels ctx on SIGINT or SIGTERM, so that the command stops
+// taking new files, finishes those in progress and closes its catalogs,
+// which flushes their batches. A second signal exits at once.
+func handleSigtem(ctx context.Context, cancel context.CancelFunc) {
 	logger := ctx.Value("logger").(zerolog.Logger)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM) // SIGINT, SIGKILL, SIGTERM
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM) // SIGINT, SIGTERM
 	go func() {
 		<-c
+		logger.Info().Msg("Signal received. Finishing the files in progress and saving the catalog; signal again to exit at once.")
+		cancel()
 
-		logger.Info().Msg("SIGTERM received. Exiting.")
-		os.Exit(0)
+		<-c
+		logger.Info().Msg("Second signal received. Exiting.")
+		os.Exit(1)
 	}()
 }
+
+// exitIfInterrupted exits with a non-zero status when a signal stopped the
+// command that just returned.
+func exitIfInterrupted(ctx context.Context) {
+	if ctx.Err() != nil {
+		logger := ctx.Value("logger").(zerolog.Logger)
+		logger.Info().Msg("Interrupted. Exiting.")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+package icopy
+
+// bkTree indexes perceptual hashes by Hamming distance. Each child of a node
+// sits at a known distance from it, so by the triangle inequality a search
+// within threshold t of a query at distance d from a node only descends into
+// children between d-t and d+t. With small thresholds that prunes most of the
+// tree, which is what makes clustering a million images practical.
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash     PerceptualHash
+	items    []int // every item with exactly this hash
+	children map[int]*bkNode
+}
+
+func (t *bkTree) Insert(hash PerceptualHash, item int) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, items: []int{item}}
+		return
+	}
+	node := t.root
+	for {
+		d := node.hash.Distance(hash)
+		if d == 0 {
+			node.items = append(node.items, item)
+			return
+		}
+		child, ok := node.children[d]
+		if !ok {
+			if node.children == nil {
+				node.children = map[int]*bkNode{}
+			}
+			node.children[d] = &bkNode{hash: hash, items: []int{item}}
+			return
+		}
+		node = child
+	}
+}
+
+// Search calls fn with every item whose hash is within threshold of hash, and
+// the distance to it.
+func (t *bkTree) Search(hash PerceptualHash, threshold int, fn func(item int, distance int)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := node.hash.Distance(hash)
+		if d <= threshold {
+			for _, item := range node.items {
+				fn(item, d)
+			}
+		}
+		for cd, child := range node.children {
+			if cd >= d-threshold && cd <= d+threshold {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
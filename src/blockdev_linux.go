@@ -0,0 +1,50 @@
+//go:build linux
+
+package icopy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func deviceNumber(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
+
+// probeBlockDevice resolves dev through /sys/dev/block to its disk and reads
+// whether that disk is rotational or removable. Filesystems without a block
+// device (tmpfs, NFS, FUSE) come back unknown.
+func probeBlockDevice(dev uint64) blockDevice {
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(dev), unix.Minor(dev)))
+	if err != nil {
+		return blockDevice{}
+	}
+
+	// Partitions sit inside the directory of the disk they belong to.
+	disk := sysPath
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+		disk = filepath.Dir(sysPath)
+	}
+	name := filepath.Base(disk)
+
+	return blockDevice{
+		name:       name,
+		known:      true,
+		rotational: readSysFlag(filepath.Join("/sys/block", name, "queue", "rotational")),
+		removable:  readSysFlag(filepath.Join("/sys/block", name, "removable")) || strings.HasPrefix(name, "mmcblk"),
+	}
+}
+
+func readSysFlag(path string) bool {
+	b, err := os.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(b)) == "1"
+}
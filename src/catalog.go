@@ -0,0 +1,285 @@
+package icopy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// CatalogDirName is the directory icopy keeps inside a destination library for
+// its own bookkeeping. Directory walks skip it.
+const CatalogDirName = ".icopy"
+
+const (
+	catalogFilePrefix    = "file-"
+	catalogJournalPrefix = "journal-"
+	catalogScrubKey      = "scrub-checkpoint"
+)
+
+// catalogPageSize is how many entries are read at a time by commands that
+// walk the whole catalog.
+var catalogPageSize = 1000
+
+// Scrub outcomes recorded in CatalogEntry.Status.
+const (
+	StatusOK      = "ok"
+	StatusCorrupt = "corrupt"
+	StatusMissing = "missing"
+)
+
+// Catalog is the persistent record of what icopy has placed in a destination.
+// Unlike the scratch ./badger store, which is removed at the end of each run,
+// it lives under <destdir>/.icopy/catalog and survives between runs.
+//
+// Writes go through a BatchWriter, so Get and Entries only see records that
+// have been committed; call Flush first to read back this run's writes.
+type Catalog struct {
+	db    *badger.DB
+	batch *BatchWriter
+	root  string
+	run   string
+	seq   int64
+}
+
+// CatalogEntry describes one file in the destination library.
+type CatalogEntry struct {
+	Path           string    `json:"path"`
+	Source         string    `json:"source"`
+	OriginalName   string    `json:"original_name,omitempty"` // before -rename or -fix-ext
+	Md5Sum         string    `json:"md5sum"`
+	FullMd5Sum     string    `json:"full_md5sum,omitempty"` // of the whole file, when Md5Sum is a fast hash or not
+	EssenceHash    string    `json:"essence_hash,omitempty"`
+	PerceptualHash string    `json:"perceptual_hash,omitempty"`
+	Width          int       `json:"width,omitempty"`
+	Height         int       `json:"height,omitempty"`
+	HasGPS         bool      `json:"has_gps,omitempty"`
+	Mode           string    `json:"mode"`
+	LinkTarget     string    `json:"link_target,omitempty"`
+	DateTime       time.Time `json:"date_time"`
+	CopiedAt       time.Time `json:"copied_at"`
+
+	// LastVerified is when scrub last read the file back, and Status what
+	// it found.
+	LastVerified time.Time `json:"last_verified"`
+	Status       string    `json:"status,omitempty"`
+}
+
+// JournalEntry records one operation icopy performed on the library, in the
+// order it happened, so that it can be reviewed or reversed later.
+type JournalEntry struct {
+	Op     string    `json:"op"`
+	Source string    `json:"source"`
+	Dest   string    `json:"dest"`
+	Time   time.Time `json:"time"`
+	// Run identifies the icopy invocation that wrote the entry, so that a
+	// whole run can be undone.
+	Run string `json:"run,omitempty"`
+	// Undoes is set on OpUndo entries to the run they reversed.
+	Undoes string `json:"undoes,omitempty"`
+}
+
+func OpenCatalog(destdir string) (*Catalog, error) {
+	root, err := filepath.Abs(destdir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(root, CatalogDirName), 0755); err != nil {
+		return nil, err
+	}
+	db, err := OpenBadgerDB(filepath.Join(root, CatalogDirName, "catalog"))
+	if err != nil {
+		return nil, err
+	}
+	batch := NewBatchWriter(db, DefaultBatchSize, DefaultBatchInterval)
+	return &Catalog{db: db, batch: batch, root: root, run: time.Now().Format("20060102-150405.000")}, nil
+}
+
+// Run returns the id journal entries written through c are tagged with.
+func (c *Catalog) Run() string {
+	return c.run
+}
+
+// Flush commits every write made so far.
+func (c *Catalog) Flush() error {
+	return c.batch.Flush()
+}
+
+// Close commits pending writes and closes the catalog. The error is that of
+// the first failed commit, if any.
+func (c *Catalog) Close() error {
+	err := c.batch.Close()
+	CloseBadgerDB(c.db)
+	return err
+}
+
+// Put records entry, keyed by its path relative to the catalog root.
+func (c *Catalog) Put(entry CatalogEntry) error {
+	rel, err := c.relPath(entry.Path)
+	if err != nil {
+		return err
+	}
+	entry.Path = rel
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.batch.Put(catalogFilePrefix+rel, string(value))
+}
+
+// Delete removes the entry recorded for path.
+func (c *Catalog) Delete(path string) error {
+	rel, err := c.relPath(path)
+	if err != nil {
+		return err
+	}
+	return c.batch.Delete(catalogFilePrefix + rel)
+}
+
+// Get returns the entry recorded for path, which may be absolute or relative
+// to the catalog root.
+func (c *Catalog) Get(path string) (CatalogEntry, error) {
+	entry := CatalogEntry{}
+	rel, err := c.relPath(path)
+	if err != nil {
+		return entry, err
+	}
+	value, err := GetBadgerDBValue(c.db, catalogFilePrefix+rel)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal([]byte(value), &entry)
+	return entry, err
+}
+
+// Entries returns every file entry in the catalog, ordered by path.
+func (c *Catalog) Entries() ([]CatalogEntry, error) {
+	entries := []CatalogEntry{}
+	err := c.each(catalogFilePrefix, func(value []byte) error {
+		entry := CatalogEntry{}
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// Journal appends entry to the operation journal.
+func (c *Catalog) Journal(entry JournalEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Run == "" {
+		entry.Run = c.run
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	seq := atomic.AddInt64(&c.seq, 1)
+	key := fmt.Sprintf("%s%020d-%08d", catalogJournalPrefix, entry.Time.UnixNano(), seq)
+	return c.batch.Put(key, string(value))
+}
+
+// entriesAfter returns up to limit entries whose path sorts after the given
+// one, ordered by path. An empty after starts from the first entry.
+func (c *Catalog) entriesAfter(after string, limit int) ([]CatalogEntry, error) {
+	entries := []CatalogEntry{}
+	err := c.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefixKey := []byte(catalogFilePrefix)
+		startKey := []byte(catalogFilePrefix + after)
+		for it.Seek(startKey); it.ValidForPrefix(prefixKey) && len(entries) < limit; it.Next() {
+			if after != "" && bytes.Equal(it.Item().Key(), startKey) {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entry := CatalogEntry{}
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// JournalEntries returns the operation journal, oldest first.
+func (c *Catalog) JournalEntries() ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	err := c.each(catalogJournalPrefix, func(value []byte) error {
+		entry := JournalEntry{}
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (c *Catalog) each(prefix string, fn func(value []byte) error) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefixKey := []byte(prefix)
+		for it.Seek(prefixKey); it.ValidForPrefix(prefixKey); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AbsPath resolves a catalog-relative path against the catalog root.
+func (c *Catalog) AbsPath(rel string) string {
+	return filepath.Join(c.root, filepath.FromSlash(rel))
+}
+
+func (c *Catalog) relPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		abs, err := filepath.Abs(path)
+		if err != nil || !isWithin(c.root, abs) {
+			return filepath.ToSlash(filepath.Clean(path)), nil
+		}
+		path = abs
+	}
+	rel, err := filepath.Rel(c.root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// isWithin reports whether path is lexically inside dir.
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// skipCatalogDir reports whether a directory walk should skip d because it is
+// icopy's own bookkeeping directory.
+func skipCatalogDir(d os.DirEntry) bool {
+	return d.IsDir() && d.Name() == CatalogDirName
+}
@@ -0,0 +1,53 @@
+package icopy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalogPutGet(t *testing.T) {
+	destDir := t.TempDir()
+	catalog, err := OpenCatalog(destDir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	defer catalog.Close()
+
+	entry := CatalogEntry{
+		Path:       filepath.Join(destDir, "2023-10-25", "a.jpg"),
+		Source:     "/media/card/a.jpg",
+		Md5Sum:     "abc",
+		Mode:       ModeHardlink,
+		LinkTarget: "/media/card/a.jpg",
+		DateTime:   time.Date(2023, 10, 25, 12, 0, 0, 0, time.UTC),
+	}
+	if err := catalog.Put(entry); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := catalog.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+
+	got, err := catalog.Get("2023-10-25/a.jpg")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if got.Path != "2023-10-25/a.jpg" {
+		t.Errorf("Expected relative path 2023-10-25/a.jpg, got %s", got.Path)
+	}
+	if got.LinkTarget != entry.LinkTarget || got.Mode != ModeHardlink {
+		t.Errorf("Expected hardlink to %s, got %s to %s", entry.LinkTarget, got.Mode, got.LinkTarget)
+	}
+	if catalog.AbsPath(got.Path) != entry.Path {
+		t.Errorf("AbsPath(%s) = %s; want %s", got.Path, catalog.AbsPath(got.Path), entry.Path)
+	}
+
+	entries, err := catalog.Entries()
+	if err != nil {
+		t.Fatalf("Entries returned error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 entry, got %d", len(entries))
+	}
+}
@@ -0,0 +1,394 @@
+package icopy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Policies for FileProcessor.OnConflict: what happens when a different file
+// already has the name a file is to be copied to.
+const (
+	ConflictSkip      = "skip"
+	ConflictRename    = "rename"
+	ConflictOverwrite = "overwrite"
+	// ConflictVersion overwrites, moving the old file into .icopy/versions
+	// once the new one is written.
+	ConflictVersion = "version"
+	// ConflictAsk sends each conflict to FileProcessor.Prompt, or skips it
+	// when there is no one to ask.
+	ConflictAsk = "ask"
+)
+
+// Answers to a ConflictRequest. The "to all" answers also settle every later
+// conflict of the run without asking.
+const (
+	AnswerYes      = "yes" // overwrite, keeping the old file as a version
+	AnswerNo       = "no"
+	AnswerRename   = "rename"
+	AnswerYesToAll = "yes-to-all"
+	AnswerNoToAll  = "no-to-all"
+)
+
+// ConflictFile describes one side of a conflict.
+type ConflictFile struct {
+	Path     string
+	Size     int64
+	DateTime time.Time
+	Md5Sum   string
+	Width    int
+	Height   int
+}
+
+// ConflictRequest asks whoever reads FileProcessor.Prompt what to do about a
+// file that would replace a different one. Exactly one answer must be sent on
+// Reply.
+type ConflictRequest struct {
+	Existing ConflictFile
+	Incoming ConflictFile
+	Reply    chan<- string
+}
+
+// Suffixes for FileProcessor.RenameSuffix, added before the extension of a
+// renamed file.
+const (
+	SuffixCounter = "counter" // IMG_0001_1.JPG
+	SuffixHash    = "hash"    // IMG_0001_3f2a9c1d.JPG
+	SuffixTime    = "time"    // IMG_0001_20231025-120000.JPG
+)
+
+// shortHashLen is how much of the file hash SuffixHash uses.
+const shortHashLen = 8
+
+// conflictPolicy returns OnConflict, or the policy -overwrite stands for when
+// it is not set. -force has always overwritten; it and -overwrite=yes keep the
+// old file as a version, and only an explicit OnConflict=overwrite destroys
+// it.
+func (fp *FileProcessor) conflictPolicy() string {
+	if fp.ForceCopy && fp.OnConflict != ConflictOverwrite {
+		return ConflictVersion
+	}
+	if fp.OnConflict != "" {
+		return fp.OnConflict
+	}
+	switch strings.ToLower(fp.Overwrite) {
+	case "yes":
+		return ConflictVersion
+	case "ask":
+		return ConflictAsk
+	}
+	// Names made by a template are meant to be unique.
+	if fp.Rename != "" {
+		return ConflictRename
+	}
+	return ConflictSkip
+}
+
+// recopies reports whether files already in the library are copied again, as
+// -force and -overwrite=yes always have.
+func (fp *FileProcessor) recopies() bool {
+	if fp.ForceCopy || fp.OnConflict == ConflictOverwrite {
+		return true
+	}
+	return fp.OnConflict == "" && strings.ToLower(fp.Overwrite) == "yes"
+}
+
+// resolution is what resolveConflict decided for a file in one destination.
+type resolution struct {
+	// path is where the file is to be written, or "" when it is to be
+	// skipped. It is claimed until releaseClaim, so that two workers never
+	// pick the same name.
+	path string
+	// keep is the hash of the file at path when it is to be kept as a
+	// version; replaceKept moves it aside once its replacement is written.
+	keep string
+	// held is the file a skipped one is skipped for, because it already
+	// holds the same content.
+	held string
+}
+
+// resolveConflict decides where image is to be written to in d, starting
+// from fYMpath, or that it is to be skipped: because the path already holds
+// the same content, or because the policy says so.
+func (fp *FileProcessor) resolveConflict(ctx context.Context, d *destination, image FileObject, fYMpath string) (resolution, error) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	policy := fp.conflictPolicy()
+
+	// The lock keeps a name from being taken between the check and the
+	// claim; occupant lets go of it while hashing a file in the way.
+	fp.claimMu.Lock()
+	defer fp.claimMu.Unlock()
+	if fp.claims == nil {
+		fp.claims = map[string]string{}
+	}
+
+	candidate := fYMpath
+	for n := 1; ; n++ {
+		candidate = d.sanitizer.Existing(candidate)
+		sum, claimed, err := fp.occupant(ctx, d, candidate, image.Md5Sum)
+		if err != nil {
+			return resolution{}, err
+		}
+		if sum == "" {
+			fp.claims[d.sanitizer.Key(candidate)] = image.Md5Sum
+			return resolution{path: candidate}, nil
+		}
+		if sum == image.Md5Sum && !fp.ForceCopy {
+			logger.Debug().Msgf("%s already holds %s", candidate, image.Name)
+			return resolution{held: candidate}, nil
+		}
+
+		decision := policy
+		if policy == ConflictAsk {
+			if claimed {
+				// Another file of this run is being written there.
+				return resolution{}, nil
+			}
+			decision = fp.ask(ctx, d, image, candidate, sum)
+		}
+		switch decision {
+		case ConflictRename:
+			if fp.namer != nil && fp.namer.hasSeq {
+				if candidate, err = d.path(image, fp.targetName(image, n+1)); err != nil {
+					return resolution{}, err
+				}
+			} else {
+				candidate = renamed(fYMpath, image, fp.RenameSuffix, n)
+			}
+			continue
+		case ConflictOverwrite, ConflictVersion:
+			if claimed {
+				return resolution{}, nil
+			}
+			fp.claims[d.sanitizer.Key(candidate)] = image.Md5Sum
+			// A forced copy of the same content has nothing worth keeping.
+			if decision == ConflictVersion && sum != image.Md5Sum {
+				return resolution{path: candidate, keep: sum}, nil
+			}
+			return resolution{path: candidate}, nil
+		}
+		return resolution{}, nil
+	}
+}
+
+// replaceKept finishes a copy to t that was written beside the file it
+// replaces, t.replaced, because that file is kept as a version: it moves the
+// old file into the versions and the new one into its place. A copy that
+// failed is removed and the old file left where it was. A moved source is
+// put back rather than removed.
+func (fp *FileProcessor) replaceKept(ctx context.Context, fpath string, t *copyTarget) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	written := t.path
+	t.path = t.replaced
+
+	discard := func() {
+		if t.mode == ModeMove {
+			if err := moveFile(written, fpath); err != nil {
+				logger.Error().Err(err).Msgf("%s is left at %s", fpath, written)
+			}
+			return
+		}
+		os.Remove(written)
+	}
+	if t.err != nil {
+		discard()
+		return
+	}
+	vpath, err := t.dest.catalog.saveVersion(t.replaced, t.keep)
+	if err != nil {
+		t.err = err
+		discard()
+		return
+	}
+	if err := os.Rename(written, t.replaced); err != nil {
+		t.err = err
+		if err := moveFile(vpath, t.replaced); err != nil {
+			logger.Error().Err(err).Msgf("The file at %s is kept at %s", t.replaced, vpath)
+		}
+		discard()
+		return
+	}
+	if _, err := t.dest.catalog.pruneVersions(t.replaced, fp.VersionRetention); err != nil {
+		logger.Error().Err(err).Msgf("Failed to prune versions of %s", t.replaced)
+	}
+}
+
+// ask settles a conflict at fYMpath through fp.Prompt and returns the policy
+// to apply to it. Called with claimMu held, it claims fYMpath and lets go of
+// the lock while waiting, so that other workers carry on.
+func (fp *FileProcessor) ask(ctx context.Context, d *destination, image FileObject, fYMpath string, sum string) string {
+	if fp.answerAll != "" {
+		return fp.answerAll
+	}
+	if fp.Prompt == nil {
+		return ConflictSkip
+	}
+
+	existing := describeFile(fYMpath, sum)
+	if entry, err := d.catalog.Get(fYMpath); err == nil && !entry.DateTime.IsZero() {
+		existing.DateTime = entry.DateTime
+	}
+	incoming := describeFile(filepath.Join(image.Path, image.Name), image.Md5Sum)
+	incoming.DateTime = image.DateTime
+
+	fp.claims[d.sanitizer.Key(fYMpath)] = sum
+	fp.claimMu.Unlock()
+	reply := make(chan string, 1)
+	var answer string
+	select {
+	case fp.Prompt <- ConflictRequest{Existing: existing, Incoming: incoming, Reply: reply}:
+		select {
+		case answer = <-reply:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	fp.claimMu.Lock()
+	delete(fp.claims, d.sanitizer.Key(fYMpath))
+
+	switch answer {
+	case AnswerYes:
+		return ConflictVersion
+	case AnswerRename:
+		return ConflictRename
+	case AnswerYesToAll:
+		fp.answerAll = ConflictVersion
+	case AnswerNoToAll:
+		fp.answerAll = ConflictSkip
+	default:
+		return ConflictSkip
+	}
+	return fp.answerAll
+}
+
+// describeFile gathers what a conflict prompt shows about fpath. DateTime is
+// the modification time; callers that know the capture date replace it.
+func describeFile(fpath string, sum string) ConflictFile {
+	f := ConflictFile{Path: fpath, Md5Sum: sum}
+	if fi, err := os.Stat(fpath); err == nil {
+		f.Size = fi.Size()
+		f.DateTime = fi.ModTime()
+	}
+	if fd, err := os.Open(fpath); err == nil {
+		if canDecode(fpath, sniffReader(fd)) {
+			if config, _, err := image.DecodeConfig(fd); err == nil {
+				f.Width, f.Height = config.Width, config.Height
+			}
+		}
+		fd.Close()
+	}
+	return f
+}
+
+// FirstDifference returns the offset of the first byte at which the files a
+// and b differ, or -1 when they are the same. A file that is a prefix of the
+// other differs at its end.
+func FirstDifference(a string, b string) (int64, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return 0, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return 0, err
+	}
+	defer fb.Close()
+
+	ra, rb := bufio.NewReader(fa), bufio.NewReader(fb)
+	for off := int64(0); ; off++ {
+		ca, erra := ra.ReadByte()
+		cb, errb := rb.ReadByte()
+		if erra == io.EOF && errb == io.EOF {
+			return -1, nil
+		}
+		if erra != nil && erra != io.EOF {
+			return 0, erra
+		}
+		if errb != nil && errb != io.EOF {
+			return 0, errb
+		}
+		if erra != nil || errb != nil || ca != cb {
+			return off, nil
+		}
+	}
+}
+
+// releaseClaim lets other workers see fYMpath on disk instead of in the claims.
+func (fp *FileProcessor) releaseClaim(d *destination, fYMpath string) {
+	fp.claimMu.Lock()
+	defer fp.claimMu.Unlock()
+	delete(fp.claims, d.sanitizer.Key(fYMpath))
+}
+
+// occupant returns the hash of what is at fYMpath in d, in the same form as
+// like, or "" when nothing is. claimed is set when it is a file still being
+// written by this run, under this name or, when d does not tell case apart,
+// one differing only in case. Called with claimMu held, it lets go of the
+// lock while hashing, so that a large file in the way does not hold up the
+// other workers, and looks again if the path was claimed or changed meanwhile.
+func (fp *FileProcessor) occupant(ctx context.Context, d *destination, fYMpath string, like string) (sum string, claimed bool, err error) {
+	key := d.sanitizer.Key(fYMpath)
+	for {
+		if sum, ok := fp.claims[key]; ok {
+			return sum, true, nil
+		}
+		fi, err := os.Stat(fYMpath)
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if fi.IsDir() {
+			return "", false, fmt.Errorf("%s is a directory", fYMpath)
+		}
+
+		fp.claimMu.Unlock()
+		sum, err = computeFileHash(ctx, fYMpath, strings.HasPrefix(like, "fast-"), fp.Throttle)
+		fp.claimMu.Lock()
+
+		if _, ok := fp.claims[key]; ok {
+			continue
+		}
+		after, serr := os.Stat(fYMpath)
+		if serr == nil && os.SameFile(fi, after) && after.Size() == fi.Size() && after.ModTime().Equal(fi.ModTime()) {
+			return sum, false, err
+		}
+		if ctx.Err() != nil {
+			return "", false, ctx.Err()
+		}
+	}
+}
+
+// renamed returns the n-th alternative to fYMpath for image. The hash and
+// time suffixes fall back to adding a counter after them in the unlikely case
+// that they are taken too.
+func renamed(fYMpath string, image FileObject, suffix string, n int) string {
+	ext := filepath.Ext(fYMpath)
+	base := strings.TrimSuffix(fYMpath, ext)
+	switch suffix {
+	case SuffixHash:
+		sum := strings.TrimPrefix(image.Md5Sum, "fast-")
+		if len(sum) > shortHashLen {
+			sum = sum[:shortHashLen]
+		}
+		base += "_" + sum
+	case SuffixTime:
+		base += "_" + image.DateTime.Format("20060102-150405")
+	default:
+		return fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	if n > 1 {
+		base = fmt.Sprintf("%s_%d", base, n-1)
+	}
+	return base + ext
+}
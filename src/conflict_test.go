@@ -0,0 +1,307 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRenamed(t *testing.T) {
+	image := FileObject{
+		Md5Sum:   "3f2a9c1d5e6b7a8c9d0e1f2a3b4c5d6e",
+		DateTime: time.Date(2023, 10, 25, 12, 0, 0, 0, time.UTC),
+	}
+	fYMpath := filepath.Join("out", "IMG_0001.JPG")
+
+	tests := []struct {
+		suffix   string
+		n        int
+		expected string
+	}{
+		{SuffixCounter, 1, "IMG_0001_1.JPG"},
+		{SuffixCounter, 2, "IMG_0001_2.JPG"},
+		{SuffixHash, 1, "IMG_0001_3f2a9c1d.JPG"},
+		{SuffixHash, 2, "IMG_0001_3f2a9c1d_1.JPG"},
+		{SuffixTime, 1, "IMG_0001_20231025-120000.JPG"},
+		{SuffixTime, 3, "IMG_0001_20231025-120000_2.JPG"},
+	}
+	for _, tt := range tests {
+		result := renamed(fYMpath, image, tt.suffix, tt.n)
+		if result != filepath.Join("out", tt.expected) {
+			t.Errorf("renamed(%s, %d) = %s; want %s", tt.suffix, tt.n, result, tt.expected)
+		}
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "IMG_0001.JPG")
+	os.WriteFile(existing, []byte("first card"), 0644)
+	existingSum, _ := Md5Sum(existing)
+
+	other := FileObject{Name: "IMG_0001.JPG", Md5Sum: "d41d8cd98f00b204e9800998ecf8427e"}
+	same := FileObject{Name: "IMG_0001.JPG", Md5Sum: existingSum}
+
+	resolve := func(policy string, image FileObject, fYMpath string) string {
+		fp := &FileProcessor{OnConflict: policy}
+		if err := fp.openDestinations(ctx, []Destination{{Dir: dir}}); err != nil {
+			t.Fatalf("openDestinations returned error: %v", err)
+		}
+		defer fp.closeDestinations(ctx)
+		r, err := fp.resolveConflict(ctx, fp.destinations[0], image, fYMpath)
+		if err != nil {
+			t.Fatalf("resolveConflict(%s) returned error: %v", policy, err)
+		}
+		return r.path
+	}
+
+	if path := resolve(ConflictSkip, other, filepath.Join(dir, "new.jpg")); path != filepath.Join(dir, "new.jpg") {
+		t.Errorf("Expected a free name to be used as is, got %q", path)
+	}
+	if path := resolve(ConflictRename, same, existing); path != "" {
+		t.Errorf("Expected identical content to be skipped as a duplicate, got %q", path)
+	}
+	if path := resolve(ConflictSkip, other, existing); path != "" {
+		t.Errorf("Expected skip to skip, got %q", path)
+	}
+	if path := resolve(ConflictOverwrite, other, existing); path != existing {
+		t.Errorf("Expected overwrite to reuse the name, got %q", path)
+	}
+
+	os.WriteFile(filepath.Join(dir, "IMG_0001_1.JPG"), []byte("second card"), 0644)
+	if path := resolve(ConflictRename, other, existing); path != filepath.Join(dir, "IMG_0001_2.JPG") {
+		t.Errorf("Expected the first free counter, got %q", path)
+	}
+
+	// A name being written by another worker is taken, even before it is on disk.
+	fp := &FileProcessor{OnConflict: ConflictRename}
+	fp.openDestinations(ctx, []Destination{{Dir: dir}})
+	claimed := filepath.Join(dir, "IMG_0002.JPG")
+	r1, _ := fp.resolveConflict(ctx, fp.destinations[0], same, claimed)
+	r2, _ := fp.resolveConflict(ctx, fp.destinations[0], other, claimed)
+	first, second := r1.path, r2.path
+	fp.releaseClaim(fp.destinations[0], first)
+	fp.closeDestinations(ctx)
+	if first != claimed || second != filepath.Join(dir, "IMG_0002_1.JPG") {
+		t.Errorf("Expected %s and IMG_0002_1.JPG, got %s and %s", claimed, first, second)
+	}
+
+	// The file in the way stays until its replacement is written.
+	fp = &FileProcessor{OnConflict: ConflictVersion}
+	fp.openDestinations(ctx, []Destination{{Dir: dir}})
+	r, _ := fp.resolveConflict(ctx, fp.destinations[0], other, existing)
+	path, keep := r.path, r.keep
+	fp.closeDestinations(ctx)
+	if path != existing || keep != existingSum {
+		t.Errorf("Expected version to reuse the name and keep %s, got %q and %q", existingSum, path, keep)
+	}
+	if content, _ := os.ReadFile(existing); string(content) != "first card" {
+		t.Error("Expected the old file to be left in place")
+	}
+}
+
+func TestResolveConflictAsk(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "IMG_0001.JPG")
+	os.WriteFile(existing, []byte("first card"), 0644)
+	incoming := FileObject{Name: "IMG_0001.JPG", Path: dir, Md5Sum: "d41d8cd98f00b204e9800998ecf8427e"}
+
+	fp := &FileProcessor{Overwrite: "ask"}
+	fp.openDestinations(ctx, []Destination{{Dir: dir}})
+	defer fp.closeDestinations(ctx)
+	d := fp.destinations[0]
+
+	if r, _ := fp.resolveConflict(ctx, d, incoming, existing); r.path != "" || r.held != "" {
+		t.Errorf("Expected a conflict to be skipped with no one to ask, got %+v", r)
+	}
+
+	prompt := make(chan ConflictRequest)
+	fp.Prompt = prompt
+	asked := 0
+	answers := []string{AnswerRename, AnswerYesToAll}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for req := range prompt {
+			if req.Existing.Path != existing || req.Existing.Size != int64(len("first card")) {
+				t.Errorf("Expected the existing file to be described, got %+v", req.Existing)
+			}
+			req.Reply <- answers[asked]
+			asked++
+		}
+	}()
+
+	if r, _ := fp.resolveConflict(ctx, d, incoming, existing); r.path != filepath.Join(dir, "IMG_0001_1.JPG") {
+		t.Errorf("Expected rename to pick IMG_0001_1.JPG, got %q", r.path)
+	}
+	kept := 0
+	if r, _ := fp.resolveConflict(ctx, d, incoming, existing); r.path != existing {
+		t.Errorf("Expected yes to all to overwrite, got %q", r.path)
+	} else if r.keep != "" {
+		kept++
+	}
+	fp.releaseClaim(d, existing)
+	os.WriteFile(existing, []byte("second card"), 0644)
+	if r, _ := fp.resolveConflict(ctx, d, incoming, existing); r.path != existing {
+		t.Errorf("Expected yes to all to apply without asking, got %q", r.path)
+	} else if r.keep != "" {
+		kept++
+	}
+	close(prompt)
+	<-done
+	if asked != 2 {
+		t.Errorf("Expected two prompts, got %d", asked)
+	}
+	if kept != 2 {
+		t.Errorf("Expected both overwritten files to be kept as versions, got %d", kept)
+	}
+}
+
+func TestFirstDifference(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+	a, b, c := write("a", "abcdef"), write("b", "abcxef"), write("c", "abc")
+
+	tests := []struct {
+		x, y     string
+		expected int64
+	}{
+		{a, a, -1},
+		{a, b, 3},
+		{a, c, 3},
+	}
+	for _, tt := range tests {
+		off, err := FirstDifference(tt.x, tt.y)
+		if err != nil || off != tt.expected {
+			t.Errorf("FirstDifference(%s, %s) = %d, %v; want %d", filepath.Base(tt.x), filepath.Base(tt.y), off, err, tt.expected)
+		}
+	}
+}
+
+func TestResolveConflictRenameTemplate(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	image := FileObject{Name: "IMG_0001.JPG", DateTime: time.Date(2023, 2, 5, 9, 30, 15, 0, time.UTC), Md5Sum: "d41d8cd98f00b204e9800998ecf8427e"}
+	os.WriteFile(filepath.Join(dir, "20230205_093015_1.jpg"), []byte("burst 1"), 0644)
+	os.WriteFile(filepath.Join(dir, "20230205_093015_2.jpg"), []byte("burst 2"), 0644)
+
+	fp := &FileProcessor{Rename: "{date}_{seq}.{ext}"}
+	if err := fp.openDestinations(ctx, []Destination{{Dir: dir}}); err != nil {
+		t.Fatalf("openDestinations returned error: %v", err)
+	}
+	defer fp.closeDestinations(ctx)
+
+	r, err := fp.resolveConflict(ctx, fp.destinations[0], image, filepath.Join(dir, fp.namer.Name(image, 1)))
+	if err != nil {
+		t.Fatalf("resolveConflict returned error: %v", err)
+	}
+	if r.path != filepath.Join(dir, "20230205_093015_3.jpg") {
+		t.Errorf("Expected {seq} to count up to a free name, got %q", r.path)
+	}
+}
+
+func TestResolveConflictHashesOutsideLock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "logger", zerolog.Nop()))
+	defer cancel()
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "IMG_0001.JPG")
+	os.WriteFile(existing, make([]byte, 2*minBurst), 0644)
+	incoming := FileObject{Name: "IMG_0001.JPG", Md5Sum: "d41d8cd98f00b204e9800998ecf8427e"}
+
+	// Reading the file in the way takes seconds at this rate.
+	fp := &FileProcessor{OnConflict: ConflictRename, Throttle: NewThrottle(1024, 0, 0)}
+	fp.openDestinations(ctx, []Destination{{Dir: dir}})
+	defer fp.closeDestinations(ctx)
+	d := fp.destinations[0]
+
+	resolved := make(chan string)
+	go func() {
+		r, _ := fp.resolveConflict(ctx, d, incoming, existing)
+		resolved <- r.path
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if !fp.claimMu.TryLock() {
+		t.Fatal("Expected the claim lock to be free while the occupant is hashed")
+	}
+	// Another worker claims the name meanwhile, so it is looked at again.
+	fp.claims[d.sanitizer.Key(existing)] = "3f2a9c1d5e6b7a8c9d0e1f2a3b4c5d6e"
+	fp.claimMu.Unlock()
+	cancel()
+
+	if path := <-resolved; path != filepath.Join(dir, "IMG_0001_1.JPG") {
+		t.Errorf("Expected the claimed name to be passed over, got %q", path)
+	}
+}
+
+func TestCopyKeepsReplacedFile(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	t.Chdir(t.TempDir())
+	src := t.TempDir()
+	out := t.TempDir()
+	fpath := filepath.Join(src, "a.jpg")
+	os.WriteFile(fpath, []byte("\xFF\xD8\xFF\xE0second card"), 0644)
+	sum, _ := Md5Sum(fpath)
+	image := FileObject{Name: "a.jpg", Path: src, Md5Sum: sum, MediaType: MediaImage, DateTime: time.Date(2023, 10, 25, 12, 0, 0, 0, time.UTC)}
+
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+	fp := &FileProcessor{DateFmt: "DATE", OnConflict: ConflictVersion}
+	if err := fp.openDestinations(ctx, []Destination{{Dir: out}}); err != nil {
+		t.Fatalf("openDestinations returned error: %v", err)
+	}
+	defer fp.closeDestinations(ctx)
+	d := fp.destinations[0]
+	library, _ := d.path(image, image.Name)
+	os.MkdirAll(filepath.Dir(library), 0755)
+	os.WriteFile(library, []byte("first card"), 0644)
+
+	copyOnce := func() int {
+		copyChan, errorChan, skipChan := make(chan FileObject, 1), make(chan ErroredFileObject, 1), make(chan FileObject, 1)
+		var counter int64
+		fp.processCopy(ctx, db, image, copyChan, errorChan, skipChan, &counter)
+		return len(errorChan)
+	}
+
+	// The source cannot be read, so the library file is left alone.
+	os.Rename(fpath, fpath+".away")
+	if errored := copyOnce(); errored != 1 {
+		t.Fatalf("Expected the copy to fail, got %d errors", errored)
+	}
+	if content, _ := os.ReadFile(library); string(content) != "first card" {
+		t.Errorf("Expected the library file in place after a failed copy, got %q", content)
+	}
+	if versions, _ := d.catalog.versions(library); len(versions) != 0 {
+		t.Errorf("Expected no version saved for a failed copy, got %d", len(versions))
+	}
+
+	os.Rename(fpath+".away", fpath)
+	if errored := copyOnce(); errored != 0 {
+		t.Fatalf("Expected the copy to succeed, got %d errors", errored)
+	}
+	if content, _ := os.ReadFile(library); string(content) != "\xFF\xD8\xFF\xE0second card" {
+		t.Errorf("Expected the copy in the library, got %q", content)
+	}
+	versions, _ := d.catalog.versions(library)
+	if len(versions) != 1 {
+		t.Fatalf("Expected the replaced file saved as a version, got %d", len(versions))
+	}
+	if content, _ := os.ReadFile(versions[0].File); string(content) != "first card" {
+		t.Errorf("Expected the version to hold the old file, got %q", content)
+	}
+	if _, err := os.Stat(library + tmpSuffix); !os.IsNotExist(err) {
+		t.Error("Expected nothing left beside the library file")
+	}
+}
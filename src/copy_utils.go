@@ -6,8 +6,8 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,50 +20,116 @@ type FileProcessor struct {
 	Overwrite    string
 	ForceCopy    bool
 	Recursive    bool
+	FollowLinks  bool // enter symbolic links to directories in the source
 	DateFmt      string
 	UseFastHash  bool
 	NumWorkers   int
 	ProgressChan chan string
+	Mode         string // copy, hardlink, symlink or move
+	CrossDevice  string // copy or refuse, for hardlinks across filesystems
+	Verify       bool   // read back each copy and compare it with the source
+	Throttle     *Throttle
+	Sizer        *WorkerSizer // sizes worker pools per device; NumWorkers, when set, overrides it
+	Unsorted     bool         // copy files as they are found rather than oldest first
+	Filter       *Filter      // source files to leave out
+	// MediaTypes are what CopyMediaFilesTo reads; every type when empty.
+	MediaTypes []string
+	// FixExtensions gives copies whose content is not what their extension
+	// says the usual extension of their format.
+	FixExtensions bool
+	// UseEssenceHash also treats a file as a duplicate when its image or
+	// media payload is already in the destination, whatever its metadata.
+	UseEssenceHash bool
+	// UsePerceptualHash records a perceptual hash of each image in the
+	// catalog, for finding resized and recompressed copies.
+	UsePerceptualHash bool
+	// OnConflict is what happens when a different file already has the name
+	// a file is copied to: skip, rename, overwrite or version. When empty,
+	// Overwrite decides.
+	OnConflict string
+	// RenameSuffix is how OnConflict=rename tells the names apart: counter,
+	// hash or time.
+	RenameSuffix string
+	// Layout fills in the -dirformat and Rename tokens that do not come from
+	// the file.
+	Layout LayoutOptions
+	// Rename, when set, is the template copies are named by; see
+	// ParseNameFormat. Conflicts are then renamed unless OnConflict says
+	// otherwise.
+	Rename string
+	// Preserve lists the attributes copies keep from their source, besides
+	// the modification time.
+	Preserve Preserve
+	// XMPSidecar writes an XMP sidecar with the original name next to each
+	// renamed file.
+	XMPSidecar bool
+	// VersionRetention prunes the versions kept of a file each time another
+	// is saved.
+	VersionRetention VersionRetention
+	// Prompt receives the conflicts OnConflict=ask leaves to the user, one
+	// at a time. When nil, they are skipped.
+	Prompt chan<- ConflictRequest
+
+	destinations []*destination
+	namer        *NameLayout
+	claimMu      sync.Mutex
+	claims       map[string]string // paths being written, and their hashes
+	answerAll    string            // policy a "to all" answer settled on
+	// preserveWarned holds the destinations and attributes already warned
+	// about as not preserved.
+	preserveWarned sync.Map
 }
 
 func (fp *FileProcessor) CopyImageFiles(ctx context.Context, srcdir string, destdir string) ([]FileObject, []ErroredFileObject, []FileObject) {
-	logger := ctx.Value("logger").(zerolog.Logger)
-
-	db, err := OpenBadgerDB("./badger")
-	if err != nil {
-		logger.Panic().Err(err).Msg("Failed to open badger db")
-	}
-
-	options := ScanOptions{
-		Recursive:    fp.Recursive,
-		NumWorkers:   fp.NumWorkers,
-		UseFastHash:  fp.UseFastHash,
-		ProgressChan: fp.ProgressChan,
-	}
+	return fp.CopyImageFilesTo(ctx, srcdir, []Destination{{Dir: destdir}})
+}
 
-	imagefiles, erroredfiles := ReadJpegDate(ctx, db, srcdir, options)
+func (fp *FileProcessor) CopyVideoFiles(ctx context.Context, srcdir string, destdir string) ([]FileObject, []ErroredFileObject, []FileObject) {
+	return fp.CopyVideoFilesTo(ctx, srcdir, []Destination{{Dir: destdir}})
+}
 
-	ScanAndGenerateMd5sumFiles(ctx, db, destdir, "dst", options)
+// CopyImageFilesTo copies images to every destination in one pass: each
+// source file is read once and written to all destinations that lack it.
+func (fp *FileProcessor) CopyImageFilesTo(ctx context.Context, srcdir string, dests []Destination) ([]FileObject, []ErroredFileObject, []FileObject) {
+	return fp.copyMediaFileLists(ctx, srcdir, dests, StreamJpegDate)
+}
 
-	SortFilesByDate(imagefiles)
+// CopyVideoFilesTo copies videos to every destination in one pass: each
+// source file is read once and written to all destinations that lack it.
+func (fp *FileProcessor) CopyVideoFilesTo(ctx context.Context, srcdir string, dests []Destination) ([]FileObject, []ErroredFileObject, []FileObject) {
+	return fp.copyMediaFileLists(ctx, srcdir, dests, StreamVideoCreationTimeMetadata)
+}
 
-	if !fp.ForceCopy {
-		imagefiles = checkStatusFile(ctx, imagefiles)
-		if len(imagefiles) == 0 {
-			CloseBadgerDB(db)
-			return nil, erroredfiles, nil
-		}
-	}
+func (fp *FileProcessor) CopyMediaFiles(ctx context.Context, srcdir string, destdir string) ([]FileObject, []ErroredFileObject, []FileObject) {
+	return fp.CopyMediaFilesTo(ctx, srcdir, []Destination{{Dir: destdir}})
+}
 
-	filesCopied, erroredfiles1, skipedfiles := fp.copyFile(ctx, db, imagefiles, destdir)
-	erroredfiles = append(erroredfiles, erroredfiles1...)
+// CopyMediaFilesTo copies the files of every type in fp.MediaTypes to every
+// destination in a single walk of the source and a single copy pool, each
+// file read with the reader for its type.
+func (fp *FileProcessor) CopyMediaFilesTo(ctx context.Context, srcdir string, dests []Destination) ([]FileObject, []ErroredFileObject, []FileObject) {
+	return fp.copyMediaFileLists(ctx, srcdir, dests, StreamMedia)
+}
 
-	CloseBadgerDB(db)
+// CopyMedia is CopyMediaFilesTo for imports of any size: it returns counts
+// rather than every file, so memory does not grow with the import.
+func (fp *FileProcessor) CopyMedia(ctx context.Context, srcdir string, dests []Destination) *CopySummary {
+	summary := &CopySummary{}
+	fp.copyMediaFiles(ctx, srcdir, dests, StreamMedia, summary)
+	return summary
+}
 
-	return filesCopied, erroredfiles, skipedfiles
+func (fp *FileProcessor) copyMediaFileLists(ctx context.Context, srcdir string, dests []Destination, stream MediaStreamer) ([]FileObject, []ErroredFileObject, []FileObject) {
+	lists := newFileLists()
+	fp.copyMediaFiles(ctx, srcdir, dests, stream, lists)
+	return lists.filesCopied, lists.erroredFiles, lists.skipedfiles
 }
 
-func (fp *FileProcessor) CopyVideoFiles(ctx context.Context, srcdir string, destdir string) ([]FileObject, []ErroredFileObject, []FileObject) {
+// copyMediaFiles runs the import as a pipeline: walking the source, reading
+// metadata and copying all overlap, connected by bounded queues, and the
+// outcome of each file goes to sink. Unless Unsorted is set, copying waits for
+// the walk so that files go oldest first, sorted on disk past sortSpillSize.
+func (fp *FileProcessor) copyMediaFiles(ctx context.Context, srcdir string, dests []Destination, stream MediaStreamer, sink copySink) {
 	logger := ctx.Value("logger").(zerolog.Logger)
 
 	db, err := OpenBadgerDB("./badger")
@@ -71,72 +137,147 @@ func (fp *FileProcessor) CopyVideoFiles(ctx context.Context, srcdir string, dest
 		logger.Panic().Err(err).Msg("Failed to open badger db")
 	}
 
-	options := ScanOptions{
-		Recursive:    fp.Recursive,
-		NumWorkers:   fp.NumWorkers,
-		UseFastHash:  fp.UseFastHash,
-		ProgressChan: fp.ProgressChan,
+	fp.Layout.Source = srcdir
+	if err := fp.openDestinations(ctx, dests); err != nil {
+		logger.Panic().Err(err).Msg("Failed to open catalog")
 	}
+	defer fp.closeDestinations(ctx)
 
-	videofiles, erroredfiles := ReadVideoCreationTimeMetadata(ctx, db, srcdir, options)
+	options := fp.scanOptions()
 
-	SortFilesByDate(videofiles)
+	// Destinations are hashed first so the duplicate check is complete before
+	// the first source file reaches the copy workers.
+	for _, d := range fp.destinations {
+		ScanAndGenerateMd5sumFiles(ctx, db, d.Dir, d.prefix, options)
+	}
+
+	found := make(chan FileObject, pipelineQueueSize)
+	erroredChan := make(chan ErroredFileObject, pipelineQueueSize)
+	go func() {
+		stream(ctx, db, srcdir, options, found, erroredChan)
+		close(found)
+		close(erroredChan)
+	}()
 
-	if !fp.ForceCopy {
-		videofiles = checkStatusFile(ctx, videofiles)
-		if len(videofiles) == 0 {
-			CloseBadgerDB(db)
-			return nil, erroredfiles, nil
+	erroredDone := make(chan struct{})
+	go func() {
+		defer close(erroredDone)
+		for e := range erroredChan {
+			sink.errored(e)
 		}
+	}()
+
+	pending := fp.filterCopied(ctx, db, found)
+	if !fp.Unsorted {
+		sorted := make(chan FileObject, pipelineQueueSize)
+		go func(in <-chan FileObject) {
+			if err := SortStreamByDate(in, sorted, sortSpillSize); err != nil {
+				logger.Error().Err(err).Msg("Failed to sort files by date")
+			}
+		}(pending)
+		pending = sorted
 	}
 
-	filesCopied, erroredfiles1, skipedfiles := fp.copyFile(ctx, db, videofiles, destdir)
-	erroredfiles = append(erroredfiles, erroredfiles1...)
+	fp.copyFile(ctx, db, pending, sink)
+	<-erroredDone
 
 	CloseBadgerDB(db)
+}
 
-	return filesCopied, erroredfiles, skipedfiles
+// filterCopied drops files the status file records as already copied, unless
+// ForceCopy is set. The status file is loaded into db rather than memory.
+func (fp *FileProcessor) filterCopied(ctx context.Context, db *badger.DB, in <-chan FileObject) <-chan FileObject {
+	if fp.ForceCopy {
+		return in
+	}
+
+	err := loadStatusFile(ctx, db)
+	out := make(chan FileObject, pipelineQueueSize)
+	go func() {
+		defer close(out)
+		for image := range in {
+			if err != nil {
+				continue
+			}
+			if _, err := GetBadgerDBValue(db, statusKey(path.Join(image.Path, image.Name))); err == nil {
+				continue
+			}
+			out <- image
+		}
+	}()
+	return out
+}
+
+// targetName is the name image is copied under, seq being the number {seq}
+// stands for: the name Rename gives it, or its own, with the extension fixed
+// when FixExtensions asks for it.
+func (fp *FileProcessor) targetName(image FileObject, seq int) string {
+	if fp.FixExtensions && image.WrongExt {
+		image.Name = fixExtension(image.Name, image.Format)
+	}
+	if fp.namer != nil {
+		return fp.namer.Name(image, seq)
+	}
+	return image.Name
 }
 
-func (fp *FileProcessor) copyFile(ctx context.Context, db *badger.DB, imagefiles []FileObject, destdir string) ([]FileObject, []ErroredFileObject, []FileObject) {
-	filesCopied := []FileObject{}
-	erroredFiles := []ErroredFileObject{}
-	skipedfiles := []FileObject{}
+func (fp *FileProcessor) scanOptions() ScanOptions {
+	return ScanOptions{
+		Recursive:         fp.Recursive,
+		FollowLinks:       fp.FollowLinks,
+		NumWorkers:        fp.NumWorkers,
+		UseFastHash:       fp.UseFastHash,
+		UseEssenceHash:    fp.UseEssenceHash,
+		UsePerceptualHash: fp.UsePerceptualHash,
+		ProgressChan:      fp.ProgressChan,
+		Filter:            fp.Filter,
+		MediaTypes:        fp.MediaTypes,
+		Throttle:          fp.Throttle,
+		Sizer:             fp.Sizer,
+	}
+}
 
+func (fp *FileProcessor) copyFile(ctx context.Context, db *badger.DB, imagefiles <-chan FileObject, sink copySink) {
 	copyChan := make(chan FileObject)
 	errorChan := make(chan ErroredFileObject)
 	skipChan := make(chan FileObject)
 
-	jobs := make(chan FileObject, len(imagefiles))
 	var wg sync.WaitGroup
-	numWorkers := fp.NumWorkers // Adjust based on needs
+	// Every worker writes to all destinations, so the slowest one sets the pace.
+	options := fp.scanOptions()
+	numWorkers := 0
+	for _, d := range fp.destinations {
+		if n := options.workers(ctx, PoolWrite, d.Dir); numWorkers == 0 || n < numWorkers {
+			numWorkers = n
+		}
+	}
 	if numWorkers <= 0 {
-		numWorkers = 10
+		numWorkers = defaultWorkers
 	}
-	var counter int64
+	var counter, taken int64
 
 	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for image := range jobs {
+			for image := range imagefiles {
+				// Once interrupted, the queue is drained without copying.
+				if ctx.Err() != nil {
+					continue
+				}
+				current := atomic.AddInt64(&taken, 1)
 				if fp.ProgressChan != nil {
-					current := atomic.LoadInt64(&counter) + 1
 					select {
-					case fp.ProgressChan <- fmt.Sprintf("Copying (%d/%d): %s", current, len(imagefiles), image.Name):
+					case fp.ProgressChan <- fmt.Sprintf("Copying (%d): %s", current, image.Name):
 					default:
 					}
 				}
-				fp.processCopy(ctx, db, image, destdir, copyChan, errorChan, skipChan, &counter, len(imagefiles))
+				fp.Throttle.WaitFile(ctx)
+				fp.processCopy(ctx, db, image, copyChan, errorChan, skipChan, &counter)
 			}
 		}()
 	}
 
-	for _, image := range imagefiles {
-		jobs <- image
-	}
-	close(jobs)
-
 	collectorDone := make(chan struct{})
 	go func() {
 		defer close(collectorDone)
@@ -148,21 +289,21 @@ func (fp *FileProcessor) copyFile(ctx context.Context, db *badger.DB, imagefiles
 					copyChan = nil
 					openChannels--
 				} else {
-					filesCopied = append(filesCopied, f)
+					sink.copied(f)
 				}
 			case e, ok := <-errorChan:
 				if !ok {
 					errorChan = nil
 					openChannels--
 				} else {
-					erroredFiles = append(erroredFiles, e)
+					sink.errored(e)
 				}
 			case s, ok := <-skipChan:
 				if !ok {
 					skipChan = nil
 					openChannels--
 				} else {
-					skipedfiles = append(skipedfiles, s)
+					sink.skipped(s)
 				}
 			}
 		}
@@ -173,96 +314,214 @@ func (fp *FileProcessor) copyFile(ctx context.Context, db *badger.DB, imagefiles
 	close(errorChan)
 	close(skipChan)
 	<-collectorDone
-
-	return filesCopied, erroredFiles, skipedfiles
 }
 
-func (fp *FileProcessor) processCopy(ctx context.Context, db *badger.DB, image FileObject, destdir string,
+func (fp *FileProcessor) processCopy(ctx context.Context, db *badger.DB, image FileObject,
 	copyChan chan<- FileObject, errorChan chan<- ErroredFileObject, skipChan chan<- FileObject,
-	counter *int64, total int) {
+	counter *int64) {
 
 	logger := ctx.Value("logger").(zerolog.Logger)
 	tm := image.DateTime
-	fpath := filepath.Join(image.Path, image.Name)
 
-	value, err := GetBadgerDBValue(db, "dst-"+image.Md5Sum)
-	if (err == nil || value != "") && fp.Overwrite == "no" && !fp.ForceCopy {
-		skipChan <- FileObject{Path: image.Path, Name: image.Name, DateTime: tm}
-		return
+	targets := []*copyTarget{}
+	// Sidecars go next to image wherever it is placed or already was.
+	owners := []sidecarOwnerTarget{}
+	// held counts the destinations that already hold the file.
+	held := 0
+	for _, d := range fp.destinations {
+		value, err := GetBadgerDBValue(db, d.prefix+"-"+image.Md5Sum)
+		if err != nil && image.EssenceHash != "" {
+			value, err = GetBadgerDBValue(db, essenceKey(d.prefix, image.EssenceHash))
+		}
+		if (err == nil || value != "") && !fp.recopies() {
+			skipChan <- FileObject{Path: image.Path, Name: image.Name, DateTime: tm, MediaType: image.MediaType, Destination: d.Dir}
+			held++
+			if value != "" {
+				owners = append(owners, sidecarOwnerTarget{dest: d, path: value})
+			}
+			continue
+		}
+
+		fYMpath, err := d.path(image, fp.targetName(image, 1))
+		if err != nil {
+			logger.Error().Err(err).Msgf("No valid name for %s in %s", image.Name, d.Dir)
+			errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error(), Destination: d.Dir}
+			continue
+		}
+		fYMdir := filepath.Dir(fYMpath)
+		if err := os.MkdirAll(fYMdir, 0755); err != nil {
+			logger.Error().Err(err).Msgf("Failed to create directory: %s", fYMdir)
+			errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error(), Destination: d.Dir}
+			continue
+		}
+
+		r, err := fp.resolveConflict(ctx, d, image, fYMpath)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to resolve name conflict at %s", fYMpath)
+			errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error(), Destination: d.Dir}
+			continue
+		}
+		if r.path == "" {
+			skipChan <- FileObject{Path: fYMdir, Name: filepath.Base(fYMpath), DateTime: tm, MediaType: image.MediaType, Destination: d.Dir}
+			if r.held != "" {
+				held++
+				owners = append(owners, sidecarOwnerTarget{dest: d, path: r.held})
+			}
+			continue
+		}
+		defer fp.releaseClaim(d, r.path)
+		t := &copyTarget{dest: d, dir: fYMdir, path: r.path}
+		if r.keep != "" {
+			t.replaced, t.keep, t.path = r.path, r.keep, r.path+tmpSuffix
+		}
+		targets = append(targets, t)
+	}
+
+	placed := 0
+	if len(targets) > 0 {
+		placed = fp.placeImage(ctx, image, targets, copyChan, errorChan)
+	}
+	for _, t := range targets {
+		if t.err == nil {
+			owners = append(owners, sidecarOwnerTarget{dest: t.dest, path: t.path, replaced: t.keep != ""})
+		}
+	}
+	var sidecars []FileObject
+	if len(owners) > 0 {
+		sidecars = fp.placeSidecars(ctx, image, owners, copyChan, errorChan, skipChan)
 	}
+	// The sidecars found with the file come before one written for it.
+	for _, t := range targets {
+		if t.err == nil && fp.XMPSidecar && filepath.Base(t.path) != image.Name {
+			if err := writeXMPSidecar(t.dest.catalog, t.path, image); err != nil {
+				logger.Warn().Err(err).Msgf("No XMP sidecar for %s", t.path)
+			}
+		}
+	}
+
+	if placed > 0 {
+		atomic.AddInt64(counter, 1)
+	}
+	// A file is only done, and eligible for -removesource, once every
+	// destination has it, whether it was placed now or already there, and
+	// so are its sidecars.
+	if placed+held == len(fp.destinations) {
+		writeStatusFile(ctx, image)
+		if len(owners) == len(fp.destinations) {
+			for _, sc := range sidecars {
+				writeStatusFile(ctx, sc)
+			}
+		}
+	}
+}
+
+// placeImage writes image to every target, reporting each copy or error,
+// and returns how many it was placed in. A target that failed is left with
+// its error.
+func (fp *FileProcessor) placeImage(ctx context.Context, image FileObject, targets []*copyTarget,
+	copyChan chan<- FileObject, errorChan chan<- ErroredFileObject) int {
+
+	logger := ctx.Value("logger").(zerolog.Logger)
+	tm := image.DateTime
+	fpath := filepath.Join(image.Path, image.Name)
 
 	fis, _ := os.Stat(fpath)
 	fd, err := os.Open(fpath)
 	if err != nil {
 		logger.Error().Err(err).Msgf("Failed to open file: %s", fpath)
-		errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error()}
-		return
+		for _, t := range targets {
+			t.err = err
+			errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error(), Destination: t.dest.Dir}
+		}
+		return 0
 	}
 	defer fd.Close()
 
-	fYMdir := getDestinationPath(tm, destdir, fp.DateFmt)
-	if err := os.MkdirAll(fYMdir, 0755); err != nil {
-		logger.Error().Err(err).Msgf("Failed to create directory: %s", fYMdir)
-		errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error()}
-		return
-	}
-
-	fYMpath := filepath.Join(fYMdir, strings.ReplaceAll(image.Name, "%20", "_"))
-	fYMpath = strings.ReplaceAll(fYMpath, " ", "_")
-
-	shouldWrite := false
-	if fi, err := os.Stat(fYMpath); err == nil {
-		if !fi.IsDir() {
-			overwrite := strings.ToLower(fp.Overwrite)
-			if overwrite == "yes" || fp.ForceCopy {
-				shouldWrite = true
-			} else if overwrite == "ask" {
-				shouldWrite = false
-			} else {
-				shouldWrite = false
-			}
+	// Need different source based on logic?
+	// Original code: passed 'fis' or 'fi' to writeFile.
+	// 'fis' is source file info. 'fi' was destination file info?
+	// writeFile used 'fi' to set ModTime.
+	// If overwriting, 'fi' is dest info? No, we want to preserve SOURCE time presumably.
+	// Logic in orig:
+	// if exists: `writeFile(..., fi, ...)` -> `fi` is DEST info.
+	// if not exists: `writeFile(..., fis, ...)` -> `fis` is SOURCE info.
+	// And `writeFile` does `os.Chtimes(fYMpath, fi.ModTime(), fi.ModTime())`.
+	// If overwriting, we probably want to set it to Source time, or keep Dest time?
+	// Usually we want to preserve Source time.
+	// If I overwrite a file, I probably want it to look like the source.
+	// But let's check original logic carefully.
+	// Orig: `filesCopied = writeFile(fYMpath, logger, fd, fi, ctx, image, fYMdir, i, imagefiles, filesCopied, tm)`
+	// `fi` comes from `os.Stat(fYMpath)` (Dest).
+	// So it preserves DEST time? That's weird.
+	// `else` (not exists): `filesCopied = writeFile(..., fis, ...)` (Source).
+	// So if new file, use Source time. If overwrite, use Dest time?
+	// Maybe to avoid re-syncing?
+	// Unsure. I will stick to usage of 'fis' (Source) for consistency, unless 'Overwrite' implies something else.
+	// Actually, if I overwrite, I'm replacing the file. I should probably use Source time.
+	// I will use 'fis' (Source) for both cases. It makes more sense.
+
+	fp.placeFiles(ctx, fpath, targets, fd, fis)
+	for _, t := range targets {
+		if t.replaced != "" {
+			fp.replaceKept(ctx, fpath, t)
 		}
-	} else {
-		shouldWrite = true
 	}
 
-	if shouldWrite {
-		// Need different source based on logic?
-		// Original code: passed 'fis' or 'fi' to writeFile.
-		// 'fis' is source file info. 'fi' was destination file info?
-		// writeFile used 'fi' to set ModTime.
-		// If overwriting, 'fi' is dest info? No, we want to preserve SOURCE time presumably.
-		// Logic in orig:
-		// if exists: `writeFile(..., fi, ...)` -> `fi` is DEST info.
-		// if not exists: `writeFile(..., fis, ...)` -> `fis` is SOURCE info.
-		// And `writeFile` does `os.Chtimes(fYMpath, fi.ModTime(), fi.ModTime())`.
-		// If overwriting, we probably want to set it to Source time, or keep Dest time?
-		// Usually we want to preserve Source time.
-		// If I overwrite a file, I probably want it to look like the source.
-		// But let's check original logic carefully.
-		// Orig: `filesCopied = writeFile(fYMpath, logger, fd, fi, ctx, image, fYMdir, i, imagefiles, filesCopied, tm)`
-		// `fi` comes from `os.Stat(fYMpath)` (Dest).
-		// So it preserves DEST time? That's weird.
-		// `else` (not exists): `filesCopied = writeFile(..., fis, ...)` (Source).
-		// So if new file, use Source time. If overwrite, use Dest time?
-		// Maybe to avoid re-syncing?
-		// Unsure. I will stick to usage of 'fis' (Source) for consistency, unless 'Overwrite' implies something else.
-		// Actually, if I overwrite, I'm replacing the file. I should probably use Source time.
-		// I will use 'fis' (Source) for both cases. It makes more sense.
-
-		err := writeFile(fYMpath, fd, fis)
-		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to write file: %s", fYMpath)
-			errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: err.Error()}
-			return
+	placed := 0
+	for _, t := range targets {
+		if t.err != nil {
+			logger.Error().Err(t.err).Msgf("Failed to write file: %s", t.path)
+			errorChan <- ErroredFileObject{Path: image.Path, Name: image.Name, DateTime: tm, ErrorMessage: t.err.Error(), Destination: t.dest.Dir}
+			continue
 		}
+		fp.recordCatalog(ctx, t.dest.catalog, image, t)
+		copyChan <- FileObject{
+			Path: t.dir, Name: filepath.Base(t.path), DateTime: tm, MediaType: image.MediaType,
+			Format: image.Format, WrongExt: image.WrongExt, Destination: t.dest.Dir,
+		}
+		placed++
+	}
+	return placed
+}
 
-		writeStatusFile(ctx, image)
-		atomic.AddInt64(counter, 1)
-
-		copyChan <- FileObject{Path: fYMdir, Name: image.Name, DateTime: tm}
-	} else {
-		skipChan <- FileObject{Path: fYMdir, Name: image.Name, DateTime: tm}
+// recordCatalog notes the placed file in the destination catalog and journals
+// the operation. Links and moves record the absolute path of their original so
+// later passes can tell them apart from copies. The MD5 of the whole file is
+// recorded for scrub when the copy read it or the source hash is one.
+func (fp *FileProcessor) recordCatalog(ctx context.Context, catalog *Catalog, image FileObject, t *copyTarget) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	fYMpath, mode := t.path, t.mode
+
+	source, _ := filepath.Abs(filepath.Join(image.Path, image.Name))
+	dest, _ := filepath.Abs(fYMpath)
+	entry := CatalogEntry{
+		Path:           fYMpath,
+		Source:         source,
+		Md5Sum:         image.Md5Sum,
+		FullMd5Sum:     t.sum,
+		EssenceHash:    image.EssenceHash,
+		PerceptualHash: image.PerceptualHash,
+		Width:          image.Width,
+		Height:         image.Height,
+		HasGPS:         image.HasGPS,
+		Mode:           mode,
+		DateTime:       image.DateTime,
+		CopiedAt:       time.Now(),
+	}
+	if entry.FullMd5Sum == "" && !isFastHash(image.Md5Sum) {
+		entry.FullMd5Sum = image.Md5Sum
+	}
+	if name := filepath.Base(fYMpath); name != image.Name {
+		entry.OriginalName = image.Name
+	}
+	if mode == ModeHardlink || mode == ModeSymlink {
+		entry.LinkTarget = source
+	}
+	if err := catalog.Put(entry); err != nil {
+		logger.Error().Err(err).Msgf("Failed to record %s in catalog", fYMpath)
+	}
+	if err := catalog.Journal(JournalEntry{Op: mode, Source: source, Dest: dest, Time: entry.CopiedAt}); err != nil {
+		logger.Error().Err(err).Msgf("Failed to journal %s", fYMpath)
 	}
 }
 
@@ -284,16 +543,3 @@ func writeFile(fYMpath string, r io.Reader, fi fs.FileInfo) error {
 
 	return os.Chtimes(fYMpath, fi.ModTime(), fi.ModTime())
 }
-
-func getDestinationPath(tm time.Time, destdir string, datefmt string) string {
-	dPath := ""
-	switch datefmt {
-	case "DATE":
-		dPath = fmt.Sprintf("%04d-%02d-%02d", tm.Year(), tm.Month(), tm.Day())
-	case "YEAR-MONTH":
-		dPath = fmt.Sprintf("%04d/%02d", tm.Year(), tm.Month())
-	default:
-		dPath = ""
-	}
-	return filepath.Join(destdir, dPath)
-}
@@ -1,6 +1,9 @@
 package icopy
 
 import (
+	"sync"
+	"time"
+
 	badger "github.com/dgraph-io/badger/v4"
 )
 
@@ -47,7 +50,8 @@ func IterateWithPrefix(db *badger.DB, prefix string) ([]string, error) {
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		prefixKey := []byte(prefix)
+		// The separator keeps "dst" from taking in the keys of "dst1".
+		prefixKey := []byte(prefix + "-")
 		for it.Seek(prefixKey); it.ValidForPrefix(prefixKey); it.Next() {
 			item := it.Item()
 			k := item.Key()
@@ -59,3 +63,149 @@ func IterateWithPrefix(db *badger.DB, prefix string) ([]string, error) {
 	})
 	return keys, err
 }
+
+const (
+	// DefaultBatchSize is how many records a BatchWriter buffers before it
+	// commits them.
+	DefaultBatchSize = 1000
+	// DefaultBatchInterval is the longest a record waits in a BatchWriter
+	// before it is committed.
+	DefaultBatchInterval = time.Second
+)
+
+// BatchWriter groups writes from many goroutines into badger WriteBatch
+// commits, instead of one db.Update transaction per record. Records are
+// committed when maxCount of them are pending, when interval has passed since
+// the last commit, on Flush and on Close.
+//
+// Durability: a record handed to Put lives only in memory until the batch
+// holding it is committed, and is not visible to readers of the database
+// until then. If the process dies, every record since the last commit is
+// lost: at most maxCount records, or interval's worth. Committed records
+// have badger's usual guarantee, which with SyncWrites off survives a
+// process crash but not necessarily a power failure. Everything icopy
+// stores can be rebuilt by scanning again, so callers Flush before they
+// read back what they wrote, and Close when done.
+type BatchWriter struct {
+	db       *badger.DB
+	maxCount int
+
+	mu      sync.Mutex
+	pending []batchRecord
+	err     error
+
+	flushMu sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type batchRecord struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func NewBatchWriter(db *badger.DB, maxCount int, interval time.Duration) *BatchWriter {
+	if maxCount <= 0 {
+		maxCount = DefaultBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+	b := &BatchWriter{
+		db:       db,
+		maxCount: maxCount,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.flushEvery(interval)
+	return b
+}
+
+// Put queues key and value, committing the batch if it is full.
+func (b *BatchWriter) Put(key string, value string) error {
+	return b.queue(batchRecord{key: []byte(key), value: []byte(value)})
+}
+
+// Delete queues the removal of key, committing the batch if it is full.
+func (b *BatchWriter) Delete(key string) error {
+	return b.queue(batchRecord{key: []byte(key), delete: true})
+}
+
+func (b *BatchWriter) queue(r batchRecord) error {
+	b.mu.Lock()
+	b.pending = append(b.pending, r)
+	full := len(b.pending) >= b.maxCount
+	b.mu.Unlock()
+
+	if full {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush commits every record queued before it was called. It returns the
+// first error any commit has hit.
+func (b *BatchWriter) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	records := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	if len(records) > 0 {
+		wb := b.db.NewWriteBatch()
+		for _, r := range records {
+			var err error
+			if r.delete {
+				err = wb.Delete(r.key)
+			} else {
+				err = wb.Set(r.key, r.value)
+			}
+			if err != nil {
+				wb.Cancel()
+				b.setErr(err)
+				return b.Err()
+			}
+		}
+		b.setErr(wb.Flush())
+	}
+	return b.Err()
+}
+
+// Close stops the timed commits and flushes what is left.
+func (b *BatchWriter) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
+
+func (b *BatchWriter) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *BatchWriter) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *BatchWriter) flushEvery(interval time.Duration) {
+	defer close(b.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.Flush()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package icopy
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBatchWriterFlushThresholds(t *testing.T) {
+	db, err := OpenBadgerDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	// Size threshold: the third Put commits the batch.
+	batch := NewBatchWriter(db, 3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := batch.Put(fmt.Sprintf("size-%d", i), "v"); err != nil {
+			t.Fatalf("Put returned error: %v", err)
+		}
+	}
+	if _, err := GetBadgerDBValue(db, "size-2"); err != nil {
+		t.Errorf("Expected full batch to be committed, got %v", err)
+	}
+
+	// Below the threshold nothing is visible until Flush.
+	batch.Put("pending", "v")
+	if _, err := GetBadgerDBValue(db, "pending"); err == nil {
+		t.Error("Expected pending record to be invisible before Flush")
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+	if _, err := GetBadgerDBValue(db, "pending"); err != nil {
+		t.Errorf("Expected record to be committed by Flush, got %v", err)
+	}
+	if err := batch.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// Time threshold: a lone record is committed after the interval.
+	timed := NewBatchWriter(db, 1000, 10*time.Millisecond)
+	defer timed.Close()
+	timed.Put("timed", "v")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := GetBadgerDBValue(db, "timed"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected record to be committed by the interval flush")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatchWriterDurability(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenBadgerDB(dir)
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+
+	batch := NewBatchWriter(db, 1000, time.Hour)
+	batch.Put("committed", "v")
+	if err := batch.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+	batch.Put("lost", "v")
+
+	// Closing the database without closing the writer stands in for a crash:
+	// whatever the writer still holds never reaches disk.
+	CloseBadgerDB(db)
+
+	db, err = OpenBadgerDB(dir)
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	if _, err := GetBadgerDBValue(db, "committed"); err != nil {
+		t.Errorf("Expected committed record to survive, got %v", err)
+	}
+	if _, err := GetBadgerDBValue(db, "lost"); err == nil {
+		t.Error("Expected uncommitted record to be lost")
+	}
+}
+
+func TestBatchWriterCloseFlushes(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenBadgerDB(dir)
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+
+	batch := NewBatchWriter(db, 1000, time.Hour)
+	for i := 0; i < 10; i++ {
+		batch.Put(fmt.Sprintf("key-%d", i), "v")
+	}
+	if err := batch.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	CloseBadgerDB(db)
+
+	db, err = OpenBadgerDB(dir)
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	keys, err := IterateWithPrefix(db, "key")
+	if err != nil {
+		t.Fatalf("IterateWithPrefix returned error: %v", err)
+	}
+	if len(keys) != 10 {
+		t.Errorf("Expected 10 records after Close, got %d", len(keys))
+	}
+}
+
+func TestIterateWithPrefixSeparatesDestinations(t *testing.T) {
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	batch := NewBatchWriter(db, 1000, time.Hour)
+	batch.Put(DestPrefix(0)+"-aaa", "/lib1/a.jpg")
+	batch.Put(DestPrefix(1)+"-bbb", "/lib2/b.jpg")
+	batch.Put(DestPrefix(10)+"-ccc", "/lib11/c.jpg")
+	if err := batch.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if keys, _ := IterateWithPrefix(db, DestPrefix(0)); len(keys) != 1 || keys[0] != "aaa" {
+		t.Errorf("Expected only the first destination's hash, got %v", keys)
+	}
+	if keys, _ := IterateWithPrefix(db, DestPrefix(1)); len(keys) != 1 || keys[0] != "bbb" {
+		t.Errorf("Expected only the second destination's hash, got %v", keys)
+	}
+}
@@ -0,0 +1,278 @@
+package icopy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// Dedupe actions. Each duplicate in a plan is removed, or replaced with a
+// link to the copy being kept.
+const (
+	DedupeReport   = "report"
+	DedupeHardlink = "hardlink"
+	DedupeReflink  = "reflink"
+	DedupeSymlink  = "symlink"
+	DedupeDelete   = "delete"
+)
+
+// opDedupe prefixes the journal op of each dedupe action, e.g.
+// "dedupe-hardlink".
+const opDedupe = "dedupe-"
+
+// DedupeOptions controls Dedupe.
+type DedupeOptions struct {
+	Action string
+	// Policy picks the copy to keep when Plan is nil.
+	Policy KeepPolicy
+	// Plan, when set, is applied instead of making one, e.g. after it has
+	// been reviewed.
+	Plan         *Plan
+	NumWorkers   int
+	ProgressChan chan<- string
+	Throttle     *Throttle
+	Sizer        *WorkerSizer
+}
+
+// DedupeResult is what Dedupe did, or with DedupeReport would do.
+type DedupeResult struct {
+	Plan Plan
+	// Deduped counts the duplicates removed or replaced with links.
+	Deduped int
+	// Reclaimed is the size of those duplicates in bytes. For reflinks the
+	// filesystem frees the space as their extents become shared.
+	Reclaimed int64
+	// Skipped holds duplicates left alone: contents that turned out to
+	// differ, files already linked, and failures.
+	Skipped []ErroredFileObject
+	// Run is the journal run to pass to Undo.
+	Run string
+}
+
+// Dedupe removes exact duplicates from the library in destdir. Before a
+// duplicate is touched, it and the copy being kept are hashed in full and
+// compared, so a plan made from essence or perceptual groups, or a fast hash,
+// can never lose data. Every change is journalled and can be reversed with
+// Undo.
+func Dedupe(ctx context.Context, destdir string, options DedupeOptions) (DedupeResult, error) {
+	report := DedupeResult{}
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return report, err
+	}
+	defer catalog.Close()
+	report.Run = catalog.Run()
+
+	if options.Plan != nil {
+		// A plan's paths are only checked against the library it was made for.
+		if filepath.Clean(options.Plan.Root) != catalog.root {
+			return report, fmt.Errorf("the plan was made for %s, not %s", options.Plan.Root, catalog.root)
+		}
+		// Groups run at the same time, so a file in two of them could be
+		// deleted as the copy kept by the other.
+		if err := checkPlanPaths(*options.Plan); err != nil {
+			return report, err
+		}
+		report.Plan = *options.Plan
+	} else {
+		report.Plan, err = catalog.makePlan(ctx, PlanOptions{Kind: GroupExact, Policy: options.Policy})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	scan := ScanOptions{NumWorkers: options.NumWorkers, Sizer: options.Sizer}
+	numWorkers := scan.workers(ctx, PoolDestRead, catalog.root)
+
+	var mu sync.Mutex
+	jobs := make(chan PlanGroup)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				if options.ProgressChan != nil {
+					select {
+					case options.ProgressChan <- fmt.Sprintf("Deduplicating: %s", filepath.Base(group.Keep)):
+					default:
+					}
+				}
+				catalog.dedupeGroup(ctx, group, options, &report, &mu)
+			}
+		}()
+	}
+	for _, group := range report.Plan.Groups {
+		jobs <- group
+	}
+	close(jobs)
+	wg.Wait()
+
+	return report, catalog.Flush()
+}
+
+// checkPlanPaths returns an error naming the first path that appears more
+// than once across the keep and discard lists of plan.
+func checkPlanPaths(plan Plan) error {
+	seen := map[string]bool{}
+	for _, group := range plan.Groups {
+		for _, path := range append([]string{group.Keep}, group.Discard...) {
+			path = filepath.Clean(path)
+			if seen[path] {
+				return fmt.Errorf("%s is in the plan more than once", path)
+			}
+			seen[path] = true
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) dedupeGroup(ctx context.Context, group PlanGroup, options DedupeOptions, report *DedupeResult, mu *sync.Mutex) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	skip := func(path string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Skipped = append(report.Skipped, ErroredFileObject{Name: filepath.Base(path), Path: filepath.Dir(path), ErrorMessage: err.Error()})
+	}
+
+	keepInfo, err := os.Lstat(group.Keep)
+	if err == nil && !keepInfo.Mode().IsRegular() {
+		// A link to a file outside the library is no safe place to keep the
+		// only copy.
+		err = fmt.Errorf("%s is not a regular file", group.Keep)
+	}
+	if err != nil {
+		for _, discard := range group.Discard {
+			skip(discard, err)
+		}
+		return
+	}
+	options.Throttle.WaitFile(ctx)
+	keepSum, err := md5Sum(ctx, group.Keep, options.Throttle)
+	if err != nil {
+		for _, discard := range group.Discard {
+			skip(discard, err)
+		}
+		return
+	}
+
+	for _, discard := range group.Discard {
+		fi, err := os.Lstat(discard)
+		if err != nil {
+			skip(discard, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			skip(discard, fmt.Errorf("%s is not a regular file", discard))
+			continue
+		}
+		if os.SameFile(keepInfo, fi) {
+			skip(discard, fmt.Errorf("%s is already a hardlink to %s", discard, group.Keep))
+			continue
+		}
+		options.Throttle.WaitFile(ctx)
+		sum, err := md5Sum(ctx, discard, options.Throttle)
+		if err != nil {
+			skip(discard, err)
+			continue
+		}
+		if sum != keepSum {
+			skip(discard, fmt.Errorf("%s differs from %s", discard, group.Keep))
+			continue
+		}
+
+		if options.Action != DedupeReport {
+			if err := c.dedupeFile(group.Keep, discard, fi, options.Action); err != nil {
+				logger.Error().Err(err).Msgf("Failed to %s %s", options.Action, discard)
+				skip(discard, err)
+				continue
+			}
+			if err := c.Journal(JournalEntry{Op: opDedupe + options.Action, Source: group.Keep, Dest: discard}); err != nil {
+				logger.Error().Err(err).Msgf("Failed to journal %s", discard)
+			}
+		}
+		mu.Lock()
+		report.Deduped++
+		report.Reclaimed += fi.Size()
+		mu.Unlock()
+	}
+}
+
+// dedupeFile removes discard, or atomically replaces it with a link to keep,
+// and updates the catalog to match.
+func (c *Catalog) dedupeFile(keep string, discard string, fi os.FileInfo, action string) error {
+	if action == DedupeDelete {
+		if err := os.Remove(discard); err != nil {
+			return err
+		}
+		return c.Delete(discard)
+	}
+
+	tmp := discard + ".icopy-tmp"
+	os.Remove(tmp)
+	var mode string
+	var err error
+	switch action {
+	case DedupeHardlink:
+		mode = ModeHardlink
+		var same bool
+		if same, err = sameDevice(keep, filepath.Dir(discard)); err == nil && !same {
+			err = fmt.Errorf("%w: %s", ErrCrossDevice, discard)
+		}
+		if err == nil {
+			err = os.Link(keep, tmp)
+		}
+	case DedupeSymlink:
+		mode = ModeSymlink
+		err = os.Symlink(keep, tmp)
+	case DedupeReflink:
+		mode = ModeReflink
+		err = reflinkFile(keep, tmp, fi)
+	default:
+		return fmt.Errorf("unknown dedupe action %q", action)
+	}
+	if err == nil {
+		err = os.Rename(tmp, discard)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	entry, err := c.Get(discard)
+	if err != nil {
+		if entry, err = c.Get(keep); err != nil {
+			return err
+		}
+	}
+	entry.Path = discard
+	entry.Mode = mode
+	entry.LinkTarget = keep
+	return c.Put(entry)
+}
+
+// reflinkFile creates dst as a reflink of src with fi's permissions and
+// modification time.
+func reflinkFile(src string, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := reflink(in, out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,182 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestDedupeAndUndo(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"a.jpg":        "same content",
+		"a copy.jpg":   "same content",
+		"a-edited.jpg": "same content",
+		// Recorded with the same hash, as a fast hash could, but different.
+		"a (1).jpg": "other content",
+	}
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		catalog.Put(CatalogEntry{Path: path, Md5Sum: "fast-1234", Mode: ModeCopy})
+	}
+	catalog.Close()
+
+	keep := filepath.Join(dir, "a.jpg")
+	policy, _ := ParseKeepPolicy("original")
+	result, err := Dedupe(ctx, dir, DedupeOptions{Action: DedupeHardlink, Policy: policy})
+	if err != nil {
+		t.Fatalf("Dedupe returned error: %v", err)
+	}
+	if result.Plan.Groups[0].Keep != keep {
+		t.Errorf("Expected to keep a.jpg, got %s", result.Plan.Groups[0].Keep)
+	}
+	if result.Deduped != 2 || result.Reclaimed != 2*int64(len("same content")) {
+		t.Errorf("Expected 2 files and 24 bytes reclaimed, got %d and %d", result.Deduped, result.Reclaimed)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Name != "a (1).jpg" {
+		t.Errorf("Expected the differing file to be skipped, got %+v", result.Skipped)
+	}
+	keepInfo, _ := os.Stat(keep)
+	for _, name := range []string{"a copy.jpg", "a-edited.jpg"} {
+		fi, _ := os.Stat(filepath.Join(dir, name))
+		if !os.SameFile(keepInfo, fi) {
+			t.Errorf("Expected %s to be a hardlink to a.jpg", name)
+		}
+	}
+
+	undo, err := Undo(ctx, dir, "")
+	if err != nil {
+		t.Fatalf("Undo returned error: %v", err)
+	}
+	if undo.Run != result.Run || undo.Undone != 2 || len(undo.Errored) != 0 {
+		t.Errorf("Expected both links undone, got %+v", undo)
+	}
+	for _, name := range []string{"a copy.jpg", "a-edited.jpg"} {
+		path := filepath.Join(dir, name)
+		fi, _ := os.Stat(path)
+		content, _ := os.ReadFile(path)
+		if os.SameFile(keepInfo, fi) || string(content) != "same content" {
+			t.Errorf("Expected %s to be an independent copy again", name)
+		}
+	}
+
+	result, err = Dedupe(ctx, dir, DedupeOptions{Action: DedupeDelete, Policy: policy})
+	if err != nil {
+		t.Fatalf("Dedupe returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a copy.jpg")); !os.IsNotExist(err) {
+		t.Error("Expected a copy.jpg to be deleted")
+	}
+	catalog, _ = OpenCatalog(dir)
+	if _, err := catalog.Get("a copy.jpg"); err == nil {
+		t.Error("Expected a copy.jpg to be removed from the catalog")
+	}
+	runs, _ := catalog.Runs()
+	catalog.Close()
+	if len(runs) != 2 || !runs[0].Undone || runs[1].Ops[opDedupe+DedupeDelete] != 2 {
+		t.Errorf("Expected an undone hardlink run and a delete run, got %+v", runs)
+	}
+
+	if _, err := Undo(ctx, dir, result.Run); err != nil {
+		t.Fatalf("Undo returned error: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a copy.jpg")); string(content) != "same content" {
+		t.Error("Expected a copy.jpg to be restored")
+	}
+	if _, err := Undo(ctx, dir, ""); err == nil {
+		t.Error("Expected nothing left to undo")
+	}
+}
+
+func TestDedupePlanRoot(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	other := t.TempDir()
+	plan := Plan{Root: other, Groups: []PlanGroup{{Keep: filepath.Join(other, "a.jpg"), Discard: []string{filepath.Join(other, "b.jpg")}}}}
+
+	if _, err := Dedupe(ctx, dir, DedupeOptions{Action: DedupeDelete, Plan: &plan}); err == nil {
+		t.Errorf("Expected a plan made for another library to be refused")
+	}
+}
+
+func TestDedupePlanRepeatedPath(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("same"), 0644)
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	// b.jpg is kept by one group and discarded by the other.
+	plan := Plan{Root: dir, Groups: []PlanGroup{
+		{Keep: path("b.jpg"), Discard: []string{path("a.jpg")}},
+		{Keep: path("c.jpg"), Discard: []string{path("b.jpg")}},
+	}}
+	if _, err := Dedupe(ctx, dir, DedupeOptions{Action: DedupeDelete, Plan: &plan}); err == nil {
+		t.Errorf("Expected a plan naming a file twice to be refused")
+	}
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		if _, err := os.Stat(path(name)); err != nil {
+			t.Errorf("Expected %s left alone, got %v", name, err)
+		}
+	}
+
+	plan.Groups = []PlanGroup{{Keep: path("a.jpg"), Discard: []string{path("b.jpg"), path("b.jpg")}}}
+	if _, err := Dedupe(ctx, dir, DedupeOptions{Action: DedupeDelete, Plan: &plan}); err == nil {
+		t.Errorf("Expected a plan discarding a file twice to be refused")
+	}
+}
+
+func TestUndoLinks(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	src := t.TempDir()
+	dir := t.TempDir()
+	a, b, c := filepath.Join(src, "a.jpg"), filepath.Join(src, "b.jpg"), filepath.Join(src, "c.jpg")
+	for _, path := range []string{a, b, c} {
+		os.WriteFile(path, []byte(filepath.Base(path)), 0644)
+	}
+
+	linked := filepath.Join(dir, "a.jpg")
+	repointed := filepath.Join(dir, "b.jpg")
+	orphaned := filepath.Join(dir, "c.jpg")
+	os.Link(a, linked)
+	os.Symlink(a, repointed)
+	os.Link(c, orphaned)
+
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	catalog.Journal(JournalEntry{Op: ModeHardlink, Source: a, Dest: linked})
+	catalog.Journal(JournalEntry{Op: ModeSymlink, Source: b, Dest: repointed})
+	catalog.Journal(JournalEntry{Op: ModeHardlink, Source: c, Dest: orphaned})
+	catalog.Close()
+	// The source of the last hardlink is gone, which leaves it the only copy.
+	os.Remove(c)
+
+	undo, err := Undo(ctx, dir, "")
+	if err != nil {
+		t.Fatalf("Undo returned error: %v", err)
+	}
+	if undo.Undone != 1 || len(undo.Errored) != 2 {
+		t.Errorf("Expected only the intact hardlink undone, got %+v", undo)
+	}
+	if _, err := os.Lstat(linked); !os.IsNotExist(err) {
+		t.Errorf("Expected %s removed", linked)
+	}
+	for _, path := range []string{repointed, orphaned} {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("Expected %s kept, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package icopy
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Destination is one output library of a copy run. DateFmt overrides
+// FileProcessor.DateFmt for this destination when set; either is a name or a
+// template, see ParseDirFormat.
+type Destination struct {
+	Dir     string
+	DateFmt string
+	// Sanitize is the policy names are made valid by: SanitizeAuto, which
+	// is the default, SanitizePosix or SanitizeWindows.
+	Sanitize string
+}
+
+// destination is a Destination opened for a run: its catalog and the key
+// prefix its hashes are stored under in the scratch store.
+type destination struct {
+	Destination
+	prefix    string
+	catalog   *Catalog
+	layout    *DirLayout
+	sanitizer *Sanitizer
+}
+
+// copyTarget is the path a file is placed at in one destination, and the
+// outcome of placing it there.
+type copyTarget struct {
+	dest *destination
+	dir  string
+	path string
+	mode string
+	sum  string // MD5 of the whole file written, when it was read to copy it
+	err  error
+	// replaced is the file a copy is to replace, kept as a version with hash
+	// keep. Until the copy is written it goes to path, beside that file.
+	replaced string
+	keep     string
+}
+
+func (fp *FileProcessor) openDestinations(ctx context.Context, dests []Destination) error {
+	fp.destinations = nil
+	fp.namer = nil
+	if fp.Rename != "" {
+		namer, err := ParseNameFormat(fp.Rename, fp.Layout)
+		if err != nil {
+			return err
+		}
+		fp.namer = namer
+	}
+	for i, d := range dests {
+		if d.DateFmt == "" {
+			d.DateFmt = fp.DateFmt
+		}
+		layout, err := ParseDirFormat(d.DateFmt, fp.Layout)
+		if err != nil {
+			fp.closeDestinations(ctx)
+			return err
+		}
+		catalog, err := OpenCatalog(d.Dir)
+		if err != nil {
+			fp.closeDestinations(ctx)
+			return err
+		}
+		sanitizer, err := NewSanitizer(d.Sanitize, d.Dir)
+		if err != nil {
+			catalog.Close()
+			fp.closeDestinations(ctx)
+			return err
+		}
+		fp.destinations = append(fp.destinations, &destination{Destination: d, prefix: DestPrefix(i), catalog: catalog, layout: layout, sanitizer: sanitizer})
+	}
+	return nil
+}
+
+func (fp *FileProcessor) closeDestinations(ctx context.Context) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	for _, d := range fp.destinations {
+		if err := d.catalog.Close(); err != nil {
+			logger.Error().Err(err).Msgf("Failed to write catalog for %s", d.Dir)
+		}
+	}
+	fp.destinations = nil
+}
+
+// DestPrefix is the prefix the hashes of the i-th destination are stored
+// under. The first keeps the "dst" prefix of single destination runs.
+func DestPrefix(i int) string {
+	if i == 0 {
+		return "dst"
+	}
+	return fmt.Sprintf("dst%d", i)
+}
+
+// path returns where image is placed in d under name, made valid for d. Spaces
+// and "%20" in the name become underscores, as they always have.
+func (d *destination) path(image FileObject, name string) (string, error) {
+	name = strings.NewReplacer("%20", "_", " ", "_").Replace(name)
+	return d.sanitizer.Join(d.Dir, d.layout.Path("", image), name)
+}
+
+// fanOutCopy writes everything read from r to every target in one pass. A
+// target whose write fails drops out without stopping the others. With verify
+// set, each copy is read back and compared with the MD5 of the bytes read.
+// Either way every target written records that MD5 as its sum. Reads and
+// writes are drawn from throttle.
+func fanOutCopy(ctx context.Context, r io.Reader, targets []*copyTarget, fis fs.FileInfo, verify bool, throttle *Throttle) {
+	hash := md5.New()
+	if len(targets) == 1 && !verify && throttle == nil {
+		t := targets[0]
+		if t.err = clearDestination(t.path, fis, false); t.err == nil {
+			t.err = writeFile(t.path, io.TeeReader(r, hash), fis)
+		}
+		if t.err == nil {
+			t.mode, t.sum = ModeCopy, fmt.Sprintf("%x", hash.Sum(nil))
+		}
+		return
+	}
+
+	files := make([]*os.File, len(targets))
+	for i, t := range targets {
+		if t.err = clearDestination(t.path, fis, false); t.err != nil {
+			continue
+		}
+		files[i], t.err = os.Create(t.path)
+	}
+
+	r = throttle.Reader(ctx, r)
+	buf := make([]byte, 256*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			for i, t := range targets {
+				if files[i] == nil || t.err != nil {
+					continue
+				}
+				throttle.WaitWrite(ctx, n)
+				_, t.err = files[i].Write(buf[:n])
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			for _, t := range targets {
+				if t.err == nil {
+					t.err = rerr
+				}
+			}
+			break
+		}
+	}
+
+	srcSum := fmt.Sprintf("%x", hash.Sum(nil))
+	for i, t := range targets {
+		if files[i] == nil {
+			continue
+		}
+		if err := files[i].Close(); err != nil && t.err == nil {
+			t.err = err
+		}
+		if t.err == nil {
+			t.err = os.Chtimes(t.path, fis.ModTime(), fis.ModTime())
+		}
+		if t.err == nil && verify {
+			if dstSum, err := md5Sum(ctx, t.path, throttle); err != nil {
+				t.err = err
+			} else if dstSum != srcSum {
+				t.err = fmt.Errorf("verification of %s failed: source %s, copy %s", t.path, srcSum, dstSum)
+			}
+		}
+		if t.err != nil {
+			os.Remove(t.path)
+			continue
+		}
+		t.mode, t.sum = ModeCopy, srcSum
+	}
+}
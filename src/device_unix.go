@@ -0,0 +1,18 @@
+//go:build !windows
+
+package icopy
+
+import "syscall"
+
+// sameDevice reports whether the two paths live on the same filesystem, i.e.
+// whether a hardlink or rename between them can succeed.
+func sameDevice(a string, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Stat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, err
+	}
+	return uint64(sa.Dev) == uint64(sb.Dev), nil
+}
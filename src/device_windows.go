@@ -0,0 +1,22 @@
+//go:build windows
+
+package icopy
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sameDevice reports whether the two paths live on the same volume, i.e.
+// whether a hardlink or rename between them can succeed.
+func sameDevice(a string, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(absA), filepath.VolumeName(absB)), nil
+}
@@ -0,0 +1,309 @@
+package icopy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrNoEssence is returned for files whose format has no essence hash.
+var ErrNoEssence = errors.New("no essence hash for this format")
+
+// span is a byte range of a file.
+type span struct {
+	off int64
+	n   int64
+}
+
+// ComputeEssenceHash hashes only the image or media payload of a file, so that
+// copies differing only in metadata (an EXIF date fixed in another tool, a
+// rewritten tag) hash the same:
+//
+//   - JPEG: the scan data from the first SOS marker on
+//   - HEIC, AVIF, CR3, MP4, MOV: the payload of every mdat box
+//   - TIFF and TIFF-based RAW: the image strips and tiles of every IFD
+//
+// The format is told from the content, whatever the extension says. Other
+// formats return ErrNoEssence.
+func ComputeEssenceHash(filePath string) (string, error) {
+	return computeEssenceHash(context.Background(), filePath, "", nil)
+}
+
+// computeEssenceHash is ComputeEssenceHash with reads drawn from throttle,
+// for a file already sniffed as format, or not yet when format is "".
+func computeEssenceHash(ctx context.Context, filePath string, format string, throttle *Throttle) (string, error) {
+	if format != "" && essenceSpans(format) == nil {
+		return "", ErrNoEssence
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	if format == "" {
+		format = sniffReader(file)
+	}
+	find := essenceSpans(format)
+	if find == nil {
+		return "", ErrNoEssence
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	spans, err := find(file, fi.Size())
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filePath, err)
+	}
+	if len(spans) == 0 {
+		return "", ErrNoEssence
+	}
+
+	hash := md5.New()
+	for _, s := range spans {
+		if s.off < 0 || s.n < 0 || s.off+s.n > fi.Size() {
+			return "", fmt.Errorf("%s: payload at %d+%d runs past end of file", filePath, s.off, s.n)
+		}
+		r := throttle.Reader(ctx, io.NewSectionReader(file, s.off, s.n))
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// essenceSpans returns the function finding the payload of a file of format,
+// or nil when the format has no essence hash.
+func essenceSpans(format string) func(r io.ReaderAt, size int64) ([]span, error) {
+	switch format {
+	case FormatJPEG:
+		return jpegSpans
+	case FormatHEIC, FormatAVIF, FormatCR3, FormatMP4, FormatMOV, Format3GP:
+		return mdatSpans
+	case FormatTIFF, FormatCR2, FormatORF, FormatRW2:
+		return tiffSpans
+	}
+	return nil
+}
+
+// essenceHash returns the essence hash of fpath, sniffed as format or not yet
+// when format is "", when the options ask for one, or "" when they don't or
+// its format has none.
+func (o ScanOptions) essenceHash(ctx context.Context, fpath string, format string) string {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	if !o.UseEssenceHash {
+		return ""
+	}
+	essence, err := computeEssenceHash(ctx, fpath, format, o.Throttle)
+	if err != nil {
+		if !errors.Is(err, ErrNoEssence) {
+			logger.Debug().Err(err).Msgf("No essence hash for %s", fpath)
+		}
+		return ""
+	}
+	return essence
+}
+
+// jpegSpans skips the segments before the first start-of-scan marker, which
+// is where APPn metadata lives, and returns everything from there on.
+func jpegSpans(r io.ReaderAt, size int64) ([]span, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	off := int64(2)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, errors.New("no start of scan")
+		}
+		off++
+		if b != 0xFF {
+			return nil, fmt.Errorf("expected marker at offset %d", off-1)
+		}
+		// Markers may be preceded by any number of 0xFF fill bytes.
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return nil, errors.New("no start of scan")
+			}
+			off++
+		}
+		if marker == 0xDA {
+			return []span{{off: off - 2, n: size - (off - 2)}}, nil
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return nil, errors.New("no start of scan")
+		}
+		n := int64(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return nil, fmt.Errorf("bad segment length at offset %d", off)
+		}
+		if _, err := br.Discard(int(n - 2)); err != nil {
+			return nil, errors.New("no start of scan")
+		}
+		off += n
+	}
+}
+
+// mdatSpans returns the payload of every top-level mdat box of an ISO base
+// media file.
+func mdatSpans(r io.ReaderAt, size int64) ([]span, error) {
+	spans := []span{}
+	var header [16]byte
+	for off := int64(0); off+8 <= size; {
+		if _, err := r.ReadAt(header[:8], off); err != nil {
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - off
+		case 1:
+			if _, err := r.ReadAt(header[8:16], off+8); err != nil {
+				return nil, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if boxSize < headerSize || off+boxSize > size {
+			return nil, fmt.Errorf("bad %q box at offset %d", boxType, off)
+		}
+		if boxType == "mdat" {
+			spans = append(spans, span{off: off + headerSize, n: boxSize - headerSize})
+		}
+		off += boxSize
+	}
+	return spans, nil
+}
+
+// TIFF tags locating image data.
+const (
+	tiffStripOffsets    = 273
+	tiffStripByteCounts = 279
+	tiffTileOffsets     = 324
+	tiffTileByteCounts  = 325
+	tiffSubIFDs         = 330
+)
+
+// tiffSpans walks the IFD chain of a TIFF file, and the SubIFDs RAW formats
+// keep their full-size image in, and returns every strip and tile.
+func tiffSpans(r io.ReaderAt, size int64) ([]span, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a TIFF")
+	}
+	// 42 is TIFF; Olympus and Panasonic RAW use their own magic numbers.
+	switch order.Uint16(header[2:4]) {
+	case 42, 0x4F52, 0x5352, 0x55:
+	default:
+		return nil, errors.New("not a TIFF")
+	}
+
+	spans := []span{}
+	seen := map[int64]bool{}
+	queue := []int64{int64(order.Uint32(header[4:8]))}
+	for len(queue) > 0 && len(seen) < 256 {
+		ifd := queue[0]
+		queue = queue[1:]
+		if ifd == 0 || seen[ifd] || ifd+2 > size {
+			continue
+		}
+		seen[ifd] = true
+
+		var count [2]byte
+		if _, err := r.ReadAt(count[:], ifd); err != nil {
+			return nil, err
+		}
+		n := int64(order.Uint16(count[:]))
+		entries := make([]byte, n*12+4)
+		if _, err := r.ReadAt(entries, ifd+2); err != nil {
+			return nil, err
+		}
+
+		values := map[uint16][]int64{}
+		for i := int64(0); i < n; i++ {
+			e := entries[i*12 : i*12+12]
+			tag := order.Uint16(e[0:2])
+			switch tag {
+			case tiffStripOffsets, tiffStripByteCounts, tiffTileOffsets, tiffTileByteCounts, tiffSubIFDs:
+				v, err := tiffValues(r, order, e)
+				if err != nil {
+					return nil, err
+				}
+				values[tag] = v
+			}
+		}
+
+		spans = append(spans, pairSpans(values[tiffStripOffsets], values[tiffStripByteCounts])...)
+		spans = append(spans, pairSpans(values[tiffTileOffsets], values[tiffTileByteCounts])...)
+		queue = append(queue, values[tiffSubIFDs]...)
+		queue = append(queue, int64(order.Uint32(entries[n*12:])))
+	}
+	return spans, nil
+}
+
+// tiffValues reads the SHORT, LONG or IFD values of a 12-byte IFD entry.
+func tiffValues(r io.ReaderAt, order binary.ByteOrder, entry []byte) ([]int64, error) {
+	typ := order.Uint16(entry[2:4])
+	count := int64(order.Uint32(entry[4:8]))
+	width := int64(4)
+	if typ == 3 {
+		width = 2
+	} else if typ != 4 && typ != 13 {
+		return nil, fmt.Errorf("unexpected type %d for tag %d", typ, order.Uint16(entry[0:2]))
+	}
+	if count > 1<<20 {
+		return nil, fmt.Errorf("too many values for tag %d", order.Uint16(entry[0:2]))
+	}
+
+	data := entry[8:12]
+	if count*width > 4 {
+		data = make([]byte, count*width)
+		if _, err := r.ReadAt(data, int64(order.Uint32(entry[8:12]))); err != nil {
+			return nil, err
+		}
+	}
+	values := make([]int64, count)
+	for i := range values {
+		if width == 2 {
+			values[i] = int64(order.Uint16(data[i*2:]))
+		} else {
+			values[i] = int64(order.Uint32(data[i*4:]))
+		}
+	}
+	return values, nil
+}
+
+func pairSpans(offsets []int64, counts []int64) []span {
+	spans := []span{}
+	for i := 0; i < len(offsets) && i < len(counts); i++ {
+		spans = append(spans, span{off: offsets[i], n: counts[i]})
+	}
+	return spans
+}
@@ -0,0 +1,102 @@
+package icopy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func jpegWithComment(comment string) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	b.Write([]byte{0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(len(comment)+2))
+	b.WriteString(comment)
+	b.Write([]byte{0xFF, 0xDA, 0x00, 0x04, 0x01, 0x00})
+	b.WriteString("entropy coded data")
+	b.Write([]byte{0xFF, 0xD9})
+	return b.Bytes()
+}
+
+func box(typ string, payload string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(payload)+8))
+	b.WriteString(typ)
+	b.WriteString(payload)
+	return b.Bytes()
+}
+
+func mp4WithMoov(moov string) []byte {
+	return bytes.Join([][]byte{box("ftyp", "isom"), box("moov", moov), box("mdat", "frames")}, nil)
+}
+
+// tiffWithPadding puts padding bytes between the header and the single strip,
+// as rewriting the metadata of a real file moves its strips.
+func tiffWithPadding(padding int) []byte {
+	var b bytes.Buffer
+	strip := []byte("pixels")
+	stripOffset := uint32(8 + padding)
+	ifdOffset := stripOffset + uint32(len(strip))
+	b.WriteString("II")
+	binary.Write(&b, binary.LittleEndian, uint16(42))
+	binary.Write(&b, binary.LittleEndian, ifdOffset)
+	b.Write(make([]byte, padding))
+	b.Write(strip)
+	binary.Write(&b, binary.LittleEndian, uint16(2))
+	for _, e := range [][3]uint32{{tiffStripOffsets, 4, stripOffset}, {tiffStripByteCounts, 4, uint32(len(strip))}} {
+		binary.Write(&b, binary.LittleEndian, uint16(e[0]))
+		binary.Write(&b, binary.LittleEndian, uint16(e[1]))
+		binary.Write(&b, binary.LittleEndian, uint32(1))
+		binary.Write(&b, binary.LittleEndian, e[2])
+	}
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	return b.Bytes()
+}
+
+func TestComputeEssenceHash(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{"photo.jpg", jpegWithComment("2020:01:01 10:00:00"), jpegWithComment("2021:06:15 12:30:00 fixed")},
+		{"clip.mov", mp4WithMoov("created 2020"), mp4WithMoov("created 2021, retagged")},
+		{"raw.dng", tiffWithPadding(0), tiffWithPadding(32)},
+		// The payload is found by what the file is, not what it is called.
+		{"misnamed.jpg", mp4WithMoov("created 2020"), mp4WithMoov("created 2021, retagged")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := filepath.Join(dir, "a-"+tt.name)
+			b := filepath.Join(dir, "b-"+tt.name)
+			os.WriteFile(a, tt.a, 0644)
+			os.WriteFile(b, tt.b, 0644)
+
+			md5a, _ := ComputeFileHash(a, false)
+			md5b, _ := ComputeFileHash(b, false)
+			if md5a == md5b {
+				t.Fatal("Expected test files to differ")
+			}
+			essenceA, err := ComputeEssenceHash(a)
+			if err != nil {
+				t.Fatalf("ComputeEssenceHash returned error: %v", err)
+			}
+			essenceB, err := ComputeEssenceHash(b)
+			if err != nil {
+				t.Fatalf("ComputeEssenceHash returned error: %v", err)
+			}
+			if essenceA != essenceB {
+				t.Errorf("Expected equal essence hashes, got %s and %s", essenceA, essenceB)
+			}
+		})
+	}
+
+	other := filepath.Join(dir, "notes.png")
+	os.WriteFile(other, []byte("png"), 0644)
+	if _, err := ComputeEssenceHash(other); err != ErrNoEssence {
+		t.Errorf("Expected ErrNoEssence, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package icopy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metadata is what a MetadataExtractor reads from a file.
+type Metadata struct {
+	// DateTime is when the photo or video was taken. When zero, the file
+	// is dated by its modification time.
+	DateTime time.Time
+	// SubSec is the fraction of a second of DateTime, as EXIF writes it.
+	SubSec string
+	// Make and Model are the camera's.
+	Make  string
+	Model string
+	// HasGPS is set when the file records where it was taken.
+	HasGPS bool
+}
+
+// MetadataExtractor reads the metadata of the files it matches.
+type MetadataExtractor interface {
+	// Match reports whether the extractor reads files sniffed as s.
+	Match(s Sniff) bool
+	// Extract reads the metadata of a file of size bytes. It returns an
+	// error wrapping ErrNoMetadata when the file holds none it can read,
+	// and the next matching extractor is tried; any other error fails the
+	// file.
+	Extract(r io.ReaderAt, size int64) (Metadata, error)
+}
+
+// ErrNoMetadata is returned by extractors that find no metadata in a file.
+var ErrNoMetadata = errors.New("no metadata")
+
+// PriorityDefault is the priority of the extractors icopy comes with. An
+// extractor registered with a higher one is tried before them, and with a
+// lower one only when they find nothing.
+const PriorityDefault = 0
+
+type registeredExtractor struct {
+	extractor MetadataExtractor
+	priority  int
+}
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   []registeredExtractor
+)
+
+func init() {
+	RegisterExtractor(exifExtractor{}, PriorityDefault)
+	RegisterExtractor(heicExtractor{}, PriorityDefault)
+	RegisterExtractor(movExtractor{}, PriorityDefault)
+}
+
+// RegisterExtractor adds e to the extractors media files are read with. The
+// matching extractors are tried from the highest priority down, and in the
+// order they were registered within one priority, until one does not return
+// ErrNoMetadata. It is safe to call while files are being read.
+func RegisterExtractor(e MetadataExtractor, priority int) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	extractors = append(extractors, registeredExtractor{extractor: e, priority: priority})
+	sort.SliceStable(extractors, func(i, j int) bool {
+		return extractors[i].priority > extractors[j].priority
+	})
+}
+
+// matchingExtractors returns the extractors for files sniffed as s, in the
+// order they are tried.
+func matchingExtractors(s Sniff) []MetadataExtractor {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	matched := []MetadataExtractor{}
+	for _, r := range extractors {
+		if r.extractor.Match(s) {
+			matched = append(matched, r.extractor)
+		}
+	}
+	return matched
+}
+
+// extractMetadata reads the metadata of the file at fpath, sniffed as s, with
+// reads drawn from throttle. A file no extractor finds metadata in has none,
+// which is not an error.
+func extractMetadata(ctx context.Context, fpath string, s Sniff, throttle *Throttle) (Metadata, error) {
+	matched := matchingExtractors(s)
+	if len(matched) == 0 {
+		return Metadata{}, nil
+	}
+
+	fd, err := os.Open(fpath)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	r := throttle.ReaderAt(ctx, fd)
+	for _, e := range matched {
+		md, err := e.Extract(r, fi.Size())
+		if errors.Is(err, ErrNoMetadata) {
+			continue
+		}
+		return md, err
+	}
+	return Metadata{}, nil
+}
@@ -0,0 +1,129 @@
+package icopy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// stubExtractor matches one format and returns md and err.
+type stubExtractor struct {
+	format string
+	md     Metadata
+	err    error
+	calls  int
+}
+
+func (e *stubExtractor) Match(s Sniff) bool {
+	return s.Format == e.format
+}
+
+func (e *stubExtractor) Extract(r io.ReaderAt, size int64) (Metadata, error) {
+	e.calls++
+	return e.md, e.err
+}
+
+func TestRegisterExtractor(t *testing.T) {
+	defer func(saved []registeredExtractor) { extractors = saved }(slices.Clone(extractors))
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+
+	src := t.TempDir()
+	fpath := filepath.Join(src, "scan.png")
+	os.WriteFile(fpath, []byte("\x89PNG\r\n\x1A\n\x00\x00"), 0644)
+	sniff, _ := SniffFile(fpath)
+
+	taken := time.Date(2019, 6, 1, 14, 30, 0, 0, time.UTC)
+	fallback := &stubExtractor{format: FormatPNG, md: Metadata{DateTime: taken.AddDate(1, 0, 0)}}
+	empty := &stubExtractor{format: FormatPNG, err: fmt.Errorf("%w: no tEXt chunk", ErrNoMetadata)}
+	png := &stubExtractor{format: FormatPNG, md: Metadata{DateTime: taken, Make: "Scanner"}}
+	RegisterExtractor(fallback, PriorityDefault-1)
+	RegisterExtractor(empty, PriorityDefault+10)
+	RegisterExtractor(png, PriorityDefault+1)
+
+	md, err := extractMetadata(ctx, fpath, sniff, nil)
+	if err != nil {
+		t.Fatalf("extractMetadata returned error: %v", err)
+	}
+	// The highest priority finds nothing, so the next one decides and the
+	// fallback is never asked.
+	if !md.DateTime.Equal(taken) || md.Make != "Scanner" {
+		t.Errorf("Expected the date and make of the second extractor, got %+v", md)
+	}
+	if empty.calls != 1 || png.calls != 1 || fallback.calls != 0 {
+		t.Errorf("Expected calls 1, 1 and 0, got %d, %d and %d", empty.calls, png.calls, fallback.calls)
+	}
+
+	failing := &stubExtractor{format: FormatPNG, err: errors.New("corrupt chunk")}
+	RegisterExtractor(failing, PriorityDefault+20)
+	if _, err := extractMetadata(ctx, fpath, sniff, nil); err == nil {
+		t.Errorf("Expected the error of the failing extractor")
+	}
+
+	// Registered extractors date the files a copy reads.
+	extractors = slices.DeleteFunc(extractors, func(r registeredExtractor) bool { return r.extractor == failing })
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+	files, _ := ReadMedia(ctx, db, src, ScanOptions{})
+	if len(files) != 1 || !files[0].DateTime.Equal(taken) || files[0].Make != "Scanner" {
+		t.Errorf("Expected scan.png dated by the registered extractor, got %+v", files)
+	}
+}
+
+// movie returns an MP4 file whose movie header records created, with an
+// atom of filler before it.
+func movie(created time.Time) []byte {
+	var b bytes.Buffer
+	atom := func(kind string, body []byte) {
+		binary.Write(&b, binary.BigEndian, uint32(8+len(body)))
+		b.WriteString(kind)
+		b.Write(body)
+	}
+	atom("ftyp", []byte("isom\x00\x00\x02\x00isommp42"))
+	atom("free", make([]byte, 16))
+	mvhd := make([]byte, 8)
+	binary.BigEndian.PutUint32(mvhd[4:], uint32(created.Unix()+appleEpochAdjustment))
+	binary.Write(&b, binary.BigEndian, uint32(8+8+len(mvhd)))
+	b.WriteString("moov")
+	atom("mvhd", mvhd)
+	return b.Bytes()
+}
+
+func TestMovExtractor(t *testing.T) {
+	created := time.Date(2021, 12, 24, 18, 0, 0, 0, time.UTC)
+	data := movie(created)
+	if !(movExtractor{}).Match(Sniff{Format: SniffFormat(data)}) {
+		t.Fatalf("Expected the movie to match")
+	}
+	md, err := movExtractor{}.Extract(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Extract returned error: %v", err)
+	}
+	if !md.DateTime.Equal(created) {
+		t.Errorf("Expected %v, got %v", created, md.DateTime)
+	}
+
+	// Without a moov atom the file is dated another way.
+	noMoov := data[:len(data)-24]
+	if _, err := (movExtractor{}).Extract(bytes.NewReader(noMoov), int64(len(noMoov))); !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Expected ErrNoMetadata without a moov atom, got %v", err)
+	}
+
+	// A moov that does not start with its header is an error.
+	broken := bytes.Replace(data, []byte("mvhd"), []byte("trak"), 1)
+	if _, err := (movExtractor{}).Extract(bytes.NewReader(broken), int64(len(broken))); err == nil || errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Expected an error for a moov without mvhd, got %v", err)
+	}
+}
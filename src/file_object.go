@@ -2,18 +2,75 @@ package icopy
 
 import "time"
 
+// Media types for FileObject.MediaType.
+const (
+	MediaImage   = "image"
+	MediaVideo   = "video"
+	MediaAudio   = "audio"
+	MediaSidecar = "sidecar" // XMP, THM, AAE and the like, kept next to a photo or video
+)
+
 type FileObject struct {
 	Name     string    `json:"name"`
 	Path     string    `json:"path"`
 	DateTime time.Time `json:"date_time"`
 	Md5Sum   string    `json:"md5sum"`
+
+	// EssenceHash covers only the image or media payload; see
+	// ComputeEssenceHash. Empty unless ScanOptions.UseEssenceHash is set.
+	EssenceHash string `json:"essence_hash,omitempty"`
+
+	// PerceptualHash and the dimensions are set for decodable images when
+	// ScanOptions.UsePerceptualHash is set; see ComputePerceptualHash.
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+
+	// HasGPS is set for images whose EXIF carries a location.
+	HasGPS bool `json:"has_gps,omitempty"`
+
+	// Make and Model are the camera's, from EXIF, when known.
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	// SubSec is the fraction of a second of DateTime, as EXIF writes it.
+	SubSec string `json:"subsec,omitempty"`
+
+	// MediaType is MediaImage, MediaVideo, MediaAudio or MediaSidecar.
+	MediaType string `json:"media_type,omitempty"`
+	// Format is what the file's content says it is, and WrongExt is set when
+	// its extension says otherwise; see Sniff.
+	Format   string `json:"format,omitempty"`
+	WrongExt bool   `json:"wrong_ext,omitempty"`
+
+	// Destination is the output library a copied or skipped file belongs to.
+	Destination string `json:"destination,omitempty"`
+
+	// Sidecars are the sidecars found next to a media file that belong to
+	// it. They are dated, placed and named with it.
+	Sidecars []FileObject `json:"sidecars,omitempty"`
 }
 
 type ScanOptions struct {
-	Recursive    bool
-	NumWorkers   int
-	UseFastHash  bool
-	ProgressChan chan string
+	Recursive bool
+	// FollowLinks enters symbolic links to directories in the source.
+	// Destinations are never walked through them.
+	FollowLinks bool
+	NumWorkers  int
+	UseFastHash bool
+	// UseEssenceHash also computes essence hashes, and makes a file whose
+	// essence is already in the destination a duplicate.
+	UseEssenceHash bool
+	// UsePerceptualHash decodes images to compute their perceptual hash.
+	UsePerceptualHash bool
+	ProgressChan      chan string
+	Throttle          *Throttle
+	Sizer             *WorkerSizer
+	// Filter leaves source files out; destinations are always read whole.
+	Filter *Filter
+	// MediaTypes limits a source scan, and what StreamMedia reads, to files
+	// of these types. When empty, a scan reads every file and StreamMedia
+	// every type.
+	MediaTypes []string
 }
 
 type ErroredFileObject struct {
@@ -21,4 +78,5 @@ type ErroredFileObject struct {
 	Path         string    `json:"path"`
 	DateTime     time.Time `json:"date_time"`
 	ErrorMessage string    `json:"error_message"`
+	Destination  string    `json:"destination,omitempty"`
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/rs/zerolog"
 )
 
@@ -31,43 +32,37 @@ func writeStatusFile(ctx context.Context, imagefile FileObject) {
 	}
 }
 
-func checkStatusFile(ctx context.Context, imageFiles []FileObject) []FileObject {
+// statusKey is the key loadStatusFile records a copied source path under.
+func statusKey(fpath string) string {
+	return "status-" + fpath
+}
+
+// loadStatusFile records the source paths the status file lists as copied in
+// db, replacing what an earlier run left there.
+func loadStatusFile(ctx context.Context, db *badger.DB) error {
 	logger := ctx.Value("logger").(zerolog.Logger)
-	_, err := os.Stat("./.file_status.txt")
-	if err != nil {
-		if os.IsNotExist(err) {
-			logger.Debug().Msg("No .file_status.txt file found")
-			return imageFiles
-		}
+	if err := db.DropPrefix([]byte(statusKey(""))); err != nil {
+		return err
 	}
 
 	fd, err := os.Open("./.file_status.txt")
 	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Debug().Msg("No .file_status.txt file found")
+			return nil
+		}
 		logger.Error().Err(err).Msg("Error opening .file_status.txt file")
-		return nil
+		return err
 	}
 	defer fd.Close()
+
+	batch := NewBatchWriter(db, DefaultBatchSize, DefaultBatchInterval)
 	scanner := bufio.NewScanner(fd)
-	filesCopied := []string{}
 	for scanner.Scan() {
-		line := scanner.Text()
-		filesCopied = append(filesCopied, line)
-	}
-
-	rImageFiles := []FileObject{}
-	for _, image := range imageFiles {
-		if !contains(filesCopied, path.Join(image.Path, image.Name)) {
-			rImageFiles = append(rImageFiles, image)
-		}
+		batch.Put(statusKey(scanner.Text()), "")
 	}
-	return rImageFiles
-}
-
-func contains(filesCopied []string, s string) bool {
-	for _, f := range filesCopied {
-		if f == s {
-			return true
-		}
+	if err := batch.Close(); err != nil {
+		return err
 	}
-	return false
+	return scanner.Err()
 }
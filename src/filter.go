@@ -0,0 +1,252 @@
+package icopy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Filter narrows the source files a scan or copy reads. Patterns and sizes are
+// checked while walking, before a file is read; the date range once its
+// capture date is known. A nil Filter keeps everything.
+type Filter struct {
+	// MinSize and MaxSize bound the file size in bytes; 0 is no bound.
+	MinSize int64
+	MaxSize int64
+	// Since and Until bound the capture date, Until excluded; zero is no
+	// bound.
+	Since time.Time
+	Until time.Time
+
+	include  []filterPattern
+	exclude  []filterPattern
+	excluded atomic.Int64
+}
+
+// filterPattern is an -include or -exclude pattern. Globs are matched without
+// regard to case: against the whole path relative to the source when they
+// contain a slash, and against each name along it when they do not. A trailing
+// slash only matches folders. Regular expressions, given as "re:<expr>", are
+// matched against the relative path with slashes.
+type filterPattern struct {
+	glob    string
+	re      *regexp.Regexp
+	dirOnly bool
+}
+
+// Include adds a pattern a file must match, unless no pattern is included.
+func (f *Filter) Include(pattern string) error {
+	p, err := parseFilterPattern(pattern)
+	if err == nil {
+		f.include = append(f.include, p)
+	}
+	return err
+}
+
+// Exclude adds a pattern that leaves out the files matching it, even when
+// they are included.
+func (f *Filter) Exclude(pattern string) error {
+	p, err := parseFilterPattern(pattern)
+	if err == nil {
+		f.exclude = append(f.exclude, p)
+	}
+	return err
+}
+
+func parseFilterPattern(pattern string) (filterPattern, error) {
+	if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return filterPattern{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		return filterPattern{re: re}, nil
+	}
+	p := filterPattern{glob: strings.ToLower(strings.TrimPrefix(pattern, "/"))}
+	p.glob, p.dirOnly = strings.CutSuffix(p.glob, "/")
+	if p.glob == "" {
+		return p, fmt.Errorf("empty pattern %q", pattern)
+	}
+	if _, err := path.Match(p.glob, ""); err != nil {
+		return p, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return p, nil
+}
+
+// matches reports whether p matches the file at rel, a relative path with
+// slashes, or one of the folders it is in.
+func (p filterPattern) matches(rel string) bool {
+	if p.re != nil {
+		return p.re.MatchString(rel)
+	}
+	rel = strings.ToLower(rel)
+	anchored := strings.Contains(p.glob, "/")
+	elems := strings.Split(rel, "/")
+	for i := range elems {
+		if p.dirOnly && i == len(elems)-1 {
+			break
+		}
+		subject := elems[i]
+		if anchored {
+			subject = strings.Join(elems[:i+1], "/")
+		}
+		if ok, _ := path.Match(p.glob, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded returns how many files the filter has left out.
+func (f *Filter) Excluded() int64 {
+	if f == nil {
+		return 0
+	}
+	return f.excluded.Load()
+}
+
+// keepPath reports whether the file at fpath, found under root, passes the
+// patterns and size bounds, and counts it when it does not.
+func (f *Filter) keepPath(root string, fpath string) bool {
+	if f == nil || f.matchPath(root, fpath) {
+		return true
+	}
+	f.excluded.Add(1)
+	return false
+}
+
+func (f *Filter) matchPath(root string, fpath string) bool {
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil || rel == "." {
+		rel = filepath.Base(fpath)
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, p := range f.exclude {
+		if p.matches(rel) {
+			return false
+		}
+	}
+	if len(f.include) > 0 {
+		included := false
+		for _, p := range f.include {
+			if included = p.matches(rel); included {
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	if f.MinSize > 0 || f.MaxSize > 0 {
+		// Links are measured by what they point at.
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			return false
+		}
+		if fi.Size() < f.MinSize || (f.MaxSize > 0 && fi.Size() > f.MaxSize) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDates reports whether the filter bounds capture dates.
+func (f *Filter) hasDates() bool {
+	return f != nil && (!f.Since.IsZero() || !f.Until.IsZero())
+}
+
+// keepDate reports whether tm is within the date range, and counts the file
+// when it is not.
+func (f *Filter) keepDate(tm time.Time) bool {
+	if !f.hasDates() || ((f.Since.IsZero() || !tm.Before(f.Since)) && (f.Until.IsZero() || tm.Before(f.Until))) {
+		return true
+	}
+	f.excluded.Add(1)
+	return false
+}
+
+// keepModTime applies the date range to a file that is only hashed, by its
+// modification time, as reading its capture date falls back to.
+func keepModTime(f *Filter, fpath string) bool {
+	if !f.hasDates() {
+		return true
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return true
+	}
+	return f.keepDate(fi.ModTime())
+}
+
+// byDate returns the channel to send read files on so that only those within
+// the date range reach out, and a function that closes it and waits until the
+// last file has been passed on.
+func (f *Filter) byDate(out chan<- FileObject) (chan<- FileObject, func()) {
+	if !f.hasDates() {
+		return out, func() {}
+	}
+	in := make(chan FileObject)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for file := range in {
+			if f.keepDate(file.DateTime) {
+				out <- file
+			}
+		}
+	}()
+	return in, func() {
+		close(in)
+		<-done
+	}
+}
+
+// ParseSize parses a file size such as "1MB" or "500K", with the binary
+// multiples ParseRate uses.
+func ParseSize(s string) (int64, error) {
+	if strings.Contains(s, "/") {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := ParseRate(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+// ParseFilterDate parses a -since or -until value relative to now: a date
+// such as "2024-03-01", a time such as "2024-03-01T18:00:00" in local time or
+// with a zone, or an age such as "36h", "7d" or "2w". A date alone given as
+// an end means the end of that day.
+func ParseFilterDate(s string, now time.Time, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimRight(s, "dw")); err == nil && n >= 0 && len(s) > 1 {
+		switch s[len(s)-1] {
+		case 'd':
+			return now.AddDate(0, 0, -n), nil
+		case 'w':
+			return now.AddDate(0, 0, -7*n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q: use 2006-01-02, 2006-01-02T15:04:05 or an age such as 7d", s)
+}
@@ -0,0 +1,148 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestFilterPatterns(t *testing.T) {
+	root := "/media/card"
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		rel      string
+		expected bool
+	}{
+		{name: "no patterns", rel: "DCIM/IMG_0001.JPG", expected: true},
+		{name: "glob on name, any case", exclude: []string{"*.thm"}, rel: "DCIM/MVI_0001.THM", expected: false},
+		{name: "folder", exclude: []string{"MISC/"}, rel: "MISC/sub/a.jpg", expected: false},
+		{name: "folder pattern not a file", exclude: []string{"misc/"}, rel: "DCIM/misc", expected: true},
+		{name: "anchored", exclude: []string{"DCIM/1*CANON"}, rel: "DCIM/100CANON/a.jpg", expected: false},
+		{name: "anchored elsewhere", exclude: []string{"DCIM/1*CANON"}, rel: "backup/DCIM/100CANON/a.jpg", expected: true},
+		{name: "regexp", exclude: []string{`re:^DCIM/\d+_FUJI/`}, rel: "DCIM/101_FUJI/a.raf", expected: false},
+		{name: "included", include: []string{"*.jpg", "*.cr3"}, rel: "DCIM/a.CR3", expected: true},
+		{name: "not included", include: []string{"*.jpg"}, rel: "DCIM/a.mov", expected: false},
+		{name: "exclude wins", include: []string{"DCIM/"}, exclude: []string{"*.thm"}, rel: "DCIM/a.thm", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Filter{}
+			for _, p := range tt.include {
+				if err := f.Include(p); err != nil {
+					t.Fatalf("Include(%s) returned error: %v", p, err)
+				}
+			}
+			for _, p := range tt.exclude {
+				if err := f.Exclude(p); err != nil {
+					t.Fatalf("Exclude(%s) returned error: %v", p, err)
+				}
+			}
+			if result := f.keepPath(root, filepath.Join(root, filepath.FromSlash(tt.rel))); result != tt.expected {
+				t.Errorf("keepPath(%s) = %v; want %v", tt.rel, result, tt.expected)
+			}
+		})
+	}
+
+	f := &Filter{}
+	if err := f.Exclude("re:("); err == nil {
+		t.Error("Expected an invalid regexp to fail")
+	}
+	if err := f.Exclude("[a"); err == nil {
+		t.Error("Expected an invalid glob to fail")
+	}
+}
+
+func TestFilterSizeAndDate(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.jpg")
+	big := filepath.Join(dir, "big.jpg")
+	os.WriteFile(small, make([]byte, 10), 0644)
+	os.WriteFile(big, make([]byte, 2048), 0644)
+
+	f := &Filter{MinSize: 1024}
+	if f.keepPath(dir, small) || !f.keepPath(dir, big) {
+		t.Error("Expected only files of at least 1K to be kept")
+	}
+	f.MaxSize = 1500
+	if f.keepPath(dir, big) {
+		t.Error("Expected files over the maximum to be left out")
+	}
+
+	f = &Filter{Since: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Until: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)}
+	if !f.keepDate(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || f.keepDate(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) ||
+		f.keepDate(time.Date(2024, 2, 29, 23, 59, 0, 0, time.UTC)) {
+		t.Error("Expected Since to be included and Until excluded")
+	}
+	if f.Excluded() != 2 {
+		t.Errorf("Expected 2 files counted as excluded, got %d", f.Excluded())
+	}
+}
+
+func TestParseFilterDate(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		in       string
+		end      bool
+		expected time.Time
+	}{
+		{in: "2024-03-01", expected: time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		{in: "2024-03-01", end: true, expected: time.Date(2024, 3, 2, 0, 0, 0, 0, time.Local)},
+		{in: "2024-03-01T18:30:00", expected: time.Date(2024, 3, 1, 18, 30, 0, 0, time.Local)},
+		{in: "7d", expected: time.Date(2024, 3, 8, 12, 0, 0, 0, time.Local)},
+		{in: "2w", expected: time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)},
+		{in: "36h", expected: time.Date(2024, 3, 14, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		result, err := ParseFilterDate(tt.in, now, tt.end)
+		if err != nil || !result.Equal(tt.expected) {
+			t.Errorf("ParseFilterDate(%s, %v) = %v, %v; want %v", tt.in, tt.end, result, err, tt.expected)
+		}
+	}
+	if _, err := ParseFilterDate("last week", now, false); err == nil {
+		t.Error("Expected an unknown date to fail")
+	}
+}
+
+func TestScanFiltersSource(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "MISC"), 0755)
+	os.MkdirAll(filepath.Join(src, "DCIM"), 0755)
+	os.WriteFile(filepath.Join(src, "a.jpg"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(src, "a.thm"), []byte("thumb"), 0644)
+	os.WriteFile(filepath.Join(src, "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(src, "MISC", "b.jpg"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(src, "DCIM", "c.jpg"), []byte("c"), 0644)
+
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	filter := &Filter{}
+	filter.Exclude("MISC/")
+	filter.Exclude("*.thm")
+	options := ScanOptions{Recursive: true, Filter: filter, MediaTypes: []string{MediaImage}}
+	ScanAndGenerateMd5sumFiles(ctx, db, src, "src", options)
+
+	files, _ := IterateWithPrefix(db, "src")
+	if len(files) != 2 {
+		t.Errorf("Expected a.jpg and DCIM/c.jpg to be scanned, got %d files", len(files))
+	}
+	// Files of another type are not counted as excluded.
+	if filter.Excluded() != 1 {
+		t.Errorf("Expected MISC/b.jpg excluded, got %d files", filter.Excluded())
+	}
+
+	ScanAndGenerateMd5sumFiles(ctx, db, src, "dst", options)
+	if files, _ := IterateWithPrefix(db, "dst"); len(files) != 5 {
+		t.Errorf("Expected a destination to be scanned whole, got %d files", len(files))
+	}
+}
@@ -1,10 +1,12 @@
 package icopy
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
 const (
@@ -19,26 +21,37 @@ const (
 // it computes a partial hash based on the beginning, middle, and end of the file.
 // Otherwise, it computes the full MD5.
 func ComputeFileHash(filePath string, useFastHash bool) (string, error) {
+	return computeFileHash(context.Background(), filePath, useFastHash, nil)
+}
+
+// computeFileHash is ComputeFileHash with reads drawn from throttle.
+func computeFileHash(ctx context.Context, filePath string, useFastHash bool, throttle *Throttle) (string, error) {
 	fi, err := os.Stat(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to stat file: %w", err)
 	}
 
 	if useFastHash && fi.Size() > FastHashThreshold {
-		return computePartialHash(filePath, fi.Size())
+		return computePartialHash(ctx, filePath, fi.Size(), throttle)
 	}
 
-	return Md5Sum(filePath)
+	return md5Sum(ctx, filePath, throttle)
+}
+
+// isFastHash reports whether sum is a partial hash from computePartialHash.
+func isFastHash(sum string) bool {
+	return strings.HasPrefix(sum, "fast-")
 }
 
 // computePartialHash reads the first, middle, and last ChunkSize bytes of the file
 // and computes an MD5 checksum of those combined chunks.
-func computePartialHash(filePath string, fileSize int64) (string, error) {
+func computePartialHash(ctx context.Context, filePath string, fileSize int64, throttle *Throttle) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
+	r := throttle.Reader(ctx, file)
 
 	hash := md5.New()
 
@@ -47,7 +60,7 @@ func computePartialHash(filePath string, fileSize int64) (string, error) {
 	// but purely safe logic:
 	if fileSize <= 3*ChunkSize {
 		// Just hash the whole thing if it somehow got here
-		if _, err := io.Copy(hash, file); err != nil {
+		if _, err := io.Copy(hash, r); err != nil {
 			return "", err
 		}
 		return fmt.Sprintf("fast-%x", hash.Sum(nil)), nil
@@ -56,7 +69,7 @@ func computePartialHash(filePath string, fileSize int64) (string, error) {
 	buf := make([]byte, ChunkSize)
 
 	// Start
-	if _, err := io.ReadFull(file, buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", err
 	}
 	hash.Write(buf)
@@ -65,7 +78,7 @@ func computePartialHash(filePath string, fileSize int64) (string, error) {
 	if _, err := file.Seek(fileSize/2-int64(ChunkSize/2), 0); err != nil {
 		return "", err
 	}
-	if _, err := io.ReadFull(file, buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", err
 	}
 	hash.Write(buf)
@@ -74,7 +87,7 @@ func computePartialHash(filePath string, fileSize int64) (string, error) {
 	if _, err := file.Seek(-int64(ChunkSize), 2); err != nil {
 		return "", err
 	}
-	if _, err := io.ReadFull(file, buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", err
 	}
 	hash.Write(buf)
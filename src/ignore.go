@@ -0,0 +1,160 @@
+package icopy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the file that lists, in gitignore syntax, what the walks
+// in a directory and below it leave out.
+const IgnoreFileName = ".icopyignore"
+
+// GlobalIgnoreFile returns the ignore file that applies to every walk, such
+// as ~/.config/icopy/ignore on Linux, or "" when there is no configuration
+// directory. Rules in .icopyignore files take precedence over it.
+func GlobalIgnoreFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "icopy", "ignore")
+}
+
+// ignoreList is the rules of one ignore file, which apply to paths below
+// base, a path relative to the walk root with slashes ("" for the root).
+type ignoreList struct {
+	base  string
+	rules []ignoreRule
+}
+
+// ignoreRule is one line of an ignore file. As in gitignore, a pattern
+// without a slash matches a name at any depth, one with a slash is matched
+// from the file's directory, "**" matches any number of folders, a trailing
+// slash only matches folders and a leading "!" takes a path back in.
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// readIgnoreFile reads the rules in fpath for paths below base. A missing
+// file has no rules.
+func readIgnoreFile(fpath string, base string) (*ignoreList, error) {
+	fd, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	list := &ignoreList{base: base}
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		rule, ok, err := parseIgnoreRule(scanner.Text())
+		if err != nil {
+			return list, fmt.Errorf("%s:%d: %w", fpath, n, err)
+		}
+		if ok {
+			list.rules = append(list.rules, rule)
+		}
+	}
+	return list, scanner.Err()
+}
+
+// parseIgnoreRule parses a line of an ignore file; ok is false for blank lines
+// and comments.
+func parseIgnoreRule(line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are dropped unless escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	line, rule.dirOnly = strings.CutSuffix(line, "/")
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule, false, nil
+	}
+	rule.segments = strings.Split(line, "/")
+	for _, seg := range rule.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return rule, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+	}
+	return rule, true, nil
+}
+
+// ignored reports whether the lists, outermost first, leave out rel, a path
+// relative to the walk root with slashes. The last rule that matches decides.
+func ignored(lists []*ignoreList, rel string, isDir bool) bool {
+	result := false
+	for _, list := range lists {
+		sub := rel
+		if list.base != "" {
+			var ok bool
+			if sub, ok = strings.CutPrefix(rel, list.base+"/"); !ok {
+				continue
+			}
+		}
+		for _, rule := range list.rules {
+			if rule.matches(sub, isDir) {
+				result = !rule.negate
+			}
+		}
+	}
+	return result
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches a path against a pattern, a folder at a time, where a
+// "**" segment stands for any number of folders.
+func matchSegments(pattern []string, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				// "dir/**" is what is inside dir, not dir itself.
+				return len(elems) > 0
+			}
+			for i := 0; i <= len(elems); i++ {
+				if matchSegments(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
@@ -0,0 +1,118 @@
+package icopy
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{[]string{"Thumbs.db"}, "Thumbs.db", false, true},
+		{[]string{"Thumbs.db"}, "DCIM/100CANON/Thumbs.db", false, true},
+		{[]string{"Thumbs.db"}, "thumbs.db", false, false},
+		{[]string{"._*"}, "DCIM/._IMG_0001.JPG", false, true},
+		{[]string{"# comment", "", "MISC/"}, "MISC", true, true},
+		{[]string{"MISC/"}, "MISC", false, false},
+		{[]string{"/MISC"}, "MISC", true, true},
+		{[]string{"/MISC"}, "DCIM/MISC", true, false},
+		{[]string{"DCIM/*.THM"}, "DCIM/MVI_0001.THM", false, true},
+		{[]string{"DCIM/*.THM"}, "DCIM/100CANON/MVI_0001.THM", false, false},
+		{[]string{"**/cache"}, "a/b/cache", true, true},
+		{[]string{"**/cache"}, "cache", true, true},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"a/**"}, "a/x/y", false, true},
+		{[]string{"a/**"}, "a", true, false},
+		{[]string{"*.xmp", "!keep.xmp"}, "keep.xmp", false, false},
+		{[]string{"*.xmp", "!keep.xmp"}, "other.xmp", false, true},
+		{[]string{"!keep.xmp", "*.xmp"}, "keep.xmp", false, true},
+		{[]string{`\!important`}, "!important", false, true},
+		{[]string{`\#hash`}, "#hash", false, true},
+		{[]string{"trailing   "}, "trailing", false, true},
+	}
+	for _, test := range tests {
+		list := &ignoreList{}
+		for _, line := range test.rules {
+			rule, ok, err := parseIgnoreRule(line)
+			if err != nil {
+				t.Fatalf("parseIgnoreRule(%q) returned error: %v", line, err)
+			}
+			if ok {
+				list.rules = append(list.rules, rule)
+			}
+		}
+		if got := ignored([]*ignoreList{list}, test.rel, test.isDir); got != test.ignored {
+			t.Errorf("Rules %q on %s (dir %v): expected ignored %v, got %v", test.rules, test.rel, test.isDir, test.ignored, got)
+		}
+	}
+
+	if _, _, err := parseIgnoreRule("[a-"); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestWalkSourceIgnores(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+	os.MkdirAll(filepath.Dir(GlobalIgnoreFile()), 0755)
+	os.WriteFile(GlobalIgnoreFile(), []byte(".DS_Store\n.Trashes/\n"), 0644)
+
+	root := t.TempDir()
+	files := map[string]string{
+		".DS_Store":                    "x",
+		".Trashes/501/IMG_0001.JPG":    "x",
+		"MISC/AUTPRINT.MRK":            "x",
+		"DCIM/100CANON/IMG_0001.JPG":   "x",
+		"DCIM/100CANON/IMG_0001.xmp":   "x",
+		"DCIM/100CANON/keep.xmp":       "x",
+		"DCIM/100CANON/.DS_Store":      "x",
+		"DCIM/100CANON/MVI_0002.THM":   "x",
+		"DCIM/100CANON/MVI_0002.MOV":   "x",
+		"DCIM/101CANON/IMG_0003.JPG":   "x",
+		"DCIM/101CANON/.icopyignore":   "!*.THM\n",
+		"DCIM/101CANON/MVI_0004.THM":   "x",
+		"DCIM/.icopyignore":            "*.xmp\n!keep.xmp\n",
+		".icopyignore":                 "/MISC\n*.THM\n",
+		"Other/DCIM/100CANON/skip.xmp": "x",
+	}
+	for name, content := range files {
+		fpath := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		os.WriteFile(fpath, []byte(content), 0644)
+	}
+
+	walked := []string{}
+	err := walkSource(ctx, root, true, false, func(path string, d fs.DirEntry) {
+		rel, _ := filepath.Rel(root, path)
+		walked = append(walked, filepath.ToSlash(rel))
+	})
+	if err != nil {
+		t.Fatalf("walkSource returned error: %v", err)
+	}
+	// The .xmp rules in DCIM do not reach Other, and the negation in 101CANON
+	// takes its thumbnail back.
+	expected := []string{
+		"DCIM/100CANON/IMG_0001.JPG",
+		"DCIM/100CANON/MVI_0002.MOV",
+		"DCIM/100CANON/keep.xmp",
+		"DCIM/101CANON/IMG_0003.JPG",
+		"DCIM/101CANON/MVI_0004.THM",
+		"Other/DCIM/100CANON/skip.xmp",
+	}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Expected %v, got %v", expected, walked)
+	}
+}
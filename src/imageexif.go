@@ -4,211 +4,89 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io/fs"
-	"os"
-	"path/filepath"
+	"io"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/dgraph-io/badger/v4"
-	"github.com/rs/zerolog"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
 func ReadJpegDate(ctx context.Context, db *badger.DB, src_dirname string, options ScanOptions) ([]FileObject, []ErroredFileObject) {
-	logger := ctx.Value("logger").(zerolog.Logger)
-
-	imageFiles := []FileObject{}
-	erroredFiles := []ErroredFileObject{}
-
-	// Channels for results
-	imageChan := make(chan FileObject)
-	erroredChan := make(chan ErroredFileObject)
+	return collectFiles(ctx, db, src_dirname, options, StreamJpegDate)
+}
 
-	// Worker pool
-	jobs := make(chan string)
-	var wg sync.WaitGroup
+// StreamJpegDate is ReadJpegDate sending each file on as soon as it is
+// read instead of collecting them. It returns once every file has been sent.
+func StreamJpegDate(ctx context.Context, db *badger.DB, src_dirname string, options ScanOptions, imageChan chan<- FileObject, erroredChan chan<- ErroredFileObject) {
+	options.MediaTypes = []string{MediaImage}
+	StreamMedia(ctx, db, src_dirname, options, imageChan, erroredChan)
+}
 
-	numWorkers := options.NumWorkers
-	if numWorkers <= 0 {
-		numWorkers = 10
-	}
+// exifExtractor reads the EXIF of JPEG, TIFF and the RAW formats built on
+// TIFF.
+type exifExtractor struct{}
 
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for fpath := range jobs {
-				if options.ProgressChan != nil {
-					select {
-					case options.ProgressChan <- fmt.Sprintf("Scanning: %s", filepath.Base(fpath)):
-					default:
-					}
-				}
-				processImageFile(ctx, db, fpath, imageChan, erroredChan, options.UseFastHash)
-			}
-		}()
+func (exifExtractor) Match(s Sniff) bool {
+	switch s.Format {
+	case FormatJPEG, FormatTIFF, FormatCR2, FormatORF, FormatRW2, FormatRAF:
+		return true
 	}
+	return false
+}
 
-	// Result collector
-	done := make(chan struct{})
-	collectorDone := make(chan struct{})
-	go func() {
-		defer close(collectorDone)
-		for {
-			select {
-			case img := <-imageChan:
-				imageFiles = append(imageFiles, img)
-			case errFile := <-erroredChan:
-				erroredFiles = append(erroredFiles, errFile)
-			case <-done:
-				return
-			}
-		}
-	}()
-
-	err := filepath.WalkDir(src_dirname, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			logger.Error().Err(err).Msgf("Error walking path: %s", path)
-			return nil
-		}
-		if d.IsDir() {
-			if path != src_dirname && !options.Recursive {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		lowerName := strings.ToLower(d.Name())
-		if strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") ||
-			strings.HasSuffix(lowerName, ".gif") || strings.HasSuffix(lowerName, ".png") ||
-			strings.HasSuffix(lowerName, ".bmp") || strings.HasSuffix(lowerName, ".heic") ||
-			strings.HasSuffix(lowerName, ".tiff") || strings.HasSuffix(lowerName, ".tif") ||
-			strings.HasSuffix(lowerName, ".webp") || strings.HasSuffix(lowerName, ".svg") ||
-			strings.HasSuffix(lowerName, ".psd") || strings.HasSuffix(lowerName, ".ai") ||
-			strings.HasSuffix(lowerName, ".cr2") || strings.HasSuffix(lowerName, ".nef") ||
-			strings.HasSuffix(lowerName, ".arw") || strings.HasSuffix(lowerName, ".dng") ||
-			strings.HasSuffix(lowerName, ".orf") || strings.HasSuffix(lowerName, ".rw2") ||
-			strings.HasSuffix(lowerName, ".raf") || strings.HasSuffix(lowerName, ".cr3") {
-			jobs <- path
-		}
-		return nil
-	})
-
+func (exifExtractor) Extract(r io.ReaderAt, size int64) (Metadata, error) {
+	x, err := exif.Decode(io.NewSectionReader(r, 0, size))
 	if err != nil {
-		logger.Error().Err(err).Msg("Error walking directory")
+		return Metadata{}, fmt.Errorf("%w: %v", ErrNoMetadata, err)
 	}
+	return exifMetadata(x), nil
+}
 
-	close(jobs)
-	wg.Wait()
-	close(done)
-	<-collectorDone
-
-	// drain channels just in case
-	close(imageChan)
-	close(erroredChan)
+// heicExtractor reads the EXIF item of HEIC and AVIF files.
+type heicExtractor struct{}
 
-	return imageFiles, erroredFiles
+func (heicExtractor) Match(s Sniff) bool {
+	return s.Format == FormatHEIC || s.Format == FormatAVIF
 }
 
-func processImageFile(ctx context.Context, db *badger.DB, fpath string, imageChan chan<- FileObject, erroredChan chan<- ErroredFileObject, useFastHash bool) {
-	logger := ctx.Value("logger").(zerolog.Logger)
-	fileName := filepath.Base(fpath)
-
-	md5sum, err := ComputeFileHash(fpath, useFastHash)
+func (heicExtractor) Extract(r io.ReaderAt, size int64) (Metadata, error) {
+	exifData, err := ExtractHeicExif(r)
+	if err != nil || exifData == nil {
+		return Metadata{}, fmt.Errorf("%w: no EXIF item: %v", ErrNoMetadata, err)
+	}
+	x, err := exif.Decode(bytes.NewReader(exifData))
 	if err != nil {
-		logger.Error().Err(err).Msgf("Failed to calculate md5sum for file: %s", fpath)
-		// Consider adding to erroredFiles or just logging. For now logging.
-		return
+		return Metadata{}, fmt.Errorf("%w: %v", ErrNoMetadata, err)
 	}
-	PutBadgerDB(db, "src-"+md5sum, fpath)
-
-	lowerName := strings.ToLower(fileName)
-	var tm time.Time
+	return exifMetadata(x), nil
+}
 
-	// Determine if we should attempt to read EXIF data
-	tryExif := false
-	isHeic := false
-	if strings.HasSuffix(lowerName, ".jpg") || strings.HasSuffix(lowerName, ".jpeg") ||
-		strings.HasSuffix(lowerName, ".tiff") || strings.HasSuffix(lowerName, ".tif") ||
-		strings.HasSuffix(lowerName, ".cr2") || strings.HasSuffix(lowerName, ".nef") ||
-		strings.HasSuffix(lowerName, ".arw") || strings.HasSuffix(lowerName, ".dng") ||
-		strings.HasSuffix(lowerName, ".orf") || strings.HasSuffix(lowerName, ".rw2") ||
-		strings.HasSuffix(lowerName, ".raf") {
-		tryExif = true
-	} else if strings.HasSuffix(lowerName, ".heic") {
-		isHeic = true
+// exifMetadata returns what x records. A missing date is left zero.
+func exifMetadata(x *exif.Exif) Metadata {
+	md := Metadata{SubSec: exifString(x, exif.SubSecTimeOriginal)}
+	_, _, gpsErr := x.LatLong()
+	md.HasGPS = gpsErr == nil
+	md.Make, md.Model = exifCamera(x)
+	if t, err := x.DateTime(); err == nil {
+		md.DateTime = t
 	}
+	return md
+}
 
-	foundDate := false
-	if tryExif {
-		fd, err := os.Open(fpath)
-		if err == nil {
-			defer fd.Close()
-			x, err := exif.Decode(fd)
-			if err == nil {
-				t, err := x.DateTime()
-				if err == nil {
-					tm = t
-					foundDate = true
-				}
-			} else {
-				// Log debug if needed
-			}
-		} else {
-			logger.Error().Err(err).Msgf("Failed to open file: %s", fpath)
-			erroredChan <- ErroredFileObject{
-				DateTime: time.Now(), Name: fileName, Path: filepath.Dir(fpath),
-				ErrorMessage: err.Error(),
-			}
-			return
-		}
-	} else if isHeic {
-		// HEIC custom parsing
-		fd, err := os.Open(fpath)
-		if err == nil {
-			defer fd.Close()
-			exifData, err := ExtractHeicExif(fd)
-			if err == nil && exifData != nil {
-				x, err := exif.Decode(bytes.NewReader(exifData))
-				if err == nil {
-					t, err := x.DateTime()
-					if err == nil {
-						tm = t
-						foundDate = true
-					}
-				}
-			}
-		} else {
-			logger.Error().Err(err).Msgf("Failed to open file: %s", fpath)
-			erroredChan <- ErroredFileObject{
-				DateTime: time.Now(), Name: fileName, Path: filepath.Dir(fpath),
-				ErrorMessage: err.Error(),
-			}
-			return
-		}
-	}
+// exifCamera returns the camera make and model recorded in x, if any.
+func exifCamera(x *exif.Exif) (string, string) {
+	return exifString(x, exif.Make), exifString(x, exif.Model)
+}
 
-	// Fallback to file modification time if EXIF failed or not supported
-	if !foundDate {
-		fi, err := os.Stat(fpath)
-		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to stat file: %s", fpath)
-			return
-		}
-		tm = fi.ModTime()
+// exifString returns the text tag name of x, or "" when it is missing.
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
 	}
-
-	// Fallback to file modification time if EXIF failed or not supported
-	if !foundDate {
-		fi, err := os.Stat(fpath)
-		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to stat file: %s", fpath)
-			return
-		}
-		tm = fi.ModTime()
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
 	}
-
-	imageChan <- FileObject{DateTime: tm, Name: fileName, Path: filepath.Dir(fpath), Md5Sum: md5sum}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
 }
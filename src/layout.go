@@ -0,0 +1,480 @@
+package icopy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The built-in -dirformat names and the templates they stand for.
+var namedLayouts = map[string]string{
+	"DATE":       "{year:04}-{month:02}-{day:02}",
+	"YEAR-MONTH": "{year:04}/{month:02}",
+	"NOF":        "",
+	"MIRROR":     "{srcdir}",
+}
+
+// Tokens a layout template can use, as {name} or {name:spec}. Numbers take a
+// width spec, "02" padding with zeros; text takes "lower" or "upper"; hash
+// takes its length; date takes a Go time layout.
+const (
+	TokenYear      = "year"
+	TokenMonth     = "month"
+	TokenDay       = "day"
+	TokenHour      = "hour"
+	TokenWeek      = "week"    // ISO 8601 week number
+	TokenQuarter   = "quarter" // 1 to 4
+	TokenMonthName = "monthname"
+	TokenMonthAbbr = "monthabbr"
+	TokenDate      = "date"   // capture time, 20060102_150405 unless given
+	TokenSubsec    = "subsec" // fraction of the second from EXIF, 0 unless known
+	TokenMake      = "make"
+	TokenModel     = "model"
+	TokenCamera    = "camera" // model, prefixed with the make unless it already is
+	TokenMedia     = "media"  // image or video
+	TokenExt       = "ext"    // lower case and normalised, without the dot
+	TokenName      = "name"   // original file name without the extension
+	TokenFolder    = "folder" // name of the folder the file came from
+	TokenSrcDir    = "srcdir" // folders from the source root to the file
+	TokenEvent     = "event"
+	TokenHash      = "hash" // prefix of the file hash, 2 characters unless given
+	// TokenSeq, in -rename only, counts up from 1 until the name is free.
+	TokenSeq = "seq"
+)
+
+type tokenKind int
+
+const (
+	numberToken tokenKind = iota
+	textToken
+	hashToken
+	dateToken
+)
+
+var layoutTokens = map[string]tokenKind{
+	TokenYear: numberToken, TokenMonth: numberToken, TokenDay: numberToken, TokenHour: numberToken,
+	TokenWeek: numberToken, TokenQuarter: numberToken, TokenSeq: numberToken,
+	TokenMonthName: textToken, TokenMonthAbbr: textToken, TokenSubsec: textToken, TokenMake: textToken,
+	TokenModel: textToken, TokenCamera: textToken, TokenMedia: textToken, TokenExt: textToken,
+	TokenName: textToken, TokenFolder: textToken, TokenSrcDir: textToken, TokenEvent: textToken,
+	TokenHash: hashToken,
+	TokenDate: dateToken,
+}
+
+// defaultDateLayout is what {date} writes without a spec.
+const defaultDateLayout = "20060102_150405"
+
+// normalExtensions maps extensions to the spelling used for them.
+var normalExtensions = map[string]string{
+	"jpeg": "jpg",
+	"jpe":  "jpg",
+	"tiff": "tif",
+	"mpeg": "mpg",
+}
+
+// unknownValue stands in for text the file does not have, such as the camera
+// of a file without EXIF.
+const unknownValue = "unknown"
+
+// LayoutOptions fills in the tokens that do not come from the file.
+type LayoutOptions struct {
+	// Locale names the months, e.g. "de" or "fr_FR.UTF-8". Defaults to
+	// English.
+	Locale string
+	// Event is the value of {event}, such as "Wedding".
+	Event string
+	// Source is the directory {srcdir} is relative to. The copy sets it to
+	// the directory it reads from.
+	Source string
+}
+
+// DirLayout is a parsed -dirformat: the folders a file is placed in under a
+// destination.
+type DirLayout struct {
+	parts   []layoutPart
+	options LayoutOptions
+}
+
+type layoutPart struct {
+	literal string
+	token   string
+	spec    string
+}
+
+// ParseDirFormat parses a -dirformat, which is either one of the names DATE,
+// YEAR-MONTH and NOF or a template such as "{year}/{month:02}-{monthname}".
+// Every token and spec is checked, so that a bad template fails before any
+// file is copied.
+func ParseDirFormat(format string, options LayoutOptions) (*DirLayout, error) {
+	if format == "" {
+		format = namedLayouts["NOF"]
+	} else if named, ok := namedLayouts[format]; ok {
+		format = named
+	} else if !strings.Contains(format, "{") {
+		return nil, fmt.Errorf("unknown directory format %q: use DATE, YEAR-MONTH, NOF, MIRROR or a template of {tokens}", format)
+	}
+	if filepath.IsAbs(format) || strings.HasPrefix(format, "/") {
+		return nil, fmt.Errorf("directory format %q must be relative", format)
+	}
+	for _, elem := range strings.Split(format, "/") {
+		if elem == ".." {
+			return nil, fmt.Errorf("directory format %q must not leave the destination", format)
+		}
+	}
+
+	parts, err := parseTemplate(format, options, false)
+	if err != nil {
+		return nil, fmt.Errorf("directory format %q: %w", format, err)
+	}
+	return &DirLayout{parts: parts, options: options}, nil
+}
+
+// parseTemplate splits a template into literal text and checked tokens.
+// {seq} is only allowed in file names, and {srcdir} only in directories.
+func parseTemplate(format string, options LayoutOptions, forName bool) ([]layoutPart, error) {
+	parts := []layoutPart{}
+	rest := format
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			parts = append(parts, layoutPart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unmatched }")
+		}
+		if open > 0 {
+			parts = append(parts, layoutPart{literal: rest[:open]})
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unclosed {")
+		}
+		token, spec, _ := strings.Cut(rest[open+1:open+1+end], ":")
+		if token == TokenSeq && !forName {
+			return nil, fmt.Errorf("{seq} can only be used in -rename")
+		}
+		if token == TokenSrcDir && forName {
+			return nil, fmt.Errorf("{srcdir} can only be used in -dirformat")
+		}
+		if err := checkToken(token, spec, options); err != nil {
+			return nil, err
+		}
+		parts = append(parts, layoutPart{token: token, spec: spec})
+		rest = rest[open+end+2:]
+	}
+	return parts, nil
+}
+
+func checkToken(token string, spec string, options LayoutOptions) error {
+	kind, ok := layoutTokens[token]
+	if !ok {
+		return fmt.Errorf("unknown token {%s}", token)
+	}
+	if token == TokenEvent && options.Event == "" {
+		return fmt.Errorf("{event} needs an event name")
+	}
+	if spec == "" {
+		return nil
+	}
+	switch kind {
+	case numberToken:
+		if n, err := strconv.Atoi(spec); err != nil || n < 1 || n > 9 {
+			return fmt.Errorf("{%s:%s} needs a width such as 02", token, spec)
+		}
+	case textToken:
+		if spec != "lower" && spec != "upper" {
+			return fmt.Errorf("{%s:%s} takes lower or upper", token, spec)
+		}
+	case hashToken:
+		if n, err := strconv.Atoi(spec); err != nil || n < 1 || n > 32 {
+			return fmt.Errorf("{%s:%s} needs a length from 1 to 32", token, spec)
+		}
+	case dateToken:
+		if strings.ContainsAny(spec, "/\\") {
+			return fmt.Errorf("{%s:%s} must not write a path separator", token, spec)
+		}
+	}
+	return nil
+}
+
+// Path returns the directory image goes to under destdir.
+func (l *DirLayout) Path(destdir string, image FileObject) string {
+	return filepath.Join(destdir, filepath.FromSlash(expandTemplate(l.parts, l.options, image, 0)))
+}
+
+func expandTemplate(parts []layoutPart, options LayoutOptions, image FileObject, seq int) string {
+	var b strings.Builder
+	for _, p := range parts {
+		if p.token == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		b.WriteString(expandToken(p, options, image, seq))
+	}
+	return b.String()
+}
+
+func expandToken(p layoutPart, options LayoutOptions, image FileObject, seq int) string {
+	tm := image.DateTime
+	switch layoutTokens[p.token] {
+	case numberToken:
+		var n int
+		switch p.token {
+		case TokenYear:
+			n = tm.Year()
+		case TokenMonth:
+			n = int(tm.Month())
+		case TokenDay:
+			n = tm.Day()
+		case TokenHour:
+			n = tm.Hour()
+		case TokenWeek:
+			_, n = tm.ISOWeek()
+		case TokenQuarter:
+			n = (int(tm.Month())-1)/3 + 1
+		case TokenSeq:
+			n = seq
+		}
+		if width, _ := strconv.Atoi(p.spec); width > 0 {
+			return fmt.Sprintf("%0*d", width, n)
+		}
+		return strconv.Itoa(n)
+	case hashToken:
+		n := 2
+		if p.spec != "" {
+			n, _ = strconv.Atoi(p.spec)
+		}
+		sum := strings.TrimPrefix(image.Md5Sum, "fast-")
+		if len(sum) > n {
+			sum = sum[:n]
+		}
+		if sum == "" {
+			return unknownValue
+		}
+		return sum
+	case dateToken:
+		layout := p.spec
+		if layout == "" {
+			layout = defaultDateLayout
+		}
+		return tm.Format(layout)
+	}
+
+	var s string
+	switch p.token {
+	case TokenSrcDir:
+		// The only token that adds folders: each is kept as it is.
+		return sourceDir(options.Source, image.Path, p.spec)
+	case TokenMonthName:
+		s = monthNames(options.Locale).long[tm.Month()-1]
+	case TokenMonthAbbr:
+		s = monthNames(options.Locale).short[tm.Month()-1]
+	case TokenSubsec:
+		s = image.SubSec
+		if s == "" {
+			s = "0"
+		}
+	case TokenMake:
+		s = image.Make
+	case TokenModel:
+		s = image.Model
+	case TokenCamera:
+		s = image.Model
+		if image.Make != "" && !strings.HasPrefix(strings.ToLower(s), strings.ToLower(firstWord(image.Make))) {
+			s = strings.TrimSpace(image.Make + " " + s)
+		}
+	case TokenMedia:
+		s = image.MediaType
+	case TokenExt:
+		// An extensionless file stays that way.
+		if s = normalExtension(image.Name); s == "" {
+			return ""
+		}
+	case TokenName:
+		s = strings.TrimSuffix(image.Name, filepath.Ext(image.Name))
+	case TokenFolder:
+		s = filepath.Base(image.Path)
+		if s == "." || s == string(filepath.Separator) {
+			s = ""
+		}
+	case TokenEvent:
+		s = options.Event
+	}
+	switch p.spec {
+	case "lower":
+		s = strings.ToLower(s)
+	case "upper":
+		s = strings.ToUpper(s)
+	}
+	return pathComponent(s)
+}
+
+// sourceDir returns dir relative to source, with slashes, cased as spec
+// says. A file outside source falls back to the name of its folder.
+func sourceDir(source string, dir string, spec string) string {
+	rel := ""
+	if source != "" {
+		absSource, err1 := filepath.Abs(source)
+		absDir, err2 := filepath.Abs(dir)
+		if err1 == nil && err2 == nil {
+			rel, _ = filepath.Rel(absSource, absDir)
+		}
+	}
+	if rel == "" || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(dir)
+	}
+	if rel == "." || rel == string(filepath.Separator) {
+		return ""
+	}
+	switch spec {
+	case "lower":
+		rel = strings.ToLower(rel)
+	case "upper":
+		rel = strings.ToUpper(rel)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// normalExtension returns the extension of name in lower case, without the
+// dot, with variant spellings such as jpeg replaced.
+func normalExtension(name string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if normal, ok := normalExtensions[ext]; ok {
+		return normal
+	}
+	return ext
+}
+
+// NameLayout is a parsed -rename: the name a file is given in its
+// destination folder.
+type NameLayout struct {
+	parts   []layoutPart
+	options LayoutOptions
+	hasSeq  bool
+}
+
+// ParseNameFormat parses a -rename template such as
+// "{date:20060102_150405}_{subsec}_{camera}_{seq}.{ext}". When it has no
+// {ext}, the normalised extension is added.
+func ParseNameFormat(format string, options LayoutOptions) (*NameLayout, error) {
+	if strings.ContainsAny(format, "/\\") {
+		return nil, fmt.Errorf("rename format %q must not contain a path separator", format)
+	}
+	parts, err := parseTemplate(format, options, true)
+	if err != nil {
+		return nil, fmt.Errorf("rename format %q: %w", format, err)
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("rename format is empty")
+	}
+	layout := &NameLayout{parts: parts, options: options}
+	hasExt := false
+	for _, p := range parts {
+		hasExt = hasExt || p.token == TokenExt
+		layout.hasSeq = layout.hasSeq || p.token == TokenSeq
+	}
+	if !hasExt {
+		layout.parts = append(layout.parts, layoutPart{literal: "."}, layoutPart{token: TokenExt})
+	}
+	return layout, nil
+}
+
+// Name returns the name for image with {seq} set to seq.
+func (l *NameLayout) Name(image FileObject, seq int) string {
+	name := expandTemplate(l.parts, l.options, image, seq)
+	// A file without an extension would otherwise end in a dot.
+	return strings.TrimSuffix(name, ".")
+}
+
+// pathComponent keeps a value from adding folders or escaping the
+// destination.
+func pathComponent(s string) string {
+	s = strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(s))
+	if s == "" || s == "." || s == ".." {
+		return unknownValue
+	}
+	return s
+}
+
+func firstWord(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+type monthNameSet struct {
+	long  [12]string
+	short [12]string
+}
+
+// localeMonths are the month names of the locales layouts know, by language.
+var localeMonths = map[string]monthNameSet{
+	"en": {
+		[12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		[12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+	},
+	"de": {
+		[12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		[12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+	},
+	"fr": {
+		[12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		[12]string{"janv", "févr", "mars", "avr", "mai", "juin", "juil", "août", "sept", "oct", "nov", "déc"},
+	},
+	"es": {
+		[12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		[12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+	},
+	"it": {
+		[12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		[12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+	},
+	"nl": {
+		[12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		[12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+	},
+	"pt": {
+		[12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		[12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+	},
+	"sv": {
+		[12]string{"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+		[12]string{"jan", "feb", "mars", "apr", "maj", "juni", "juli", "aug", "sep", "okt", "nov", "dec"},
+	},
+	"pl": {
+		[12]string{"styczeń", "luty", "marzec", "kwiecień", "maj", "czerwiec", "lipiec", "sierpień", "wrzesień", "październik", "listopad", "grudzień"},
+		[12]string{"sty", "lut", "mar", "kwi", "maj", "cze", "lip", "sie", "wrz", "paź", "lis", "gru"},
+	},
+}
+
+// monthNames returns the month names for locale, falling back to English.
+func monthNames(locale string) monthNameSet {
+	if names, ok := localeMonths[localeLanguage(locale)]; ok {
+		return names
+	}
+	return localeMonths["en"]
+}
+
+// localeLanguage reduces a locale such as "de_DE.UTF-8" or "pt-BR" to its
+// language.
+func localeLanguage(locale string) string {
+	lang, _, _ := strings.Cut(locale, ".")
+	lang, _, _ = strings.Cut(lang, "_")
+	lang, _, _ = strings.Cut(lang, "-")
+	return strings.ToLower(lang)
+}
+
+// SystemLocale returns the locale the environment asks for dates to be
+// written in, or "" when it does not say.
+func SystemLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if v := os.Getenv(name); v != "" && v != "C" && v != "POSIX" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package icopy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirLayoutPath(t *testing.T) {
+	destDir := "/tmp/dest"
+	image := FileObject{
+		Name:      "IMG_0001.JPG",
+		Path:      "/media/card/DCIM/100CANON",
+		DateTime:  time.Date(2023, 2, 5, 9, 0, 0, 0, time.UTC),
+		Md5Sum:    "3f2a9c1d5e6b7a8c9d0e1f2a3b4c5d6e",
+		Make:      "Canon",
+		Model:     "Canon EOS R5",
+		MediaType: MediaImage,
+	}
+	options := LayoutOptions{Event: "Ski Trip", Source: "/media/card"}
+
+	tests := []struct {
+		name     string
+		format   string
+		locale   string
+		image    *FileObject
+		expected string
+	}{
+		{name: "DATE", format: "DATE", expected: "2023-02-05"},
+		{name: "YEAR-MONTH", format: "YEAR-MONTH", expected: "2023/02"},
+		{name: "NOF", format: "NOF", expected: ""},
+		{name: "DATE before year 1000", format: "DATE", image: &FileObject{DateTime: time.Date(987, 10, 25, 12, 0, 0, 0, time.UTC)}, expected: "0987-10-25"},
+		{name: "YEAR-MONTH before year 1000", format: "YEAR-MONTH", image: &FileObject{DateTime: time.Date(987, 10, 25, 12, 0, 0, 0, time.UTC)}, expected: "0987/10"},
+		{name: "year", format: "{year}", expected: "2023"},
+		{name: "month", format: "{month}", expected: "2"},
+		{name: "padded month", format: "{month:02}", expected: "02"},
+		{name: "day", format: "{day:02}", expected: "05"},
+		{name: "hour", format: "{hour:02}", expected: "09"},
+		{name: "week", format: "{year}-W{week:02}", expected: "2023-W05"},
+		{name: "quarter", format: "{year}/Q{quarter}", expected: "2023/Q1"},
+		{name: "month name", format: "{year}/{month:02}-{monthname}/{day}", expected: "2023/02-February/5"},
+		{name: "localized month name", format: "{monthname}", locale: "de_DE.UTF-8", expected: "Februar"},
+		{name: "localized month abbreviation", format: "{monthabbr}", locale: "fr", expected: "févr"},
+		{name: "unknown locale", format: "{monthabbr}", locale: "xx", expected: "Feb"},
+		{name: "make", format: "{make}", expected: "Canon"},
+		{name: "model", format: "{model:lower}", expected: "canon eos r5"},
+		{name: "camera without repeated make", format: "{camera}", expected: "Canon EOS R5"},
+		{name: "camera with make", format: "{camera}", image: &FileObject{Make: "NIKON CORPORATION", Model: "Z 6"}, expected: "NIKON CORPORATION Z 6"},
+		{name: "missing camera", format: "{camera}", image: &FileObject{}, expected: "unknown"},
+		{name: "model with slash", format: "{model}", image: &FileObject{Model: "A/B"}, expected: "A_B"},
+		{name: "media type", format: "{media}s", expected: "images"},
+		{name: "extension", format: "{ext}", expected: "jpg"},
+		{name: "source folder", format: "{folder}", expected: "100CANON"},
+		{name: "MIRROR", format: "MIRROR", expected: "DCIM/100CANON"},
+		{name: "year and source folders", format: "{year}/{srcdir:lower}", expected: "2023/dcim/100canon"},
+		{name: "source root", format: "{srcdir}", image: &FileObject{Path: "/media/card"}, expected: ""},
+		{name: "outside source", format: "{srcdir}", image: &FileObject{Path: "/tmp/2019 Wedding"}, expected: "2019 Wedding"},
+		{name: "event", format: "{year}/{event}", expected: "2023/Ski Trip"},
+		{name: "default hash prefix", format: "{hash}", expected: "3f"},
+		{name: "long hash prefix", format: "{hash:4}", image: &FileObject{Md5Sum: "fast-abcdef"}, expected: "abcd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := options
+			opts.Locale = tt.locale
+			layout, err := ParseDirFormat(tt.format, opts)
+			if err != nil {
+				t.Fatalf("ParseDirFormat(%s) returned error: %v", tt.format, err)
+			}
+			img := image
+			if tt.image != nil {
+				img = *tt.image
+			}
+			result := layout.Path(destDir, img)
+			if result != filepath.Join(destDir, tt.expected) {
+				t.Errorf("Path(%s) = %s; want %s", tt.format, result, filepath.Join(destDir, tt.expected))
+			}
+		})
+	}
+}
+
+func TestParseDirFormatErrors(t *testing.T) {
+	tests := []string{
+		"UNKNOWN",
+		"{year",
+		"year}",
+		"{year}/{nope}",
+		"{month:x}",
+		"{make:02}",
+		"{hash:40}",
+		"{event}",
+		"/{year}",
+		"{year}/../x",
+	}
+	for _, format := range tests {
+		if _, err := ParseDirFormat(format, LayoutOptions{}); err == nil {
+			t.Errorf("ParseDirFormat(%s) should have failed", format)
+		}
+	}
+}
+
+func TestNameLayout(t *testing.T) {
+	image := FileObject{
+		Name:     "IMG_0001.JPEG",
+		DateTime: time.Date(2023, 2, 5, 9, 30, 15, 0, time.UTC),
+		SubSec:   "42",
+		Make:     "Canon",
+		Model:    "Canon EOS R5",
+	}
+
+	tests := []struct {
+		name     string
+		format   string
+		image    *FileObject
+		seq      int
+		expected string
+	}{
+		{name: "date", format: "{date}.{ext}", expected: "20230205_093015.jpg"},
+		{name: "date layout", format: "{date:2006-01-02}.{ext}", expected: "2023-02-05.jpg"},
+		{name: "full", format: "{date:20060102_150405}_{subsec}_{camera}_{seq}.{ext}", seq: 3, expected: "20230205_093015_42_Canon EOS R5_3.jpg"},
+		{name: "padded seq", format: "{date}_{seq:04}", seq: 12, expected: "20230205_093015_0012.jpg"},
+		{name: "missing subsec", format: "{date}_{subsec}", image: &FileObject{Name: "a.mov", DateTime: image.DateTime}, expected: "20230205_093015_0.mov"},
+		{name: "extension added", format: "{name}", expected: "IMG_0001.jpg"},
+		{name: "no extension", format: "{date}", image: &FileObject{Name: "README", DateTime: image.DateTime}, expected: "20230205_093015"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := ParseNameFormat(tt.format, LayoutOptions{})
+			if err != nil {
+				t.Fatalf("ParseNameFormat(%s) returned error: %v", tt.format, err)
+			}
+			img := image
+			if tt.image != nil {
+				img = *tt.image
+			}
+			if result := layout.Name(img, tt.seq); result != tt.expected {
+				t.Errorf("Name(%s) = %s; want %s", tt.format, result, tt.expected)
+			}
+		})
+	}
+
+	for _, format := range []string{"", "{year}/{name}", "{nope}", "{srcdir}"} {
+		if _, err := ParseNameFormat(format, LayoutOptions{}); err == nil {
+			t.Errorf("ParseNameFormat(%s) should have failed", format)
+		}
+	}
+	if _, err := ParseDirFormat("{year}/{seq}", LayoutOptions{}); err == nil {
+		t.Errorf("ParseDirFormat should reject {seq}")
+	}
+}
@@ -0,0 +1,155 @@
+package icopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+)
+
+// Modes for FileProcessor.Mode.
+const (
+	ModeCopy     = "copy"
+	ModeHardlink = "hardlink"
+	ModeSymlink  = "symlink"
+	ModeMove     = "move"
+	// ModeReflink is recorded in the catalog for files dedupe replaced with
+	// a copy-on-write clone.
+	ModeReflink = "reflink"
+)
+
+// ErrCrossDevice is returned when a hardlink is requested between two
+// filesystems and FileProcessor.CrossDevice is "refuse".
+var ErrCrossDevice = errors.New("source and destination are on different devices")
+
+// placeFile links the source file at fYMpath according to fp.Mode and returns
+// the mode actually used, which is ModeCopy when a cross-device hardlink fell
+// back to copying.
+func (fp *FileProcessor) placeFile(ctx context.Context, fpath string, fYMpath string, fd *os.File, fis fs.FileInfo) (string, error) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	if err := clearDestination(fYMpath, fis, true); err != nil {
+		return "", err
+	}
+
+	switch fp.Mode {
+	case ModeSymlink:
+		target, err := filepath.Abs(fpath)
+		if err != nil {
+			return "", err
+		}
+		return ModeSymlink, os.Symlink(target, fYMpath)
+	case ModeHardlink:
+		same, err := sameDevice(fpath, filepath.Dir(fYMpath))
+		if err != nil {
+			return "", err
+		}
+		if same {
+			return ModeHardlink, os.Link(fpath, fYMpath)
+		}
+		if fp.CrossDevice == "refuse" {
+			return "", fmt.Errorf("%w: %s", ErrCrossDevice, fYMpath)
+		}
+		logger.Warn().Msgf("%s is on a different device than %s, copying instead of hardlinking", fpath, fYMpath)
+	}
+
+	return ModeCopy, writeFile(fYMpath, fp.Throttle.Reader(ctx, fd), fis)
+}
+
+// placeFiles puts the source at every target according to fp.Mode, reading
+// it only once for copies. Each target records its own outcome.
+func (fp *FileProcessor) placeFiles(ctx context.Context, fpath string, targets []*copyTarget, fd *os.File, fis fs.FileInfo) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	switch fp.Mode {
+	case ModeHardlink, ModeSymlink:
+		for i, t := range targets {
+			if i > 0 {
+				// A previous cross-device fallback may have read the file.
+				if _, err := fd.Seek(0, io.SeekStart); err != nil {
+					t.err = err
+					continue
+				}
+			}
+			t.mode, t.err = fp.placeFile(ctx, fpath, t.path, fd, fis)
+			if t.err == nil && t.mode == ModeCopy {
+				fp.preserveAttrs(ctx, fd, fis, t)
+			}
+		}
+	case ModeMove:
+		if len(targets) == 1 {
+			t := targets[0]
+			same, err := sameDevice(fpath, t.dir)
+			if err != nil {
+				t.err = err
+				return
+			}
+			if same {
+				if t.err = clearDestination(t.path, fis, false); t.err != nil {
+					return
+				}
+				// Windows refuses to rename an open file.
+				fd.Close()
+				t.mode, t.err = ModeMove, os.Rename(fpath, t.path)
+				return
+			}
+		}
+		if err := fp.moveAcrossDevices(ctx, fpath, targets, fd, fis); err != nil {
+			logger.Error().Err(err).Msgf("Copied %s but could not remove it", fpath)
+		}
+	default:
+		fanOutCopy(ctx, fd, targets, fis, fp.Verify, fp.Throttle)
+		for _, t := range targets {
+			if t.err == nil {
+				fp.preserveAttrs(ctx, fd, fis, t)
+			}
+		}
+	}
+}
+
+// moveAcrossDevices copies the source to every target, checks each copy
+// against the bytes that were read, and removes the source only once all of
+// them verified, after giving them the attributes fp.Preserve asks for.
+// Copies that verified are kept even if another target failed.
+func (fp *FileProcessor) moveAcrossDevices(ctx context.Context, fpath string, targets []*copyTarget, fd *os.File, fis fs.FileInfo) error {
+	fanOutCopy(ctx, fd, targets, fis, true, fp.Throttle)
+	for _, t := range targets {
+		if t.err != nil {
+			return nil
+		}
+	}
+	for _, t := range targets {
+		fp.preserveAttrs(ctx, fd, fis, t)
+	}
+
+	fd.Close()
+	if err := os.Remove(fpath); err != nil {
+		return err
+	}
+	for _, t := range targets {
+		t.mode = ModeMove
+	}
+	return nil
+}
+
+// clearDestination removes whatever is at fYMpath when writing through it
+// would be wrong: always for link modes, and for copies when it is a symlink
+// or a hardlink to the source, since truncating it would destroy the original.
+func clearDestination(fYMpath string, fis fs.FileInfo, always bool) error {
+	fi, err := os.Lstat(fYMpath)
+	if err != nil {
+		return nil
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", fYMpath)
+	}
+	if always || fi.Mode()&fs.ModeSymlink != 0 || (fis != nil && os.SameFile(fi, fis)) {
+		return os.Remove(fYMpath)
+	}
+	return nil
+}
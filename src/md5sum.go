@@ -1,6 +1,7 @@
 package icopy
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
@@ -9,6 +10,11 @@ import (
 
 // Md5Sum returns the MD5 checksum of the file at the given path.
 func Md5Sum(filePath string) (string, error) {
+	return md5Sum(context.Background(), filePath, nil)
+}
+
+// md5Sum is Md5Sum with reads drawn from throttle.
+func md5Sum(ctx context.Context, filePath string, throttle *Throttle) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file: %w", err)
@@ -16,7 +22,7 @@ func Md5Sum(filePath string) (string, error) {
 	defer file.Close()
 
 	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, throttle.Reader(ctx, file)); err != nil {
 		return "", fmt.Errorf("failed to copy file content: %w", err)
 	}
 
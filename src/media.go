@@ -0,0 +1,237 @@
+package icopy
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog"
+)
+
+// MediaAll stands for every media type in ParseMediaTypes.
+const MediaAll = "all"
+
+// AllMediaTypes are the media types, in the order summaries list them.
+var AllMediaTypes = []string{MediaImage, MediaVideo, MediaAudio, MediaSidecar}
+
+// imageExtensions, videoExtensions, audioExtensions and sidecarExtensions
+// are the files of each media type, by lower case extension.
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".gif": true, ".png": true, ".bmp": true,
+	".heic": true, ".tiff": true, ".tif": true, ".webp": true, ".svg": true,
+	".psd": true, ".ai": true, ".cr2": true, ".nef": true, ".arw": true,
+	".dng": true, ".orf": true, ".rw2": true, ".raf": true, ".cr3": true,
+}
+
+var videoExtensions = map[string]bool{
+	".mp4": true, ".mov": true, ".wmv": true, ".avi": true, ".mpg": true,
+	".3gp": true, ".m4v": true, ".mkv": true, ".webm": true, ".flv": true,
+	".ts": true, ".mts": true, ".m2ts": true, ".vob": true, ".ogg": true,
+	".qt": true, ".yuv": true, ".rm": true, ".rmvb": true, ".viv": true,
+	".asf": true, ".amv": true, ".svi": true, ".3g2": true, ".mxf": true,
+	".roq": true, ".nsv": true, ".f4v": true, ".f4p": true, ".f4a": true,
+	".f4b": true,
+}
+
+var audioExtensions = map[string]bool{
+	".mp3": true, ".m4a": true, ".aac": true, ".wav": true, ".flac": true,
+	".aif": true, ".aiff": true, ".wma": true, ".opus": true, ".amr": true,
+}
+
+var sidecarExtensions = map[string]bool{
+	".xmp": true, ".thm": true, ".aae": true, ".lrv": true, ".srt": true,
+	".lrf": true, ".pp3": true, ".dop": true,
+}
+
+// MediaTypeOf returns the media type of a file name, or "" when it is none.
+func MediaTypeOf(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case imageExtensions[ext]:
+		return MediaImage
+	case videoExtensions[ext]:
+		return MediaVideo
+	case audioExtensions[ext]:
+		return MediaAudio
+	case sidecarExtensions[ext]:
+		return MediaSidecar
+	}
+	return ""
+}
+
+// ParseMediaTypes reads a comma separated list of media types, such as
+// "image,video", where "all" is every type.
+func ParseMediaTypes(s string) ([]string, error) {
+	types := []string{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "":
+		case t == MediaAll:
+			return slices.Clone(AllMediaTypes), nil
+		case slices.Contains(AllMediaTypes, t):
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		default:
+			return nil, fmt.Errorf("unknown media type %q: use %s or %s", t, strings.Join(AllMediaTypes, ", "), MediaAll)
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no media type in %q", s)
+	}
+	return types, nil
+}
+
+func ReadMedia(ctx context.Context, db *badger.DB, src_dirname string, options ScanOptions) ([]FileObject, []ErroredFileObject) {
+	return collectFiles(ctx, db, src_dirname, options, StreamMedia)
+}
+
+// StreamMedia walks src_dirname once and reads every file of the types in
+// options.MediaTypes, all of them when it is empty, in a single worker pool.
+// Each file is sniffed, so that its content rather than its extension picks
+// the extractors that read it, and files without a media extension are
+// sniffed too. A sidecar next to the media file it belongs to is sent in its
+// Sidecars rather than on its own. It returns once every file has been sent.
+func StreamMedia(ctx context.Context, db *badger.DB, src_dirname string, options ScanOptions, found chan<- FileObject, erroredChan chan<- ErroredFileObject) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+
+	types := options.MediaTypes
+	if len(types) == 0 {
+		types = AllMediaTypes
+	}
+
+	// Worker pool
+	jobs := make(chan mediaJob)
+	var wg sync.WaitGroup
+	batch := NewBatchWriter(db, DefaultBatchSize, DefaultBatchInterval)
+
+	numWorkers := options.workers(ctx, PoolSourceRead, src_dirname)
+	inRange, filtered := options.Filter.byDate(found)
+
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				fpath := job.path
+				if ctx.Err() != nil {
+					continue
+				}
+				if options.ProgressChan != nil {
+					select {
+					case options.ProgressChan <- fmt.Sprintf("Scanning: %s", filepath.Base(fpath)):
+					default:
+					}
+				}
+				options.Throttle.WaitFile(ctx)
+				sniff, err := SniffFile(fpath)
+				if err != nil {
+					logger.Error().Err(err).Msgf("Failed to open file: %s", fpath)
+					erroredChan <- ErroredFileObject{
+						DateTime: time.Now(), Name: filepath.Base(fpath), Path: filepath.Dir(fpath),
+						ErrorMessage: err.Error(),
+					}
+					continue
+				}
+				if !slices.Contains(types, sniff.MediaType) {
+					continue
+				}
+				if sniff.WrongExt {
+					logger.Warn().Msgf("%s is %s, not what its extension says", fpath, strings.ToUpper(sniff.Format))
+				}
+
+				processMediaFile(ctx, batch, fpath, sniff, job.sidecars, inRange, erroredChan, options)
+			}
+		}()
+	}
+
+	// Files are left to the workers to sniff unless their extension is of a
+	// type not asked for or the filter's patterns and sizes leave them out.
+	pairer := &sidecarPairer{
+		types: types,
+		keep:  func(path string) bool { return options.Filter.keepPath(src_dirname, path) },
+		send:  func(job mediaJob) { jobs <- job },
+	}
+	err := walkSource(ctx, src_dirname, options.Recursive, options.FollowLinks, func(path string, d fs.DirEntry) {
+		pairer.add(path)
+	})
+	pairer.close()
+
+	if err != nil {
+		logger.Error().Err(err).Msg("Error walking directory")
+	}
+
+	close(jobs)
+	wg.Wait()
+	filtered()
+
+	if err := batch.Close(); err != nil {
+		logger.Error().Err(err).Msgf("Failed to store hashes for %s", src_dirname)
+	}
+}
+
+// processMediaFile hashes the file at fpath, sniffed as sniff, reads its
+// metadata with the extractors that match it and sends it on, with the
+// sidecars at the paths in sidecars.
+func processMediaFile(ctx context.Context, batch *BatchWriter, fpath string, sniff Sniff, sidecars []string, found chan<- FileObject, erroredChan chan<- ErroredFileObject, options ScanOptions) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	fileName := filepath.Base(fpath)
+
+	md5sum, err := computeFileHash(ctx, fpath, options.UseFastHash, options.Throttle)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to calculate md5sum for file: %s", fpath)
+		return
+	}
+	batch.Put("src-"+md5sum, fpath)
+	essence := options.essenceHash(ctx, fpath, sniff.Format)
+
+	md, err := extractMetadata(ctx, fpath, sniff, options.Throttle)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to read metadata of %s", fpath)
+		erroredChan <- ErroredFileObject{
+			DateTime: time.Now(), Name: fileName, Path: filepath.Dir(fpath),
+			ErrorMessage: err.Error(),
+		}
+		return
+	}
+
+	// Fallback to file modification time if no extractor found a date
+	if md.DateTime.IsZero() {
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to stat file: %s", fpath)
+			return
+		}
+		md.DateTime = fi.ModTime()
+	}
+
+	file := FileObject{
+		DateTime: md.DateTime, Name: fileName, Path: filepath.Dir(fpath), Md5Sum: md5sum, EssenceHash: essence,
+		HasGPS: md.HasGPS, Make: md.Make, Model: md.Model, SubSec: md.SubSec,
+		MediaType: sniff.MediaType, Format: sniff.Format, WrongExt: sniff.WrongExt,
+	}
+	if sniff.MediaType == MediaImage {
+		file.PerceptualHash, file.Width, file.Height = options.perceptualHash(ctx, fpath, sniff.Format)
+	}
+	for _, scpath := range sidecars {
+		sc, err := readSidecar(ctx, batch, scpath, file, options)
+		if err != nil {
+			logger.Error().Err(err).Msgf("Failed to calculate md5sum for file: %s", scpath)
+			erroredChan <- ErroredFileObject{
+				DateTime: time.Now(), Name: filepath.Base(scpath), Path: filepath.Dir(scpath),
+				ErrorMessage: err.Error(),
+			}
+			continue
+		}
+		file.Sidecars = append(file.Sidecars, sc)
+	}
+	found <- file
+}
@@ -0,0 +1,89 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseMediaTypes(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected []string
+	}{
+		{"all", AllMediaTypes},
+		{"image", []string{MediaImage}},
+		{"video, image,video", []string{MediaVideo, MediaImage}},
+		{"sidecar,all", AllMediaTypes},
+	}
+	for _, test := range tests {
+		types, err := ParseMediaTypes(test.in)
+		if err != nil {
+			t.Errorf("ParseMediaTypes(%q) returned error: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(types, test.expected) {
+			t.Errorf("ParseMediaTypes(%q) = %v, expected %v", test.in, types, test.expected)
+		}
+	}
+	for _, in := range []string{"", "photo", "image,raw"} {
+		if _, err := ParseMediaTypes(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
+
+func TestStreamMedia(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	src := t.TempDir()
+	for _, name := range []string{"IMG_0001.JPG", "MVI_0002.AVI", "MVI_0002.THM", "memo.m4a", "notes.txt"} {
+		os.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	read := func(types ...string) map[string]string {
+		files, errored := ReadMedia(ctx, db, src, ScanOptions{MediaTypes: types})
+		if len(errored) > 0 {
+			t.Errorf("Expected no errors, got %v", errored)
+		}
+		found := map[string]string{}
+		for _, f := range files {
+			found[f.Name] = f.MediaType
+			for _, sc := range f.Sidecars {
+				found[f.Name+" "+sc.Name] = sc.MediaType
+			}
+		}
+		return found
+	}
+
+	// The thumbnail goes with the video it belongs to.
+	expected := map[string]string{
+		"IMG_0001.JPG":              MediaImage,
+		"MVI_0002.AVI":              MediaVideo,
+		"MVI_0002.AVI MVI_0002.THM": MediaSidecar,
+		"memo.m4a":                  MediaAudio,
+	}
+	if found := read(); !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+
+	os.WriteFile(filepath.Join(src, "orphan.aae"), []byte("aae"), 0644)
+	found := read(MediaImage, MediaSidecar)
+	names := []string{}
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"IMG_0001.JPG", "orphan.aae"}) {
+		t.Errorf("Expected the image and the sidecar of no file, got %v", names)
+	}
+}
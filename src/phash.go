@@ -0,0 +1,174 @@
+package icopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// maxPerceptualPixels keeps a corrupt or enormous image from making a worker
+// allocate gigabytes to decode it.
+const maxPerceptualPixels = 200 * 1000 * 1000
+
+// ErrNotDecodable is returned for images no pure-Go decoder can read.
+var ErrNotDecodable = errors.New("no decoder for this format")
+
+// PerceptualHash is a 64-bit difference hash (dHash) of an image: the image
+// is shrunk to 9x8 grey pixels and each bit records whether a pixel is
+// brighter than its right-hand neighbour. Resized and recompressed copies of
+// a photo hash within a few bits of each other.
+type PerceptualHash uint64
+
+func (h PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// Distance is the number of bits by which h and other differ.
+func (h PerceptualHash) Distance(other PerceptualHash) int {
+	return bits.OnesCount64(uint64(h) ^ uint64(other))
+}
+
+// ParsePerceptualHash parses the hex form written by String.
+func ParsePerceptualHash(s string) (PerceptualHash, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	return PerceptualHash(v), err
+}
+
+// canDecode reports whether fpath, sniffed as format, is an image
+// ComputePerceptualHash reads. RAW files built on TIFF are left out: the
+// decoder would only find the thumbnail they keep in front.
+func canDecode(fpath string, format string) bool {
+	switch format {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatBMP, FormatWebP:
+		return true
+	case FormatTIFF:
+		ext := strings.ToLower(filepath.Ext(fpath))
+		return ext == ".tif" || ext == ".tiff"
+	}
+	return false
+}
+
+// ComputePerceptualHash decodes the image in filePath and returns its
+// perceptual hash and dimensions.
+func ComputePerceptualHash(filePath string) (PerceptualHash, int, int, error) {
+	return computePerceptualHash(context.Background(), filePath, "", nil)
+}
+
+// computePerceptualHash is ComputePerceptualHash with reads drawn from
+// throttle, for a file already sniffed as format, or not yet when format is
+// "".
+func computePerceptualHash(ctx context.Context, filePath string, format string, throttle *Throttle) (PerceptualHash, int, int, error) {
+	if format != "" && !canDecode(filePath, format) {
+		return 0, 0, 0, ErrNotDecodable
+	}
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer fd.Close()
+	if format == "" && !canDecode(filePath, sniffReader(fd)) {
+		return 0, 0, 0, ErrNotDecodable
+	}
+
+	config, _, err := image.DecodeConfig(fd)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if config.Width*config.Height > maxPerceptualPixels {
+		return 0, 0, 0, fmt.Errorf("%dx%d image is too large to hash", config.Width, config.Height)
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, 0, err
+	}
+	img, _, err := image.Decode(throttle.Reader(ctx, fd))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return dHash(img), config.Width, config.Height, nil
+}
+
+// dHash averages img down to a 9x8 grid of luminance values and compares
+// horizontal neighbours.
+func dHash(img image.Image) PerceptualHash {
+	const w, h = 9, 8
+	var sum [h][w]float64
+	var count [h][w]int
+
+	luma := lumaFunc(img)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		gy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			gx := (x - b.Min.X) * w / b.Dx()
+			sum[gy][gx] += luma(x, y)
+			count[gy][gx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			left, right := cellMean(sum[y][x], count[y][x]), cellMean(sum[y][x+1], count[y][x+1])
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return PerceptualHash(hash)
+}
+
+// lumaFunc reads luminance straight from the planes of the image types the
+// decoders usually return, which is much faster than going through At.
+func lumaFunc(img image.Image) func(x, y int) float64 {
+	switch m := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) float64 { return float64(m.Y[m.YOffset(x, y)]) }
+	case *image.Gray:
+		return func(x, y int) float64 { return float64(m.Pix[m.PixOffset(x, y)]) }
+	}
+	return func(x, y int) float64 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+	}
+}
+
+func cellMean(sum float64, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// perceptualHash returns the perceptual hash and dimensions of fpath, sniffed
+// as format, when the options ask for one, or "" when they don't or it cannot
+// be decoded.
+func (o ScanOptions) perceptualHash(ctx context.Context, fpath string, format string) (string, int, int) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	if !o.UsePerceptualHash {
+		return "", 0, 0
+	}
+	hash, width, height, err := computePerceptualHash(ctx, fpath, format, o.Throttle)
+	if err != nil {
+		if !errors.Is(err, ErrNotDecodable) {
+			logger.Debug().Err(err).Msgf("No perceptual hash for %s", fpath)
+		}
+		return "", 0, 0
+	}
+	return hash.String(), width, height
+}
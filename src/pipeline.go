@@ -0,0 +1,52 @@
+package icopy
+
+import (
+	"context"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// pipelineQueueSize bounds each queue between pipeline stages, so memory use
+// does not grow with the size of the library being imported.
+const pipelineQueueSize = 1024
+
+// MediaStreamer walks srcdir and sends each media file it reads to found, or
+// to errored when it cannot be read. It returns once every file has been sent.
+type MediaStreamer func(ctx context.Context, db *badger.DB, srcdir string, options ScanOptions,
+	found chan<- FileObject, errored chan<- ErroredFileObject)
+
+// collectFiles runs stream to completion and gathers everything it sent.
+func collectFiles(ctx context.Context, db *badger.DB, srcdir string, options ScanOptions, stream MediaStreamer) ([]FileObject, []ErroredFileObject) {
+	files := []FileObject{}
+	erroredFiles := []ErroredFileObject{}
+
+	fileChan := make(chan FileObject)
+	erroredChan := make(chan ErroredFileObject)
+	collectorDone := make(chan struct{})
+	go func() {
+		defer close(collectorDone)
+		for fileChan != nil || erroredChan != nil {
+			select {
+			case f, ok := <-fileChan:
+				if !ok {
+					fileChan = nil
+				} else {
+					files = append(files, f)
+				}
+			case e, ok := <-erroredChan:
+				if !ok {
+					erroredChan = nil
+				} else {
+					erroredFiles = append(erroredFiles, e)
+				}
+			}
+		}
+	}()
+
+	stream(ctx, db, srcdir, options, fileChan, erroredChan)
+	close(fileChan)
+	close(erroredChan)
+	<-collectorDone
+
+	return files, erroredFiles
+}
@@ -0,0 +1,343 @@
+package icopy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Kinds of duplicate group a plan can be made from.
+const (
+	GroupExact      = "exact"      // same file hash
+	GroupEssence    = "essence"    // same essence hash, see ComputeEssenceHash
+	GroupPerceptual = "perceptual" // perceptual hashes within a threshold
+)
+
+// Keep rules, in the order a KeepPolicy applies them.
+const (
+	KeepHighestResolution = "highest-resolution"
+	KeepLargest           = "largest"
+	KeepEarliest          = "earliest"
+	KeepGPS               = "gps"
+	KeepOriginal          = "original"
+	KeepPreferDir         = "prefer-dir" // written prefer-dir=<path>
+)
+
+// DefaultKeepPolicy keeps the best quality copy, and among equals the one that
+// does not look like an edit.
+const DefaultKeepPolicy = "highest-resolution,largest,original,earliest"
+
+// editedName matches file names that mark a derived copy: "-edited",
+// "_edit", " copy", "(1)".
+var editedName = regexp.MustCompile(`(?i)([-_ ](edited|edit|copy)|\s*\(\d+\))$`)
+
+// KeepPolicy is an ordered list of rules for choosing the copy to keep from a
+// duplicate group. The first rule that tells two copies apart decides; the
+// path breaks remaining ties.
+type KeepPolicy []keepRule
+
+type keepRule struct {
+	name string
+	dir  string
+}
+
+// ParseKeepPolicy parses a comma-separated list of rules, for example
+// "gps,prefer-dir=/library/best,highest-resolution".
+func ParseKeepPolicy(s string) (KeepPolicy, error) {
+	policy := KeepPolicy{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		name, dir, _ := strings.Cut(field, "=")
+		switch name {
+		case KeepHighestResolution, KeepLargest, KeepEarliest, KeepGPS, KeepOriginal:
+			policy = append(policy, keepRule{name: name})
+		case KeepPreferDir:
+			abs, err := filepath.Abs(dir)
+			if dir == "" || err != nil {
+				return nil, fmt.Errorf("%s needs a directory, as %s=<path>", KeepPreferDir, KeepPreferDir)
+			}
+			policy = append(policy, keepRule{name: name, dir: abs})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown keep rule %q", name)
+		}
+	}
+	return policy, nil
+}
+
+func (p KeepPolicy) String() string {
+	names := []string{}
+	for _, r := range p {
+		if r.dir != "" {
+			names = append(names, r.name+"="+r.dir)
+		} else {
+			names = append(names, r.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// candidate is a member of a duplicate group with what the rules look at.
+type candidate struct {
+	entry  CatalogEntry
+	path   string
+	size   int64
+	pixels int
+	gps    bool
+}
+
+// compare returns a negative number when a is the better copy, a positive one
+// when b is, and the rule that decided.
+func (p KeepPolicy) compare(a, b candidate) (int, string) {
+	for _, r := range p {
+		c := 0
+		switch r.name {
+		case KeepHighestResolution:
+			c = b.pixels - a.pixels
+		case KeepLargest:
+			c = compareInt64(b.size, a.size)
+		case KeepEarliest:
+			c = a.entry.DateTime.Compare(b.entry.DateTime)
+		case KeepGPS:
+			c = compareBool(b.gps, a.gps)
+		case KeepOriginal:
+			c = compareBool(!isEditedName(b.path), !isEditedName(a.path))
+		case KeepPreferDir:
+			c = compareBool(isWithin(r.dir, b.path), isWithin(r.dir, a.path))
+		}
+		if c != 0 {
+			return c, r.name
+		}
+	}
+	return strings.Compare(a.path, b.path), "path"
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareBool orders false before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+func isEditedName(path string) bool {
+	name := filepath.Base(path)
+	return editedName.MatchString(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// Plan is the outcome of applying a KeepPolicy to the duplicate groups of a
+// library: for each group, the copy to keep and the ones to discard. It is
+// written as JSON so that other commands, or people, can review and apply it.
+type Plan struct {
+	Root    string      `json:"root"`
+	Kind    string      `json:"kind"`
+	Policy  string      `json:"policy"`
+	Created time.Time   `json:"created"`
+	Groups  []PlanGroup `json:"groups"`
+}
+
+// PlanGroup is one duplicate group. Paths are absolute.
+type PlanGroup struct {
+	Keep    string   `json:"keep"`
+	Discard []string `json:"discard"`
+	// Reason is the rule that picked Keep over the runner-up.
+	Reason string `json:"reason"`
+}
+
+// PlanOptions controls MakePlan.
+type PlanOptions struct {
+	Kind   string
+	Policy KeepPolicy
+	// Threshold is the Hamming distance for GroupPerceptual.
+	Threshold    int
+	NumWorkers   int
+	ProgressChan chan<- string
+	Throttle     *Throttle
+	Sizer        *WorkerSizer
+}
+
+// MakePlan finds the duplicate groups of the given kind among the files in
+// the catalog of destdir and picks the copy to keep in each. Files that no
+// longer exist are left out.
+func MakePlan(ctx context.Context, destdir string, options PlanOptions) (Plan, error) {
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return Plan{}, err
+	}
+	defer catalog.Close()
+	return catalog.makePlan(ctx, options)
+}
+
+func (c *Catalog) makePlan(ctx context.Context, options PlanOptions) (Plan, error) {
+	plan := Plan{Root: c.root, Kind: options.Kind, Policy: options.Policy.String(), Created: time.Now(), Groups: []PlanGroup{}}
+
+	groups, err := c.duplicateGroups(ctx, options)
+	if err != nil {
+		return plan, err
+	}
+	for _, group := range groups {
+		candidates := []candidate{}
+		for _, entry := range group {
+			if cand, ok := c.candidate(entry); ok {
+				candidates = append(candidates, cand)
+			}
+		}
+		if len(candidates) < 2 {
+			continue
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			cmp, _ := options.Policy.compare(candidates[i], candidates[j])
+			return cmp < 0
+		})
+		_, reason := options.Policy.compare(candidates[0], candidates[1])
+		pg := PlanGroup{Keep: candidates[0].path, Reason: reason}
+		for _, cand := range candidates[1:] {
+			pg.Discard = append(pg.Discard, cand.path)
+		}
+		plan.Groups = append(plan.Groups, pg)
+	}
+	sort.Slice(plan.Groups, func(i, j int) bool { return plan.Groups[i].Keep < plan.Groups[j].Keep })
+	return plan, nil
+}
+
+// duplicateGroups returns the groups of catalog entries that share a file
+// hash, an essence hash or, within options.Threshold, a perceptual hash.
+func (c *Catalog) duplicateGroups(ctx context.Context, options PlanOptions) ([][]CatalogEntry, error) {
+	switch options.Kind {
+	case GroupExact:
+		return c.groupBy(func(e CatalogEntry) string { return e.Md5Sum })
+	case GroupEssence:
+		return c.groupBy(func(e CatalogEntry) string { return e.EssenceHash })
+	case GroupPerceptual:
+		entries, err := c.perceptualEntries(ctx, SimilarOptions{
+			Threshold: options.Threshold, NumWorkers: options.NumWorkers,
+			ProgressChan: options.ProgressChan, Throttle: options.Throttle, Sizer: options.Sizer,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return clusterSimilar(entries, options.Threshold), nil
+	}
+	return nil, fmt.Errorf("unknown duplicate group kind %q", options.Kind)
+}
+
+// groupBy returns the entries that share a non-empty key with another entry.
+// The catalog is read twice so that only entries in groups are held in
+// memory.
+func (c *Catalog) groupBy(key func(CatalogEntry) string) ([][]CatalogEntry, error) {
+	counts := map[string]int{}
+	if err := c.eachEntry(func(e CatalogEntry) {
+		if k := key(e); k != "" {
+			counts[k]++
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	byKey := map[string][]CatalogEntry{}
+	if err := c.eachEntry(func(e CatalogEntry) {
+		if k := key(e); counts[k] > 1 {
+			byKey[k] = append(byKey[k], e)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	groups := [][]CatalogEntry{}
+	for _, group := range byKey {
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// eachEntry calls fn with every catalog entry, a page at a time.
+func (c *Catalog) eachEntry(fn func(CatalogEntry)) error {
+	after := ""
+	for {
+		entries, err := c.entriesAfter(after, catalogPageSize)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		for _, e := range entries {
+			fn(e)
+		}
+		after = entries[len(entries)-1].Path
+	}
+}
+
+// candidate gathers what the keep rules need about entry, filling in what the
+// catalog did not record. It reports false when the file is gone.
+func (c *Catalog) candidate(entry CatalogEntry) (candidate, bool) {
+	cand := candidate{entry: entry, path: c.AbsPath(entry.Path), pixels: entry.Width * entry.Height, gps: entry.HasGPS}
+	fi, err := os.Stat(cand.path)
+	if err != nil {
+		return cand, false
+	}
+	cand.size = fi.Size()
+
+	fd, err := os.Open(cand.path)
+	if err != nil {
+		return cand, true
+	}
+	defer fd.Close()
+	format := sniffReader(fd)
+	if cand.pixels == 0 && canDecode(cand.path, format) {
+		if config, _, err := image.DecodeConfig(fd); err == nil {
+			cand.pixels = config.Width * config.Height
+		}
+		fd.Seek(0, 0)
+	}
+	if !cand.gps && exifFormats[format] {
+		if x, err := exif.Decode(fd); err == nil {
+			_, _, err := x.LatLong()
+			cand.gps = err == nil
+		}
+	}
+	return cand, true
+}
+
+// exifFormats are the formats goexif reads GPS tags from.
+var exifFormats = map[string]bool{
+	FormatJPEG: true, FormatTIFF: true, FormatCR2: true, FormatORF: true, FormatRW2: true,
+}
+
+// WritePlan saves plan as indented JSON.
+func WritePlan(path string, plan Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ReadPlan loads a plan saved by WritePlan.
+func ReadPlan(path string) (Plan, error) {
+	plan := Plan{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	err = json.Unmarshal(data, &plan)
+	return plan, err
+}
@@ -0,0 +1,103 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseKeepPolicy(t *testing.T) {
+	policy, err := ParseKeepPolicy("gps, prefer-dir=/library/best,largest")
+	if err != nil {
+		t.Fatalf("ParseKeepPolicy returned error: %v", err)
+	}
+	if got := policy.String(); got != "gps,prefer-dir=/library/best,largest" {
+		t.Errorf("Expected policy to round-trip, got %q", got)
+	}
+	for _, bad := range []string{"biggest", "prefer-dir", "prefer-dir="} {
+		if _, err := ParseKeepPolicy(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestMakePlan(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "best"), 0755)
+
+	day := time.Date(2023, 10, 25, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		name    string
+		content string
+		date    time.Time
+	}{
+		{"a.jpg", "same", day},
+		{"a-edited.jpg", "same", day.Add(-time.Hour)},
+		{"best/a copy.jpg", "same", day},
+		{"b.jpg", "bigger", day},
+		{"b_edited.jpg", "big", day},
+		{"c.jpg", "unique", day},
+	}
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		os.WriteFile(path, []byte(f.content), 0644)
+		// The b files stand in for an essence group with different sizes.
+		catalog.Put(CatalogEntry{Path: path, Md5Sum: f.content, EssenceHash: f.content[:3], DateTime: f.date})
+	}
+	catalog.Close()
+
+	tests := []struct {
+		name   string
+		kind   string
+		policy string
+		keep   []string
+		reason string
+	}{
+		{"original", GroupExact, "original", []string{"a.jpg"}, KeepOriginal},
+		{"earliest", GroupExact, "earliest", []string{"a-edited.jpg"}, KeepEarliest},
+		{"preferred dir", GroupExact, "prefer-dir=" + filepath.Join(dir, "best"), []string{"best/a copy.jpg"}, KeepPreferDir},
+		{"largest", GroupEssence, "largest", []string{"a-edited.jpg", "b.jpg"}, KeepLargest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, _ := ParseKeepPolicy(tt.policy)
+			plan, err := MakePlan(ctx, dir, PlanOptions{Kind: tt.kind, Policy: policy})
+			if err != nil {
+				t.Fatalf("MakePlan returned error: %v", err)
+			}
+			if len(plan.Groups) != len(tt.keep) {
+				t.Fatalf("Expected %d groups, got %+v", len(tt.keep), plan.Groups)
+			}
+			for i, keep := range tt.keep {
+				if got := plan.Groups[i].Keep; got != filepath.Join(dir, keep) {
+					t.Errorf("Expected to keep %s, got %s", keep, got)
+				}
+			}
+			if got := plan.Groups[len(tt.keep)-1].Reason; got != tt.reason {
+				t.Errorf("Expected reason %s, got %s", tt.reason, got)
+			}
+		})
+	}
+
+	plan, _ := MakePlan(ctx, dir, PlanOptions{Kind: GroupExact, Policy: KeepPolicy{}})
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := WritePlan(path, plan); err != nil {
+		t.Fatalf("WritePlan returned error: %v", err)
+	}
+	read, err := ReadPlan(path)
+	if err != nil {
+		t.Fatalf("ReadPlan returned error: %v", err)
+	}
+	if len(read.Groups) != 1 || len(read.Groups[0].Discard) != 2 {
+		t.Errorf("Expected the plan to round-trip, got %+v", read)
+	}
+}
@@ -0,0 +1,103 @@
+package icopy
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Attributes FileProcessor.Preserve can keep, as -preserve names them.
+const (
+	PreserveMode  = "mode"
+	PreserveOwner = "owner"
+	PreserveTimes = "times"
+	PreserveXattr = "xattr"
+	PreserveACL   = "acl"
+)
+
+// Preserve is the set of source file attributes copies keep. Copies always
+// keep the modification time; Times adds the access time.
+type Preserve struct {
+	Mode  bool // permission bits, with setuid, setgid and sticky
+	Owner bool // user and group, which normally takes root
+	Times bool
+	Xattr bool // extended attributes other than ACLs
+	ACL   bool // POSIX access and default ACLs
+}
+
+// ParsePreserve reads a comma separated list of attributes, such as
+// "mode,times".
+func ParsePreserve(s string) (Preserve, error) {
+	p := Preserve{}
+	for _, attr := range strings.Split(s, ",") {
+		switch strings.TrimSpace(attr) {
+		case "":
+		case PreserveMode:
+			p.Mode = true
+		case PreserveOwner:
+			p.Owner = true
+		case PreserveTimes:
+			p.Times = true
+		case PreserveXattr:
+			p.Xattr = true
+		case PreserveACL:
+			p.ACL = true
+		default:
+			return p, fmt.Errorf("unknown attribute %q: use %s, %s, %s, %s or %s", attr, PreserveMode, PreserveOwner, PreserveTimes, PreserveXattr, PreserveACL)
+		}
+	}
+	return p, nil
+}
+
+// apply copies the attributes p asks for from src, whose FileInfo is fis, to
+// dst, and returns those it could not copy with the reason. The owner goes
+// first because changing it clears setuid bits, and the times last because
+// setting the others may touch them.
+func (p Preserve) apply(src *os.File, fis fs.FileInfo, dst string) map[string]error {
+	failed := map[string]error{}
+	if p.Owner {
+		if err := preserveOwner(fis, dst); err != nil {
+			failed[PreserveOwner] = err
+		}
+	}
+	if p.Mode {
+		mode := fis.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(dst, mode); err != nil {
+			failed[PreserveMode] = err
+		}
+	}
+	if p.Xattr {
+		if err := copyXattrs(src, dst, false); err != nil {
+			failed[PreserveXattr] = err
+		}
+	}
+	if p.ACL {
+		if err := copyXattrs(src, dst, true); err != nil {
+			failed[PreserveACL] = err
+		}
+	}
+	if p.Times {
+		if err := os.Chtimes(dst, accessTime(fis), fis.ModTime()); err != nil {
+			failed[PreserveTimes] = err
+		}
+	}
+	return failed
+}
+
+// preserveAttrs applies fp.Preserve to a target the source was copied to. An
+// attribute the destination cannot store is warned about once per
+// destination, and the copy is kept.
+func (fp *FileProcessor) preserveAttrs(ctx context.Context, src *os.File, fis fs.FileInfo, t *copyTarget) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	for attr, err := range fp.Preserve.apply(src, fis, t.path) {
+		if _, warned := fp.preserveWarned.LoadOrStore(t.dest.Dir+"\x00"+attr, true); warned {
+			logger.Debug().Err(err).Msgf("Could not preserve %s of %s", attr, t.path)
+			continue
+		}
+		logger.Warn().Err(err).Msgf("Could not preserve %s in %s, starting with %s", attr, t.dest.Dir, t.path)
+	}
+}
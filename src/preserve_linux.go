@@ -0,0 +1,85 @@
+package icopy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// POSIX ACLs are kept in these extended attributes.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+func preserveOwner(fis fs.FileInfo, dst string) error {
+	st, ok := fis.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return os.Lchown(dst, int(st.Uid), int(st.Gid))
+}
+
+// accessTime returns when the source was last read before this copy.
+func accessTime(fis fs.FileInfo) time.Time {
+	if st, ok := fis.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fis.ModTime()
+}
+
+// copyXattrs copies the POSIX ACLs of src to dst when acl is set, and every
+// other extended attribute when it is not. A source on a filesystem without
+// extended attributes has none to copy. It goes on past an attribute dst
+// refuses and returns the first refusal.
+func copyXattrs(src *os.File, dst string, acl bool) error {
+	names, err := listXattrs(src)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, name := range names {
+		if (name == aclAccessXattr || name == aclDefaultXattr) != acl {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err == nil {
+			err = unix.Lsetxattr(dst, name, value, 0)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func listXattrs(f *os.File) ([]string, error) {
+	size, err := unix.Flistxattr(int(f.Fd()), nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Flistxattr(int(f.Fd()), buf)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00"), nil
+}
+
+func getXattr(f *os.File, name string) ([]byte, error) {
+	size, err := unix.Fgetxattr(int(f.Fd()), name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Fgetxattr(int(f.Fd()), name, buf)
+	return buf[:size], err
+}
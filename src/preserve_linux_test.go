@@ -0,0 +1,79 @@
+package icopy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// The xattr and ACL tests need a filesystem with user extended attributes,
+// such as ext4, or tmpfs on Linux 6.6 and later, and are skipped elsewhere.
+
+func TestPreserveXattrs(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.jpg")
+	dstPath := filepath.Join(dir, "dst.jpg")
+	os.WriteFile(srcPath, []byte("photo"), 0644)
+	os.WriteFile(dstPath, []byte("photo"), 0644)
+	if err := unix.Setxattr(srcPath, "user.xdg.tags", []byte("holiday"), 0); err != nil {
+		t.Skipf("extended attributes not supported in %s: %v", dir, err)
+	}
+
+	src, _ := os.Open(srcPath)
+	defer src.Close()
+	fis, _ := os.Stat(srcPath)
+
+	// ACLs alone leave user attributes behind.
+	if failed := (Preserve{ACL: true}).apply(src, fis, dstPath); len(failed) != 0 {
+		t.Fatalf("apply failed: %v", failed)
+	}
+	if _, err := unix.Getxattr(dstPath, "user.xdg.tags", nil); err == nil {
+		t.Error("Expected only ACLs to be copied")
+	}
+
+	if failed := (Preserve{Xattr: true}).apply(src, fis, dstPath); len(failed) != 0 {
+		t.Fatalf("apply failed: %v", failed)
+	}
+	buf := make([]byte, 64)
+	n, err := unix.Getxattr(dstPath, "user.xdg.tags", buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte("holiday")) {
+		t.Errorf("Expected user.xdg.tags to be copied, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestPreserveOwner(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.jpg")
+	dstPath := filepath.Join(dir, "dst.jpg")
+	os.WriteFile(srcPath, []byte("photo"), 0644)
+	os.WriteFile(dstPath, []byte("photo"), 0644)
+	if os.Geteuid() != 0 {
+		// Without root only one's own ownership can be kept.
+		fis, _ := os.Stat(srcPath)
+		src, _ := os.Open(srcPath)
+		defer src.Close()
+		if failed := (Preserve{Owner: true}).apply(src, fis, dstPath); len(failed) != 0 {
+			t.Errorf("Expected keeping one's own files to work, got %v", failed)
+		}
+		return
+	}
+
+	if err := os.Chown(srcPath, 1234, 5678); err != nil {
+		t.Skipf("cannot change owner in %s: %v", dir, err)
+	}
+	src, _ := os.Open(srcPath)
+	defer src.Close()
+	fis, _ := os.Stat(srcPath)
+	if failed := (Preserve{Owner: true}).apply(src, fis, dstPath); len(failed) != 0 {
+		t.Fatalf("apply failed: %v", failed)
+	}
+	fi, _ := os.Stat(dstPath)
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != 1234 || st.Gid != 5678 {
+		t.Errorf("Expected owner 1234:5678, got %d:%d", st.Uid, st.Gid)
+	}
+}
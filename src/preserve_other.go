@@ -0,0 +1,24 @@
+//go:build !linux
+
+package icopy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Ownership, extended attributes and ACLs are only preserved on Linux.
+
+func preserveOwner(fis fs.FileInfo, dst string) error {
+	return errors.ErrUnsupported
+}
+
+func accessTime(fis fs.FileInfo) time.Time {
+	return fis.ModTime()
+}
+
+func copyXattrs(src *os.File, dst string, acl bool) error {
+	return errors.ErrUnsupported
+}
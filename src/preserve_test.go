@@ -0,0 +1,58 @@
+package icopy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParsePreserve(t *testing.T) {
+	p, err := ParsePreserve("mode, times,acl")
+	if err != nil {
+		t.Fatalf("ParsePreserve returned error: %v", err)
+	}
+	if p != (Preserve{Mode: true, Times: true, ACL: true}) {
+		t.Errorf("ParsePreserve = %+v", p)
+	}
+	if p, err := ParsePreserve(""); err != nil || p != (Preserve{}) {
+		t.Errorf("Expected nothing preserved by default, got %+v, %v", p, err)
+	}
+	if _, err := ParsePreserve("mode,birth"); err == nil {
+		t.Error("Expected an unknown attribute to fail")
+	}
+}
+
+func TestPreserveModeAndTimes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not kept on Windows")
+	}
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.jpg")
+	dstPath := filepath.Join(dir, "dst.jpg")
+	os.WriteFile(srcPath, []byte("photo"), 0600)
+	os.WriteFile(dstPath, []byte("photo"), 0644)
+	os.Chmod(srcPath, 0750)
+	atime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(srcPath, atime, mtime)
+
+	src, _ := os.Open(srcPath)
+	defer src.Close()
+	fis, _ := os.Stat(srcPath)
+	if failed := (Preserve{Mode: true, Times: true}).apply(src, fis, dstPath); len(failed) != 0 {
+		t.Fatalf("apply failed: %v", failed)
+	}
+
+	fi, _ := os.Stat(dstPath)
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("Expected mode 0750, got %v", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected modification time %v, got %v", mtime, fi.ModTime())
+	}
+	if runtime.GOOS == "linux" && !accessTime(fi).Equal(atime) {
+		t.Errorf("Expected access time %v, got %v", atime, accessTime(fi))
+	}
+}
@@ -0,0 +1,13 @@
+package icopy
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes dst share src's extents with the FICLONE ioctl, which btrfs,
+// XFS and bcachefs support. dst must already exist and be empty.
+func reflink(src *os.File, dst *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package icopy
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(src *os.File, dst *os.File) error {
+	return errors.New("reflinks are only supported on Linux")
+}
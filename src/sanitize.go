@@ -0,0 +1,215 @@
+package icopy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Policies for Destination.Sanitize: which names are valid in a destination.
+const (
+	// SanitizeAuto uses the Windows rules on Windows and on FAT, exFAT and
+	// NTFS filesystems, and the POSIX rules elsewhere.
+	SanitizeAuto = "auto"
+	// SanitizePosix only normalises names to NFC and keeps them within the
+	// length limits.
+	SanitizePosix = "posix"
+	// SanitizeWindows also replaces the characters exFAT and NTFS do not
+	// allow, avoids the reserved device names and trims trailing dots and
+	// spaces, and treats names differing only in case as the same, so that the
+	// library can later be moved to such a filesystem. It also keeps paths in
+	// the library within MAX_PATH, for Windows programs that still apply it.
+	SanitizeWindows = "windows"
+)
+
+// Length limits: a name component is at most 255 bytes on POSIX filesystems
+// and 255 UTF-16 code units on exFAT and NTFS, and a whole path at most 4095
+// bytes on Linux. MAX_PATH, 259 characters, is a limit of the Win32 API
+// rather than of any filesystem; it is applied to paths relative to the
+// library, so that they fit wherever the library is later put.
+const (
+	maxComponentLen   = 255
+	maxPosixPathLen   = 4095
+	maxWindowsPathLen = 259
+)
+
+// windowsInvalidChars may not appear in exFAT and NTFS names, and are
+// replaced with an underscore. Control characters are replaced too.
+const windowsInvalidChars = `<>:"/\|?*`
+
+// windowsReservedNames are device names Windows will not create a file as,
+// whatever the extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Sanitizer makes the names a copy creates valid in one destination.
+type Sanitizer struct {
+	windows bool
+	// maxPath keeps paths relative to the library within MAX_PATH.
+	maxPath bool
+	// caseInsensitive is set when names differing only in case are the
+	// same file in the destination, and matchCase when the filesystem does
+	// not see to that itself.
+	caseInsensitive bool
+	matchCase       bool
+}
+
+// NewSanitizer returns the Sanitizer policy calls for in dir, which must
+// exist for SanitizeAuto to look at its filesystem.
+func NewSanitizer(policy string, dir string) (*Sanitizer, error) {
+	s := &Sanitizer{}
+	folds := caseInsensitive(dir)
+	switch policy {
+	case "", SanitizeAuto:
+		s.windows = windowsFilesystem(dir)
+	case SanitizePosix:
+	case SanitizeWindows:
+		s.windows, s.maxPath = true, true
+	default:
+		return nil, fmt.Errorf("unknown sanitize policy %q: use %s, %s or %s", policy, SanitizeAuto, SanitizePosix, SanitizeWindows)
+	}
+	s.caseInsensitive = s.windows || folds
+	s.matchCase = s.caseInsensitive && !folds
+	return s, nil
+}
+
+// caseInsensitive reports whether dir's filesystem finds a file by a name
+// that differs from it only in case. It creates and removes a file to find
+// out, and assumes not when it cannot.
+func caseInsensitive(dir string) bool {
+	f, err := os.CreateTemp(dir, ".icopy-case-")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(f.Name()))))
+	return err == nil
+}
+
+// Join returns name in the folders rel under root, each component made
+// valid. root is left as it is. The file name is shortened, keeping its
+// extension, to keep the path within the limit: the whole path within
+// Linux's, and with SanitizeWindows, the part under root within MAX_PATH. An
+// error is returned when even that is not enough.
+func (s *Sanitizer) Join(root string, rel string, name string) (string, error) {
+	parts := []string{}
+	for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		parts = append(parts, s.Component(elem))
+	}
+	dir := filepath.Join(append([]string{root}, parts...)...)
+	name = s.Component(name)
+
+	fpath := filepath.Join(dir, name)
+	over := s.length(fpath) - maxPosixPathLen
+	if s.maxPath {
+		relPath := filepath.Join(append(parts, name)...)
+		over = max(over, s.length(relPath)-maxWindowsPathLen)
+	}
+	if over > 0 {
+		ext := filepath.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		if over >= s.length(stem) {
+			return "", fmt.Errorf("path is too long: %s", fpath)
+		}
+		fpath = filepath.Join(dir, s.truncate(stem, s.length(stem)-over)+ext)
+	}
+	return fpath, nil
+}
+
+// Component returns name valid as a single file or folder name.
+func (s *Sanitizer) Component(name string) string {
+	name = norm.NFC.String(name)
+	if s.windows {
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || strings.ContainsRune(windowsInvalidChars, r) {
+				return '_'
+			}
+			return r
+		}, name)
+		name = strings.TrimRight(name, ". ")
+		// CON.tar.gz is as reserved as CON.
+		base, _, _ := strings.Cut(name, ".")
+		if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+			name = base + "_" + name[len(base):]
+		}
+	} else {
+		name = strings.ReplaceAll(name, "\x00", "_")
+	}
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	if s.length(name) > maxComponentLen {
+		ext := filepath.Ext(name)
+		if s.length(ext) >= maxComponentLen/2 {
+			ext = ""
+		}
+		stem := strings.TrimSuffix(name, ext)
+		name = s.truncate(stem, maxComponentLen-s.length(ext)) + ext
+	}
+	return name
+}
+
+// Key returns what a path is known by in the destination: the path itself,
+// or its lower case when the destination does not tell case apart.
+func (s *Sanitizer) Key(fpath string) string {
+	if s != nil && s.caseInsensitive {
+		return strings.ToLower(fpath)
+	}
+	return fpath
+}
+
+// Existing returns the file already in the destination that fpath would
+// collide with: fpath itself, or, where the Windows rules are kept on a
+// filesystem that tells case apart, a file whose name differs only in case.
+func (s *Sanitizer) Existing(fpath string) string {
+	if s == nil || !s.matchCase {
+		return fpath
+	}
+	if _, err := os.Lstat(fpath); err == nil {
+		return fpath
+	}
+	entries, err := os.ReadDir(filepath.Dir(fpath))
+	if err != nil {
+		return fpath
+	}
+	name := filepath.Base(fpath)
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			return filepath.Join(filepath.Dir(fpath), e.Name())
+		}
+	}
+	return fpath
+}
+
+// length measures s the way the destination's limits do.
+func (s *Sanitizer) length(str string) int {
+	if s.windows {
+		return len(utf16.Encode([]rune(str)))
+	}
+	return len(str)
+}
+
+// truncate cuts str to at most n units of length without splitting a
+// character.
+func (s *Sanitizer) truncate(str string, n int) string {
+	for s.length(str) > n {
+		_, size := utf8.DecodeLastRuneInString(str)
+		str = str[:len(str)-size]
+	}
+	return strings.TrimRight(str, ". ")
+}
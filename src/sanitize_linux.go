@@ -0,0 +1,25 @@
+package icopy
+
+import "golang.org/x/sys/unix"
+
+// Magic numbers of the kernel's ntfs and ntfs3 drivers, which x/sys does not
+// name.
+const (
+	ntfsSuperMagic  = 0x5346544e
+	ntfs3SuperMagic = 0x7366746e
+)
+
+// windowsFilesystem reports whether dir is on FAT, exFAT or NTFS, which
+// restrict names as Windows does. Filesystems mounted through FUSE, such as
+// ntfs-3g, are not recognised.
+func windowsFilesystem(dir string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return false
+	}
+	switch uint32(st.Type) {
+	case unix.MSDOS_SUPER_MAGIC, unix.EXFAT_SUPER_MAGIC, ntfsSuperMagic, ntfs3SuperMagic:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package icopy
+
+import "runtime"
+
+// windowsFilesystem reports whether names in dir are restricted as on
+// Windows. Elsewhere than Linux the filesystem is not looked at, so a FAT or
+// exFAT card needs SanitizeWindows.
+func windowsFilesystem(dir string) bool {
+	return runtime.GOOS == "windows"
+}
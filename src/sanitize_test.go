@@ -0,0 +1,102 @@
+package icopy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizerComponent(t *testing.T) {
+	posix := &Sanitizer{}
+	windows := &Sanitizer{windows: true, caseInsensitive: true}
+
+	tests := []struct {
+		name      string
+		sanitizer *Sanitizer
+		in        string
+		expected  string
+	}{
+		{name: "NFD to NFC", sanitizer: posix, in: "Cafe\u0301.jpg", expected: "Caf\u00e9.jpg"},
+		{name: "posix keeps colons", sanitizer: posix, in: "12:30.jpg", expected: "12:30.jpg"},
+		{name: "invalid characters", sanitizer: windows, in: `a<b>c:d"e|f?g*h.jpg`, expected: "a_b_c_d_e_f_g_h.jpg"},
+		{name: "control characters", sanitizer: windows, in: "a\tb.jpg", expected: "a_b.jpg"},
+		{name: "trailing dots and spaces", sanitizer: windows, in: "2019 Wedding. .", expected: "2019 Wedding"},
+		{name: "reserved name", sanitizer: windows, in: "CON", expected: "CON_"},
+		{name: "reserved name with extension", sanitizer: windows, in: "aux.tar.gz", expected: "aux_.tar.gz"},
+		{name: "reserved prefix is fine", sanitizer: windows, in: "CONCERT.jpg", expected: "CONCERT.jpg"},
+		{name: "nothing left", sanitizer: windows, in: "...", expected: "_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.sanitizer.Component(tt.in); result != tt.expected {
+				t.Errorf("Component(%q) = %q; want %q", tt.in, result, tt.expected)
+			}
+		})
+	}
+
+	long := strings.Repeat("é", 200) + ".jpeg"
+	if result := posix.Component(long); len(result) > maxComponentLen || !strings.HasSuffix(result, ".jpeg") {
+		t.Errorf("Expected a name of at most %d bytes keeping its extension, got %d bytes: %q", maxComponentLen, len(result), result)
+	}
+	if result := windows.Component(long); result != long {
+		t.Errorf("Expected 205 UTF-16 units to fit on Windows, got %q", result)
+	}
+}
+
+func TestSanitizerJoin(t *testing.T) {
+	windows := &Sanitizer{windows: true, caseInsensitive: true}
+	fpath, err := windows.Join("/lib:x", "2023/Trip: Rome", "IMG?.JPG")
+	if err != nil {
+		t.Fatalf("Join returned error: %v", err)
+	}
+	if expected := filepath.Join("/lib:x", "2023", "Trip_ Rome", "IMG_.JPG"); fpath != expected {
+		t.Errorf("Join = %q; want %q", fpath, expected)
+	}
+
+	// Only the Windows policy keeps the path under the root within
+	// MAX_PATH, wherever the root is.
+	windows.maxPath = true
+	deep := strings.Repeat("folder/", 30)
+	for _, root := range []string{"lib", "/run/media/user/CARD"} {
+		fpath, err = windows.Join(root, deep, strings.Repeat("n", 100)+".jpg")
+		if err != nil {
+			t.Fatalf("Join returned error: %v", err)
+		}
+		rel, _ := filepath.Rel(root, fpath)
+		if len(rel) != maxWindowsPathLen || !strings.HasSuffix(fpath, "n.jpg") {
+			t.Errorf("Expected the name shortened to fit %d characters under %s, got %d: %s", maxWindowsPathLen, root, len(rel), rel)
+		}
+	}
+	if _, err := windows.Join("/lib", strings.Repeat("folder/", 40), "a.jpg"); err == nil {
+		t.Error("Expected a path that cannot fit to fail")
+	}
+	windows.maxPath = false
+	if fpath, err := windows.Join("/lib", strings.Repeat("folder/", 40), "a.jpg"); err != nil || filepath.Base(fpath) != "a.jpg" {
+		t.Errorf("Expected the Windows rules on a Linux filesystem to leave MAX_PATH alone, got %q and %v", fpath, err)
+	}
+}
+
+func TestSanitizerCase(t *testing.T) {
+	dir := t.TempDir()
+	folds := caseInsensitive(dir)
+	s, err := NewSanitizer(SanitizeWindows, dir)
+	if err != nil {
+		t.Fatalf("NewSanitizer returned error: %v", err)
+	}
+	if s.Key(filepath.Join(dir, "IMG.JPG")) != s.Key(filepath.Join(dir, "img.jpg")) {
+		t.Error("Expected names differing in case to collide under the Windows rules")
+	}
+
+	os.WriteFile(filepath.Join(dir, "IMG.JPG"), []byte("first"), 0644)
+	if existing := s.Existing(filepath.Join(dir, "img.jpg")); !folds && existing != filepath.Join(dir, "IMG.JPG") {
+		t.Errorf("Expected IMG.JPG to be found for img.jpg, got %s", existing)
+	}
+
+	if _, err := NewSanitizer("dos", dir); err == nil {
+		t.Error("Expected an unknown policy to fail")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected the case probe to clean up, found %d files", len(entries))
+	}
+}
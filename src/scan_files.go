@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/fs"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/dgraph-io/badger/v4"
@@ -16,7 +18,15 @@ type MatchObject struct {
 	DstFileName string `json:"dst_file_name"`
 }
 
+// ScanFiles hashes src_dirname under the "src" prefix and dst_dirname under
+// "dst", for ValidateMd5sumFiles.
 func ScanFiles(ctx context.Context, src_dirname string, dst_dirname string, options ScanOptions) {
+	ScanFilesMulti(ctx, src_dirname, []string{dst_dirname}, options)
+}
+
+// ScanFilesMulti hashes src_dirname once under the "src" prefix, and each of
+// dst_dirnames under its own DestPrefix, for ValidateMd5sumFiles.
+func ScanFilesMulti(ctx context.Context, src_dirname string, dst_dirnames []string, options ScanOptions) {
 	logger := ctx.Value("logger").(zerolog.Logger)
 	db, err := OpenBadgerDB("./badger")
 	if err != nil {
@@ -24,7 +34,9 @@ func ScanFiles(ctx context.Context, src_dirname string, dst_dirname string, opti
 	}
 
 	ScanAndGenerateMd5sumFiles(ctx, db, src_dirname, "src", options)
-	ScanAndGenerateMd5sumFiles(ctx, db, dst_dirname, "dst", options)
+	for i, dst_dirname := range dst_dirnames {
+		ScanAndGenerateMd5sumFiles(ctx, db, dst_dirname, DestPrefix(i), options)
+	}
 
 	CloseBadgerDB(db)
 }
@@ -34,11 +46,16 @@ func ScanAndGenerateMd5sumFiles(ctx context.Context, db *badger.DB, dirname stri
 
 	jobs := make(chan string)
 	var wg sync.WaitGroup
-
-	numWorkers := options.NumWorkers
-	if numWorkers <= 0 {
-		numWorkers = 10
+	batch := NewBatchWriter(db, DefaultBatchSize, DefaultBatchInterval)
+
+	// Destinations are read whole, so that every file already there is
+	// known.
+	kind := PoolSourceRead
+	source := !strings.HasPrefix(prefix, "dst")
+	if !source {
+		kind = PoolDestRead
 	}
+	numWorkers := options.workers(ctx, kind, dirname)
 
 	// Start workers
 	for w := 0; w < numWorkers; w++ {
@@ -46,32 +63,40 @@ func ScanAndGenerateMd5sumFiles(ctx context.Context, db *badger.DB, dirname stri
 		go func() {
 			defer wg.Done()
 			for path := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
 				if options.ProgressChan != nil {
 					select {
 					case options.ProgressChan <- fmt.Sprintf("Scanning: %s", filepath.Base(path)):
 					default:
 					}
 				}
-				md5sum, err := ComputeFileHash(path, options.UseFastHash)
+				options.Throttle.WaitFile(ctx)
+				md5sum, err := computeFileHash(ctx, path, options.UseFastHash, options.Throttle)
 				if err != nil {
 					logger.Error().Err(err).Msgf("Failed to calculate md5sum for file: %s", path)
 					continue
 				}
-				PutBadgerDB(db, prefix+"-"+md5sum, path)
+				batch.Put(prefix+"-"+md5sum, path)
+				if essence := options.essenceHash(ctx, path, ""); essence != "" {
+					batch.Put(essenceKey(prefix, essence), path)
+				}
 			}
 		}()
 	}
 
 	// Walk directory and send jobs
-	err := filepath.WalkDir(dirname, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			logger.Error().Err(err).Msgf("Error walking path: %s", path)
-			return nil
-		}
-		if !d.IsDir() {
-			jobs <- path
+	err := walkSource(ctx, dirname, options.Recursive || !source, options.FollowLinks && source, func(path string, d fs.DirEntry) {
+		if source {
+			if len(options.MediaTypes) > 0 && !slices.Contains(options.MediaTypes, MediaTypeOf(d.Name())) {
+				return
+			}
+			if !options.Filter.keepPath(dirname, path) || !keepModTime(options.Filter, path) {
+				return
+			}
 		}
-		return nil
+		jobs <- path
 	})
 
 	if err != nil {
@@ -80,6 +105,16 @@ func ScanAndGenerateMd5sumFiles(ctx context.Context, db *badger.DB, dirname stri
 
 	close(jobs)
 	wg.Wait()
+
+	if err := batch.Close(); err != nil {
+		logger.Error().Err(err).Msgf("Failed to store hashes for %s", dirname)
+	}
+}
+
+// essenceKey is kept apart from the "src" and "dst" prefixes so that
+// ValidateMd5sumFiles does not see essence hashes.
+func essenceKey(prefix string, essence string) string {
+	return "essence-" + prefix + "-" + essence
 }
 
 func ValidateMd5sumFiles(ctx context.Context, src_prefix string, dst_prefix string) []MatchObject {
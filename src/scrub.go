@@ -0,0 +1,233 @@
+package icopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog"
+)
+
+// ScrubOptions controls a scrub of a destination library.
+type ScrubOptions struct {
+	// Budget stops handing out new files once it has elapsed. Zero means no
+	// limit. The next run carries on from where this one stopped.
+	Budget time.Duration
+	// Restart discards the checkpoint and starts a new pass from the top.
+	Restart      bool
+	NumWorkers   int
+	ProgressChan chan<- string
+	Throttle     *Throttle
+	Sizer        *WorkerSizer
+}
+
+// ScrubMismatch is a file whose contents no longer match its catalog hash.
+type ScrubMismatch struct {
+	Entry    CatalogEntry
+	Expected string
+	Md5Sum   string
+}
+
+// ScrubReport is what one scrub run found. Unexpected files are only looked
+// for once a pass over the catalog completes.
+type ScrubReport struct {
+	Verified   int
+	Corrupt    []ScrubMismatch
+	Missing    []CatalogEntry
+	Unexpected []string
+	Errored    []ErroredFileObject
+	// Complete is true when this run reached the end of the catalog.
+	Complete bool
+}
+
+// Scrub re-hashes the files recorded in the catalog of destdir and compares
+// them with the MD5 of the whole file recorded when they were copied. Each
+// entry is updated with the time it was verified and what was found.
+// Progress is checkpointed in the catalog after each page of catalogPageSize
+// entries and when the scrub stops, so one stopped by its budget or by ctx
+// resumes where it stopped, and one killed outright from the page it was on.
+func Scrub(ctx context.Context, destdir string, options ScrubOptions) (ScrubReport, error) {
+	report := ScrubReport{}
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return report, err
+	}
+	defer catalog.Close()
+
+	checkpoint := ""
+	if !options.Restart {
+		if checkpoint, err = catalog.ScrubCheckpoint(); err != nil {
+			return report, err
+		}
+	}
+
+	var deadline time.Time
+	if options.Budget > 0 {
+		deadline = time.Now().Add(options.Budget)
+	}
+	scan := ScanOptions{NumWorkers: options.NumWorkers, Sizer: options.Sizer}
+	numWorkers := scan.workers(ctx, PoolDestRead, catalog.root)
+
+	var mu sync.Mutex
+	for {
+		entries, err := catalog.entriesAfter(checkpoint, catalogPageSize)
+		if err != nil {
+			return report, err
+		}
+		if len(entries) == 0 {
+			report.Complete = true
+			break
+		}
+
+		done := make([]bool, len(entries))
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < numWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					if options.ProgressChan != nil {
+						select {
+						case options.ProgressChan <- fmt.Sprintf("Scrubbing: %s", filepath.Base(entries[i].Path)):
+						default:
+						}
+					}
+					options.Throttle.WaitFile(ctx)
+					scrubEntry(ctx, catalog, entries[i], options.Throttle, &report, &mu)
+					done[i] = true
+				}
+			}()
+		}
+
+		stopped := false
+		for i := range entries {
+			if ctx.Err() != nil || (!deadline.IsZero() && time.Now().After(deadline)) {
+				stopped = true
+				break
+			}
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+
+		// Only move the checkpoint past files that were actually scrubbed.
+		for i := 0; i < len(done) && done[i]; i++ {
+			checkpoint = entries[i].Path
+		}
+		// Committed with the page's results, so that a scrub killed outright
+		// only does the page it was on again.
+		if err := catalog.batch.Put(catalogScrubKey, checkpoint); err != nil {
+			return report, err
+		}
+		if err := catalog.Flush(); err != nil {
+			return report, err
+		}
+		if stopped {
+			break
+		}
+	}
+
+	if report.Complete {
+		if err := catalog.Flush(); err != nil {
+			return report, err
+		}
+		report.Unexpected, err = catalog.unexpectedFiles(ctx)
+		if err != nil {
+			return report, err
+		}
+		if err := catalog.batch.Put(catalogScrubKey, ""); err != nil {
+			return report, err
+		}
+	}
+	return report, catalog.Flush()
+}
+
+func scrubEntry(ctx context.Context, catalog *Catalog, entry CatalogEntry, throttle *Throttle, report *ScrubReport, mu *sync.Mutex) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	fpath := catalog.AbsPath(entry.Path)
+
+	entry.LastVerified = time.Now()
+	expected := entry.FullMd5Sum
+	if expected == "" && !isFastHash(entry.Md5Sum) {
+		expected = entry.Md5Sum
+	}
+	var md5sum string
+	var err error
+	if expected != "" {
+		md5sum, err = md5Sum(ctx, fpath, throttle)
+	} else {
+		// Copied before the whole file's MD5 was recorded: check what the
+		// fast hash covers, then keep the MD5 as the baseline of the next
+		// scrubs.
+		expected = entry.Md5Sum
+		md5sum, err = computeFileHash(ctx, fpath, true, throttle)
+		if err == nil && md5sum == expected {
+			entry.FullMd5Sum, err = md5Sum(ctx, fpath, throttle)
+			md5sum = expected
+		}
+	}
+
+	mu.Lock()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		entry.Status = StatusMissing
+		report.Missing = append(report.Missing, entry)
+	case err != nil:
+		logger.Error().Err(err).Msgf("Failed to scrub %s", fpath)
+		report.Errored = append(report.Errored, ErroredFileObject{
+			DateTime: entry.DateTime, Name: filepath.Base(fpath), Path: filepath.Dir(fpath),
+			ErrorMessage: err.Error(),
+		})
+		mu.Unlock()
+		return
+	case md5sum != expected:
+		entry.Status = StatusCorrupt
+		report.Corrupt = append(report.Corrupt, ScrubMismatch{Entry: entry, Expected: expected, Md5Sum: md5sum})
+	default:
+		entry.Status = StatusOK
+		report.Verified++
+	}
+	mu.Unlock()
+
+	entry.Path = fpath
+	if err := catalog.Put(entry); err != nil {
+		logger.Error().Err(err).Msgf("Failed to record scrub of %s", fpath)
+	}
+}
+
+// unexpectedFiles walks the library for files the catalog does not know,
+// leaving out those the ignore files do.
+func (c *Catalog) unexpectedFiles(ctx context.Context) ([]string, error) {
+	unexpected := []string{}
+	var getErr error
+	err := walkSource(ctx, c.root, true, false, func(path string, d fs.DirEntry) {
+		if getErr != nil {
+			return
+		}
+		if _, err := c.Get(path); errors.Is(err, badger.ErrKeyNotFound) {
+			unexpected = append(unexpected, path)
+		} else if err != nil {
+			getErr = err
+		}
+	})
+	if err == nil {
+		err = getErr
+	}
+	return unexpected, err
+}
+
+// ScrubCheckpoint returns the path the next scrub resumes after, or "" when
+// it starts a new pass.
+func (c *Catalog) ScrubCheckpoint() (string, error) {
+	checkpoint, err := GetBadgerDBValue(c.db, catalogScrubKey)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", nil
+	}
+	return checkpoint, err
+}
@@ -0,0 +1,137 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestScrub(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+
+	files := map[string]string{"a.jpg": "aaa", "b.jpg": "bbb", "c.jpg": "ccc", "d.jpg": "ddd"}
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum, _ := ComputeFileHash(path, true)
+		catalog.Put(CatalogEntry{Path: path, Md5Sum: sum})
+	}
+	if err := catalog.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "b.jpg"), []byte("bit rot"), 0644)
+	os.Remove(filepath.Join(dir, "c.jpg"))
+	os.WriteFile(filepath.Join(dir, "e.jpg"), []byte("eee"), 0644)
+
+	// A budget that has already run out scrubs nothing and keeps its place.
+	report, err := Scrub(ctx, dir, ScrubOptions{Budget: 1})
+	if err != nil {
+		t.Fatalf("Scrub returned error: %v", err)
+	}
+	if report.Complete || report.Verified != 0 {
+		t.Errorf("Expected an incomplete, empty scrub, got %+v", report)
+	}
+
+	// Resume after a.jpg, as if an earlier run had stopped there.
+	catalog, _ = OpenCatalog(dir)
+	catalog.batch.Put(catalogScrubKey, "a.jpg")
+	catalog.Close()
+
+	report, err = Scrub(ctx, dir, ScrubOptions{})
+	if err != nil {
+		t.Fatalf("Scrub returned error: %v", err)
+	}
+	if !report.Complete {
+		t.Error("Expected the scrub to complete")
+	}
+	if report.Verified != 1 {
+		t.Errorf("Expected 1 verified file, got %d", report.Verified)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Entry.Path != "b.jpg" {
+		t.Errorf("Expected b.jpg to be corrupt, got %+v", report.Corrupt)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Path != "c.jpg" {
+		t.Errorf("Expected c.jpg to be missing, got %+v", report.Missing)
+	}
+	if len(report.Unexpected) != 1 || filepath.Base(report.Unexpected[0]) != "e.jpg" {
+		t.Errorf("Expected e.jpg to be unexpected, got %v", report.Unexpected)
+	}
+
+	catalog, _ = OpenCatalog(dir)
+	defer catalog.Close()
+	if checkpoint, _ := catalog.ScrubCheckpoint(); checkpoint != "" {
+		t.Errorf("Expected the checkpoint to be cleared, got %q", checkpoint)
+	}
+	a, _ := catalog.Get("a.jpg")
+	if !a.LastVerified.IsZero() {
+		t.Error("Expected a.jpg, before the checkpoint, not to be scrubbed")
+	}
+	b, _ := catalog.Get("b.jpg")
+	if b.Status != StatusCorrupt || b.LastVerified.IsZero() {
+		t.Errorf("Expected b.jpg to be recorded as corrupt, got %+v", b)
+	}
+}
+
+func TestScrubFullSum(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+
+	// A large video recorded with a fast hash that does not cover the part
+	// that rots, and the MD5 of the whole file taken when it was copied.
+	path := filepath.Join(dir, "clip.mp4")
+	os.WriteFile(path, []byte("header middle trailer"), 0644)
+	full, _ := Md5Sum(path)
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	catalog.Put(CatalogEntry{Path: path, Md5Sum: "fast-0123456789abcdef", FullMd5Sum: full})
+	catalog.Close()
+
+	report, err := Scrub(ctx, dir, ScrubOptions{})
+	if err != nil {
+		t.Fatalf("Scrub returned error: %v", err)
+	}
+	if report.Verified != 1 || len(report.Corrupt) != 0 {
+		t.Errorf("Expected the file verified against its full MD5, got %+v", report)
+	}
+
+	os.WriteFile(path, []byte("header m1ddle trailer"), 0644)
+	report, _ = Scrub(ctx, dir, ScrubOptions{})
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Expected != full {
+		t.Errorf("Expected the rot found against the full MD5, got %+v", report)
+	}
+}
+
+func TestScrubStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "logger", zerolog.Nop()))
+	dir := t.TempDir()
+	catalog, _ := OpenCatalog(dir)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(name), 0644)
+		sum, _ := Md5Sum(path)
+		catalog.Put(CatalogEntry{Path: path, Md5Sum: sum})
+	}
+	catalog.Close()
+
+	cancel()
+	report, err := Scrub(ctx, dir, ScrubOptions{})
+	if err != nil {
+		t.Fatalf("Scrub returned error: %v", err)
+	}
+	if report.Complete || report.Verified != 0 {
+		t.Errorf("Expected a cancelled scrub to stop, got %+v", report)
+	}
+}
@@ -0,0 +1,261 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// mediaJob is a file for StreamMedia's workers to read, with the sidecars
+// that belong to it.
+type mediaJob struct {
+	path     string
+	sidecars []string
+}
+
+// sidecarPairer gathers the files a walk finds a directory at a time, and
+// hands them on once the walk has left the directory, so that each sidecar
+// can go with the media file it belongs to. The walk is depth first, so only
+// the directories on the way to the one being walked are held. Files keep
+// turns down are left out before they are handed on, and the sidecars of a
+// media file left out with it.
+type sidecarPairer struct {
+	types []string
+	keep  func(path string) bool
+	send  func(mediaJob)
+	open  []*walkedDir
+}
+
+type walkedDir struct {
+	dir   string
+	names []string
+}
+
+// add takes a file found by the walk.
+func (p *sidecarPairer) add(path string) {
+	dir := filepath.Dir(path)
+	for len(p.open) > 0 {
+		top := p.open[len(p.open)-1]
+		if top.dir == dir || isUnder(dir, top.dir) {
+			break
+		}
+		p.flush(top)
+		p.open = p.open[:len(p.open)-1]
+	}
+	if len(p.open) == 0 || p.open[len(p.open)-1].dir != dir {
+		p.open = append(p.open, &walkedDir{dir: dir})
+	}
+	top := p.open[len(p.open)-1]
+	top.names = append(top.names, filepath.Base(path))
+}
+
+// close hands on the files of the directories still held.
+func (p *sidecarPairer) close() {
+	for i := len(p.open) - 1; i >= 0; i-- {
+		p.flush(p.open[i])
+	}
+	p.open = nil
+}
+
+func (p *sidecarPairer) flush(d *walkedDir) {
+	for _, job := range pairSidecars(d.dir, d.names, p.types) {
+		if !p.keep(job.path) {
+			continue
+		}
+		job.sidecars = slices.DeleteFunc(job.sidecars, func(sc string) bool { return !p.keep(sc) })
+		p.send(job)
+	}
+}
+
+// isUnder reports whether dir is below parent.
+func isUnder(dir string, parent string) bool {
+	if !strings.HasSuffix(parent, string(filepath.Separator)) {
+		parent += string(filepath.Separator)
+	}
+	return strings.HasPrefix(dir, parent)
+}
+
+// pairSidecars returns a job for each of names in dir that is of one of
+// types, or may be, not knowing its type from its extension. A sidecar
+// whose media file is among names goes with it, and is left out with it
+// when its type is not asked for; see sidecarOwner.
+func pairSidecars(dir string, names []string, types []string) []mediaJob {
+	jobs := []mediaJob{}
+	index := map[string]int{}
+	for _, name := range names {
+		t := MediaTypeOf(name)
+		if t == MediaSidecar || (t != "" && !slices.Contains(types, t)) {
+			continue
+		}
+		index[name] = len(jobs)
+		jobs = append(jobs, mediaJob{path: filepath.Join(dir, name)})
+	}
+	if !slices.Contains(types, MediaSidecar) {
+		return jobs
+	}
+	for _, name := range names {
+		if MediaTypeOf(name) != MediaSidecar {
+			continue
+		}
+		owner := sidecarOwner(name, names)
+		if owner == "" {
+			jobs = append(jobs, mediaJob{path: filepath.Join(dir, name)})
+			continue
+		}
+		if i, ok := index[owner]; ok {
+			jobs[i].sidecars = append(jobs[i].sidecars, filepath.Join(dir, name))
+		}
+	}
+	return jobs
+}
+
+// sidecarOwner returns the media file among names that the sidecar name
+// belongs to: the one it adds an extension to, as IMG_0001.JPG.xmp does, or
+// else the first with the same stem, as for IMG_0001.xmp. Case is ignored.
+// It returns "" when there is none.
+func sidecarOwner(name string, names []string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	owner := ""
+	for _, n := range names {
+		if t := MediaTypeOf(n); t == "" || t == MediaSidecar {
+			continue
+		}
+		if strings.EqualFold(n, stem) {
+			return n
+		}
+		if owner == "" && strings.EqualFold(strings.TrimSuffix(n, filepath.Ext(n)), stem) {
+			owner = n
+		}
+	}
+	return owner
+}
+
+// sidecarName is the name the sidecar of owner takes when owner is placed
+// as placed, so that it still pairs with it: IMG_0001.xmp and
+// IMG_0001.JPG.xmp become 20230205_1.xmp and 20230205_1.jpg.xmp when
+// IMG_0001.JPG is renamed 20230205_1.jpg.
+func sidecarName(owner string, sidecar string, placed string) string {
+	ext := filepath.Ext(sidecar)
+	if strings.EqualFold(strings.TrimSuffix(sidecar, ext), owner) {
+		return placed + ext
+	}
+	return strings.TrimSuffix(placed, filepath.Ext(placed)) + ext
+}
+
+// readSidecar hashes the sidecar at fpath of owner, which dates it.
+func readSidecar(ctx context.Context, batch *BatchWriter, fpath string, owner FileObject, options ScanOptions) (FileObject, error) {
+	md5sum, err := computeFileHash(ctx, fpath, options.UseFastHash, options.Throttle)
+	if err != nil {
+		return FileObject{}, err
+	}
+	batch.Put("src-"+md5sum, fpath)
+	return FileObject{
+		DateTime: owner.DateTime, Name: filepath.Base(fpath), Path: filepath.Dir(fpath), Md5Sum: md5sum,
+		MediaType: MediaSidecar,
+	}, nil
+}
+
+// sidecarOwnerTarget is where the file a sidecar belongs to is in one
+// destination, and whether it replaced a file kept as a version there.
+type sidecarOwnerTarget struct {
+	dest     *destination
+	path     string
+	replaced bool
+}
+
+// placeSidecars puts each sidecar of image next to it in every destination
+// in owners, named after it, the way image was placed. A different file
+// already at a sidecar's name is kept as a version when image replaced one
+// or the policy keeps versions, overwritten when it overwrites, and left
+// alone otherwise. It returns the sidecars that are now in every one of
+// owners.
+func (fp *FileProcessor) placeSidecars(ctx context.Context, image FileObject, owners []sidecarOwnerTarget,
+	copyChan chan<- FileObject, errorChan chan<- ErroredFileObject, skipChan chan<- FileObject) []FileObject {
+
+	logger := ctx.Value("logger").(zerolog.Logger)
+	policy := fp.conflictPolicy()
+	done := []FileObject{}
+	for _, sc := range image.Sidecars {
+		fpath := filepath.Join(sc.Path, sc.Name)
+		errored := func(d *destination, err error) {
+			logger.Error().Err(err).Msgf("Failed to place sidecar %s in %s", fpath, d.Dir)
+			errorChan <- ErroredFileObject{Path: sc.Path, Name: sc.Name, DateTime: sc.DateTime, ErrorMessage: err.Error(), Destination: d.Dir}
+		}
+
+		there := 0
+		targets := []*copyTarget{}
+		for _, o := range owners {
+			d := o.dest
+			dir := filepath.Dir(o.path)
+			rel, err := filepath.Rel(d.Dir, dir)
+			if err != nil {
+				errored(d, err)
+				continue
+			}
+			path, err := d.sanitizer.Join(d.Dir, rel, sidecarName(image.Name, sc.Name, filepath.Base(o.path)))
+			if err != nil {
+				errored(d, err)
+				continue
+			}
+			path = d.sanitizer.Existing(path)
+			t := &copyTarget{dest: d, dir: dir, path: path}
+			if _, err := os.Lstat(path); err == nil {
+				sum, err := computeFileHash(ctx, path, isFastHash(sc.Md5Sum), fp.Throttle)
+				if err != nil {
+					errored(d, err)
+					continue
+				}
+				switch {
+				case sum == sc.Md5Sum:
+					skipChan <- FileObject{Path: dir, Name: filepath.Base(path), DateTime: sc.DateTime, MediaType: MediaSidecar, Destination: d.Dir}
+					there++
+					continue
+				case o.replaced || policy == ConflictVersion:
+					t.replaced, t.keep, t.path = path, sum, path+tmpSuffix
+				case policy != ConflictOverwrite:
+					logger.Debug().Msgf("Leaving %s in place of the sidecar of %s", path, image.Name)
+					skipChan <- FileObject{Path: dir, Name: filepath.Base(path), DateTime: sc.DateTime, MediaType: MediaSidecar, Destination: d.Dir}
+					continue
+				}
+			}
+			targets = append(targets, t)
+		}
+		if len(targets) == 0 {
+			if there == len(owners) {
+				done = append(done, sc)
+			}
+			continue
+		}
+
+		fis, _ := os.Stat(fpath)
+		fd, err := os.Open(fpath)
+		if err != nil {
+			for _, t := range targets {
+				errored(t.dest, err)
+			}
+			continue
+		}
+		fp.placeFiles(ctx, fpath, targets, fd, fis)
+		fd.Close()
+		for _, t := range targets {
+			if t.replaced != "" {
+				fp.replaceKept(ctx, fpath, t)
+			}
+			if t.err != nil {
+				errored(t.dest, t.err)
+				continue
+			}
+			fp.recordCatalog(ctx, t.dest.catalog, sc, t)
+			copyChan <- FileObject{Path: t.dir, Name: filepath.Base(t.path), DateTime: sc.DateTime, MediaType: MediaSidecar, Destination: t.dest.Dir}
+			there++
+		}
+		if there == len(owners) {
+			done = append(done, sc)
+		}
+	}
+	return done
+}
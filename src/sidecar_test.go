@@ -0,0 +1,111 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestPairSidecars(t *testing.T) {
+	names := []string{"IMG_0001.CR2", "IMG_0001.JPG", "IMG_0001.JPG.xmp", "IMG_0001.xmp", "MVI_0002.MOV", "MVI_0002.THM", "notes.txt", "orphan.aae", "report.xml"}
+	jobs := pairSidecars("card", names, AllMediaTypes)
+	got := map[string][]string{}
+	for _, job := range jobs {
+		got[filepath.Base(job.path)] = job.sidecars
+	}
+	expected := map[string][]string{
+		"IMG_0001.CR2": {filepath.Join("card", "IMG_0001.xmp")},
+		"IMG_0001.JPG": {filepath.Join("card", "IMG_0001.JPG.xmp")},
+		"MVI_0002.MOV": {filepath.Join("card", "MVI_0002.THM")},
+		"notes.txt":    nil,
+		"orphan.aae":   nil,
+		"report.xml":   nil,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	// The sidecar of a file left out is left out with it.
+	jobs = pairSidecars("card", names, []string{MediaImage, MediaSidecar})
+	for _, job := range jobs {
+		if base := filepath.Base(job.path); base == "MVI_0002.MOV" || base == "MVI_0002.THM" {
+			t.Errorf("Expected the video and its thumbnail left out, got %s", base)
+		}
+	}
+
+	// Files the filter leaves out are dropped before they are handed on, so
+	// they are never opened.
+	filter := &Filter{}
+	filter.Exclude("*.CR2")
+	filter.Exclude("*.JPG.xmp")
+	sent := map[string][]string{}
+	p := &sidecarPairer{
+		types: AllMediaTypes,
+		keep:  func(path string) bool { return filter.keepPath("card", path) },
+		send:  func(job mediaJob) { sent[filepath.Base(job.path)] = job.sidecars },
+	}
+	for _, name := range names {
+		p.add(filepath.Join("card", name))
+	}
+	p.close()
+	if _, ok := sent["IMG_0001.CR2"]; ok {
+		t.Errorf("Expected IMG_0001.CR2 and its sidecar left out, got %v", sent)
+	}
+	if sc, ok := sent["IMG_0001.JPG"]; !ok || len(sc) != 0 {
+		t.Errorf("Expected IMG_0001.JPG without its excluded sidecar, got %v", sent)
+	}
+	if filter.Excluded() != 2 {
+		t.Errorf("Expected 2 files excluded, got %d", filter.Excluded())
+	}
+
+	tests := []struct{ owner, sidecar, placed, expected string }{
+		{"IMG_0001.JPG", "IMG_0001.xmp", "20230205_1.jpg", "20230205_1.xmp"},
+		{"IMG_0001.JPG", "IMG_0001.JPG.xmp", "20230205_1.jpg", "20230205_1.jpg.xmp"},
+		{"IMG_0001.jpg", "img_0001.JPG.XMP", "IMG_0001.jpg", "IMG_0001.jpg.XMP"},
+	}
+	for _, tt := range tests {
+		if name := sidecarName(tt.owner, tt.sidecar, tt.placed); name != tt.expected {
+			t.Errorf("sidecarName(%s, %s, %s) = %s; want %s", tt.owner, tt.sidecar, tt.placed, name, tt.expected)
+		}
+	}
+}
+
+func TestCopySidecars(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	t.Chdir(t.TempDir())
+	src := t.TempDir()
+	out := t.TempDir()
+	photo := filepath.Join(src, "IMG_0001.JPG")
+	os.WriteFile(photo, []byte("\xFF\xD8\xFF\xE0photo"), 0644)
+	os.WriteFile(filepath.Join(src, "IMG_0001.xmp"), []byte("<x:xmpmeta/>"), 0644)
+	// The sidecar was edited long after the photo was taken.
+	taken := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(photo, taken, taken)
+
+	fp := &FileProcessor{DateFmt: "DATE", Rename: "{date:20060102}_{seq}.{ext}", Recursive: true}
+	summary := fp.CopyMedia(ctx, src, []Destination{{Dir: out}})
+	if summary.Copied != 2 || summary.Errored != 0 {
+		t.Fatalf("Expected the photo and its sidecar copied, got %+v", summary.CopyCounts)
+	}
+	for _, name := range []string{"20200601_1.jpg", "20200601_1.xmp"} {
+		if _, err := os.Stat(filepath.Join(out, "2020-06-01", name)); err != nil {
+			t.Errorf("Expected %s in the folder of the photo: %v", name, err)
+		}
+	}
+
+	// A sidecar added later goes next to the photo already in the library.
+	os.WriteFile(filepath.Join(src, "IMG_0001.JPG.xmp"), []byte("<x:xmpmeta>later</x:xmpmeta>"), 0644)
+	os.Remove(".file_status.txt")
+	summary = fp.CopyMedia(ctx, src, []Destination{{Dir: out}})
+	if summary.Copied != 1 || summary.Errored != 0 {
+		t.Errorf("Expected only the new sidecar copied, got %+v", summary.CopyCounts)
+	}
+	if _, err := os.Stat(filepath.Join(out, "2020-06-01", "20200601_1.jpg.xmp")); err != nil {
+		t.Errorf("Expected the new sidecar next to the photo: %v", err)
+	}
+}
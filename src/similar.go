@@ -0,0 +1,202 @@
+package icopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultSimilarThreshold is the Hamming distance under which two perceptual
+// hashes are taken to be the same picture. Resizes and recompressions usually
+// land within a few bits; unrelated photos are around 32 apart.
+const DefaultSimilarThreshold = 8
+
+// SimilarOptions controls FindSimilar.
+type SimilarOptions struct {
+	Threshold    int
+	NumWorkers   int
+	ProgressChan chan<- string
+	Throttle     *Throttle
+	Sizer        *WorkerSizer
+}
+
+// SimilarImage is one member of a group of similar images.
+type SimilarImage struct {
+	Path   string
+	Hash   PerceptualHash
+	Width  int
+	Height int
+	Size   int64
+}
+
+// FindSimilar groups the images in the catalog of destdir whose perceptual
+// hashes are within options.Threshold of each other, directly or through
+// other members of the group. Images copied without a perceptual hash are
+// hashed now and the hash is stored in the catalog. Groups are returned
+// largest first; within a group the largest image comes first.
+func FindSimilar(ctx context.Context, destdir string, options SimilarOptions) ([][]SimilarImage, error) {
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return nil, err
+	}
+	defer catalog.Close()
+
+	entries, err := catalog.perceptualEntries(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := [][]SimilarImage{}
+	for _, cluster := range clusterSimilar(entries, options.Threshold) {
+		group := []SimilarImage{}
+		for _, entry := range cluster {
+			hash, _ := ParsePerceptualHash(entry.PerceptualHash)
+			img := SimilarImage{Path: catalog.AbsPath(entry.Path), Hash: hash, Width: entry.Width, Height: entry.Height}
+			if fi, err := os.Stat(img.Path); err == nil {
+				img.Size = fi.Size()
+			}
+			group = append(group, img)
+		}
+		sort.Slice(group, func(a, b int) bool {
+			pa, pb := group[a].Width*group[a].Height, group[b].Width*group[b].Height
+			if pa != pb {
+				return pa > pb
+			}
+			if group[a].Size != group[b].Size {
+				return group[a].Size > group[b].Size
+			}
+			return group[a].Path < group[b].Path
+		})
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(a, b int) bool {
+		if len(groups[a]) != len(groups[b]) {
+			return len(groups[a]) > len(groups[b])
+		}
+		return groups[a][0].Path < groups[b][0].Path
+	})
+	return groups, nil
+}
+
+// clusterSimilar groups entries whose perceptual hashes are within threshold
+// of each other, directly or through other members, and returns the groups
+// with more than one member.
+func clusterSimilar(entries []CatalogEntry, threshold int) [][]CatalogEntry {
+	hashes := make([]PerceptualHash, len(entries))
+	tree := &bkTree{}
+	for i, entry := range entries {
+		hashes[i], _ = ParsePerceptualHash(entry.PerceptualHash)
+		tree.Insert(hashes[i], i)
+	}
+
+	parent := make([]int, len(entries))
+	for i := range parent {
+		parent[i] = i
+	}
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	for i, hash := range hashes {
+		tree.Search(hash, threshold, func(j int, _ int) {
+			if a, b := find(i), find(j); a != b {
+				parent[a] = b
+			}
+		})
+	}
+
+	byRoot := map[int][]CatalogEntry{}
+	for i, entry := range entries {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], entry)
+	}
+	clusters := [][]CatalogEntry{}
+	for _, cluster := range byRoot {
+		if len(cluster) > 1 {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters
+}
+
+// perceptualEntries returns every catalog entry with a perceptual hash,
+// computing and recording the ones that are missing.
+func (c *Catalog) perceptualEntries(ctx context.Context, options SimilarOptions) ([]CatalogEntry, error) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	scan := ScanOptions{NumWorkers: options.NumWorkers, Sizer: options.Sizer}
+	numWorkers := scan.workers(ctx, PoolDestRead, c.root)
+
+	hashed := []CatalogEntry{}
+	var mu sync.Mutex
+	add := func(entry CatalogEntry) {
+		if _, err := ParsePerceptualHash(entry.PerceptualHash); err != nil {
+			logger.Error().Err(err).Msgf("Bad perceptual hash for %s", entry.Path)
+			return
+		}
+		mu.Lock()
+		hashed = append(hashed, entry)
+		mu.Unlock()
+	}
+
+	jobs := make(chan CatalogEntry)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				fpath := c.AbsPath(entry.Path)
+				if options.ProgressChan != nil {
+					select {
+					case options.ProgressChan <- fmt.Sprintf("Hashing: %s", filepath.Base(fpath)):
+					default:
+					}
+				}
+				options.Throttle.WaitFile(ctx)
+				hash, width, height, err := computePerceptualHash(ctx, fpath, "", options.Throttle)
+				if err != nil {
+					if !errors.Is(err, ErrNotDecodable) {
+						logger.Debug().Err(err).Msgf("No perceptual hash for %s", fpath)
+					}
+					continue
+				}
+				entry.PerceptualHash, entry.Width, entry.Height = hash.String(), width, height
+				add(entry)
+				entry.Path = fpath
+				if err := c.Put(entry); err != nil {
+					logger.Error().Err(err).Msgf("Failed to record perceptual hash of %s", fpath)
+				}
+			}
+		}()
+	}
+
+	var err error
+	after := ""
+	for {
+		var entries []CatalogEntry
+		if entries, err = c.entriesAfter(after, catalogPageSize); err != nil || len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			switch {
+			case entry.PerceptualHash != "":
+				add(entry)
+			case entry.Status != StatusMissing:
+				jobs <- entry
+			}
+		}
+		after = entries[len(entries)-1].Path
+	}
+	close(jobs)
+	wg.Wait()
+	return hashed, err
+}
@@ -0,0 +1,125 @@
+package icopy
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBKTreeSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	hashes := make([]PerceptualHash, 2000)
+	tree := &bkTree{}
+	for i := range hashes {
+		hashes[i] = PerceptualHash(rng.Uint64())
+		if i%10 == 0 && i > 0 {
+			// Near neighbours of an earlier hash, so there is something to find.
+			hashes[i] = hashes[i-1] ^ PerceptualHash(1<<uint(rng.Intn(64)))
+		}
+		tree.Insert(hashes[i], i)
+	}
+
+	for _, q := range []int{0, 9, 10, 500, 1999} {
+		found := map[int]bool{}
+		tree.Search(hashes[q], 6, func(item int, distance int) {
+			if distance != hashes[q].Distance(hashes[item]) {
+				t.Errorf("Wrong distance %d for item %d", distance, item)
+			}
+			found[item] = true
+		})
+		for i, h := range hashes {
+			if want := hashes[q].Distance(h) <= 6; want != found[i] {
+				t.Errorf("Query %d: item %d found=%v, want %v", q, i, found[i], want)
+			}
+		}
+	}
+}
+
+// testPicture draws a scene at the given size, so that the same scene can be
+// saved at several resolutions.
+func testPicture(w, h int, seed int64) image.Image {
+	rng := rand.New(rand.NewSource(seed))
+	type blob struct{ x, y, r float64 }
+	blobs := make([]blob, 6)
+	for i := range blobs {
+		blobs[i] = blob{rng.Float64(), rng.Float64(), 0.1 + 0.2*rng.Float64()}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+			v := 40.0
+			for _, b := range blobs {
+				if (fx-b.x)*(fx-b.x)+(fy-b.y)*(fy-b.y) < b.r*b.r {
+					v += 35
+				}
+			}
+			img.Set(x, y, color.RGBA{uint8(v), uint8(v), uint8(v), 255})
+		}
+	}
+	return img
+}
+
+func TestFindSimilar(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+
+	write := func(name string, img image.Image) string {
+		path := filepath.Join(dir, name)
+		fd, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		if filepath.Ext(name) == ".png" {
+			png.Encode(fd, img)
+		} else {
+			jpeg.Encode(fd, img, &jpeg.Options{Quality: 40})
+		}
+		return path
+	}
+	paths := []string{
+		write("original.png", testPicture(640, 480, 1)),
+		write("forwarded.jpg", testPicture(320, 240, 1)),
+		write("other.png", testPicture(640, 480, 2)),
+	}
+
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	for _, path := range paths {
+		catalog.Put(CatalogEntry{Path: path})
+	}
+	catalog.Close()
+
+	groups, err := FindSimilar(ctx, dir, SimilarOptions{Threshold: DefaultSimilarThreshold})
+	if err != nil {
+		t.Fatalf("FindSimilar returned error: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0]) != 2 {
+		t.Fatalf("Expected one group of two, got %+v", groups)
+	}
+	if filepath.Base(groups[0][0].Path) != "original.png" || groups[0][0].Width != 640 {
+		t.Errorf("Expected the larger original first, got %+v", groups[0][0])
+	}
+	if filepath.Base(groups[0][1].Path) != "forwarded.jpg" || groups[0][1].Size == 0 {
+		t.Errorf("Expected the forwarded copy second, got %+v", groups[0][1])
+	}
+
+	// The hashes computed for the report are kept in the catalog.
+	catalog, _ = OpenCatalog(dir)
+	defer catalog.Close()
+	entry, _ := catalog.Get("other.png")
+	if entry.PerceptualHash == "" || entry.Height != 480 {
+		t.Errorf("Expected other.png to have been hashed, got %+v", entry)
+	}
+}
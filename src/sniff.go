@@ -0,0 +1,267 @@
+package icopy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Formats SniffFormat recognises. Each is named after its usual extension.
+const (
+	FormatJPEG   = "jpg"
+	FormatPNG    = "png"
+	FormatGIF    = "gif"
+	FormatBMP    = "bmp"
+	FormatTIFF   = "tif" // TIFF, and the RAW formats built on it without a mark of their own, such as DNG, NEF and ARW
+	FormatCR2    = "cr2"
+	FormatORF    = "orf"
+	FormatRW2    = "rw2"
+	FormatRAF    = "raf"
+	FormatHEIC   = "heic"
+	FormatAVIF   = "avif"
+	FormatCR3    = "cr3"
+	FormatWebP   = "webp"
+	FormatMP4    = "mp4"
+	FormatMOV    = "mov"
+	Format3GP    = "3gp"
+	FormatM4A    = "m4a"
+	FormatAVI    = "avi"
+	FormatWAV    = "wav"
+	FormatMKV    = "mkv"
+	FormatWebM   = "webm"
+	FormatASF    = "asf"
+	FormatMPEGPS = "mpg"
+	FormatMPEGTS = "ts"
+	FormatFLV    = "flv"
+)
+
+// formatInfo is the media type of a format and the extensions it goes by,
+// the usual one first.
+type formatInfo struct {
+	mediaType string
+	exts      []string
+}
+
+var formats = map[string]formatInfo{
+	FormatJPEG: {MediaImage, []string{"jpg", "jpeg", "jpe"}},
+	FormatPNG:  {MediaImage, []string{"png"}},
+	FormatGIF:  {MediaImage, []string{"gif"}},
+	FormatBMP:  {MediaImage, []string{"bmp", "dib"}},
+	FormatTIFF: {MediaImage, []string{"tif", "tiff", "dng", "nef", "nrw", "arw", "srf", "sr2", "pef", "srw", "3fr", "erf", "kdc", "mos", "iiq", "cr2", "orf", "rw2"}},
+	FormatCR2:  {MediaImage, []string{"cr2"}},
+	FormatORF:  {MediaImage, []string{"orf"}},
+	FormatRW2:  {MediaImage, []string{"rw2", "raw"}},
+	FormatRAF:  {MediaImage, []string{"raf"}},
+	FormatHEIC: {MediaImage, []string{"heic", "heif", "hif"}},
+	FormatAVIF: {MediaImage, []string{"avif"}},
+	FormatCR3:  {MediaImage, []string{"cr3"}},
+	FormatWebP: {MediaImage, []string{"webp"}},
+
+	FormatMP4:    {MediaVideo, []string{"mp4", "m4v", "f4v", "f4p", "f4b"}},
+	FormatMOV:    {MediaVideo, []string{"mov", "qt"}},
+	Format3GP:    {MediaVideo, []string{"3gp", "3g2"}},
+	FormatAVI:    {MediaVideo, []string{"avi"}},
+	FormatMKV:    {MediaVideo, []string{"mkv", "mk3d", "mka"}},
+	FormatWebM:   {MediaVideo, []string{"webm"}},
+	FormatASF:    {MediaVideo, []string{"asf", "wmv", "wma"}},
+	FormatMPEGPS: {MediaVideo, []string{"mpg", "mpeg", "vob", "m2p", "mod"}},
+	FormatMPEGTS: {MediaVideo, []string{"ts", "mts", "m2ts", "m2t", "tod"}},
+	FormatFLV:    {MediaVideo, []string{"flv"}},
+
+	FormatM4A: {MediaAudio, []string{"m4a", "m4b", "m4p", "f4a"}},
+	FormatWAV: {MediaAudio, []string{"wav"}},
+}
+
+// sniffLen is how much of a file SniffFile reads: enough for three MPEG-TS
+// packets, and for the brands of an ISOBMFF ftyp box.
+const sniffLen = 512
+
+// Sniff is what a file turned out to be.
+type Sniff struct {
+	// Format is one of the Format constants, or "" when the content was not
+	// recognised.
+	Format string
+	// MediaType comes from the extension when it is one the format goes by,
+	// or the content was not recognised, and from the format otherwise.
+	MediaType string
+	// WrongExt is set when the format was recognised and the file's
+	// extension is not one it goes by, unless it is a sidecar's.
+	WrongExt bool
+}
+
+// SniffFile reads the start of the file at fpath to tell its format.
+func SniffFile(fpath string) (Sniff, error) {
+	fd, err := os.Open(fpath)
+	if err != nil {
+		return Sniff{}, err
+	}
+	defer fd.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Sniff{}, err
+	}
+	return sniffName(filepath.Base(fpath), head[:n]), nil
+}
+
+// sniffReader tells the format of the file r reads from its first bytes,
+// for callers that have it open and were not given its Sniff.
+func sniffReader(r io.ReaderAt) string {
+	head := make([]byte, sniffLen)
+	n, _ := r.ReadAt(head, 0)
+	return SniffFormat(head[:n])
+}
+
+// sniffName sniffs head, the start of the file called name.
+func sniffName(name string, head []byte) Sniff {
+	s := Sniff{Format: SniffFormat(head), MediaType: MediaTypeOf(name)}
+	info, ok := formats[s.Format]
+	// Sidecars are often in a media format, such as THM thumbnails in JPEG
+	// and LRV proxies in MP4, and stay sidecars.
+	if !ok || s.MediaType == MediaSidecar {
+		return s
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	s.WrongExt = !slices.Contains(info.exts, ext)
+	if s.WrongExt || s.MediaType == "" {
+		s.MediaType = info.mediaType
+	}
+	return s
+}
+
+// FormatExtension returns the usual extension of a format, without the dot,
+// or "" for an unknown one.
+func FormatExtension(format string) string {
+	if info, ok := formats[format]; ok {
+		return info.exts[0]
+	}
+	return ""
+}
+
+// fixExtension returns name with the usual extension of format, in upper
+// case when its own was.
+func fixExtension(name string, format string) string {
+	ext := filepath.Ext(name)
+	fixed := FormatExtension(format)
+	if fixed == "" {
+		return name
+	}
+	if ext != "" && ext == strings.ToUpper(ext) {
+		fixed = strings.ToUpper(fixed)
+	}
+	return strings.TrimSuffix(name, ext) + "." + fixed
+}
+
+var asfHeaderGUID = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+
+// SniffFormat tells the format of a file from its first bytes, or returns ""
+// when it does not know them.
+func SniffFormat(head []byte) string {
+	at := func(off int, magic string) bool {
+		return len(head) >= off+len(magic) && string(head[off:off+len(magic)]) == magic
+	}
+	switch {
+	case at(0, "\xFF\xD8\xFF"):
+		return FormatJPEG
+	case at(0, "\x89PNG\r\n\x1A\n"):
+		return FormatPNG
+	case at(0, "GIF87a"), at(0, "GIF89a"):
+		return FormatGIF
+	case at(0, "BM") && at(6, "\x00\x00\x00\x00"):
+		// The two reserved words after the file size are always zero.
+		return FormatBMP
+	case at(0, "II*\x00") && at(8, "CR\x02"):
+		return FormatCR2
+	case at(0, "II*\x00"), at(0, "MM\x00*"):
+		return FormatTIFF
+	case at(0, "IIRO"), at(0, "IIRS"), at(0, "MMOR"):
+		return FormatORF
+	case at(0, "IIU\x00"):
+		return FormatRW2
+	case at(0, "FUJIFILMCCD-RAW"):
+		return FormatRAF
+	case at(4, "ftyp"):
+		return sniffBrands(head)
+	case at(0, "RIFF") && at(8, "WEBP"):
+		return FormatWebP
+	case at(0, "RIFF") && at(8, "AVI "):
+		return FormatAVI
+	case at(0, "RIFF") && at(8, "WAVE"):
+		return FormatWAV
+	case at(0, "\x1A\x45\xDF\xA3"):
+		// The EBML header names the document type within its first bytes.
+		if bytes.Contains(head[:min(len(head), 64)], []byte("webm")) {
+			return FormatWebM
+		}
+		return FormatMKV
+	case bytes.HasPrefix(head, asfHeaderGUID):
+		return FormatASF
+	case at(0, "\x00\x00\x01\xBA"), at(0, "\x00\x00\x01\xB3"):
+		return FormatMPEGPS
+	case at(0, "FLV\x01"):
+		return FormatFLV
+	case isTransportStream(head, 0, 188), isTransportStream(head, 4, 192):
+		return FormatMPEGTS
+	case at(4, "moov"), at(4, "mdat"), at(4, "wide"), at(4, "pnot"):
+		// QuickTime files older than the ftyp box start with an atom.
+		return FormatMOV
+	}
+	return ""
+}
+
+// isTransportStream reports whether head holds MPEG-TS packets of size
+// bytes, each starting with a sync byte at off: 188 for plain TS, and 192,
+// after a 4 byte time code, for M2TS as AVCHD cameras write it.
+func isTransportStream(head []byte, off int, size int) bool {
+	if len(head) < off+size+1 {
+		return false
+	}
+	for i := off; i < len(head); i += size {
+		if head[i] != 0x47 {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffBrands tells ISOBMFF formats apart by the major brand of the ftyp box
+// and, for the generic HEIF brands, the compatible ones.
+func sniffBrands(head []byte) string {
+	brand := func(b string) string {
+		switch {
+		case b == "heic", b == "heix", b == "heim", b == "heis", b == "hevc", b == "hevx":
+			return FormatHEIC
+		case b == "avif", b == "avis":
+			return FormatAVIF
+		case b == "crx ":
+			return FormatCR3
+		case b == "qt  ":
+			return FormatMOV
+		case b == "M4A ", b == "M4B ", b == "M4P ":
+			return FormatM4A
+		case strings.HasPrefix(b, "3gp"), strings.HasPrefix(b, "3g2"):
+			return Format3GP
+		}
+		return ""
+	}
+	if len(head) < 12 {
+		return FormatMP4
+	}
+	major := string(head[8:12])
+	if f := brand(major); f != "" {
+		return f
+	}
+	if major == "mif1" || major == "msf1" {
+		size := int(uint32(head[0])<<24 | uint32(head[1])<<16 | uint32(head[2])<<8 | uint32(head[3]))
+		for i := 16; i+4 <= min(size, len(head)); i += 4 {
+			if f := brand(string(head[i : i+4])); f == FormatHEIC || f == FormatAVIF {
+				return f
+			}
+		}
+		return FormatHEIC
+	}
+	return FormatMP4
+}
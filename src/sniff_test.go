@@ -0,0 +1,171 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// ftyp returns an ftyp box with a major brand and compatible brands.
+func ftyp(major string, compatible ...string) []byte {
+	body := major + "\x00\x00\x00\x00" + strings.Join(compatible, "")
+	size := len(body) + 8
+	return []byte(string([]byte{0, 0, 0, byte(size)}) + "ftyp" + body)
+}
+
+// transportStream returns n packets of size bytes, each with its sync byte at
+// off.
+func transportStream(n int, off int, size int) []byte {
+	b := make([]byte, n*size)
+	for i := 0; i < n; i++ {
+		b[i*size+off] = 0x47
+	}
+	return b
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     []byte
+		expected string
+	}{
+		{"jpeg", []byte("\xFF\xD8\xFF\xE1\x00\x10Exif"), FormatJPEG},
+		{"png", []byte("\x89PNG\r\n\x1A\n\x00\x00"), FormatPNG},
+		{"gif", []byte("GIF89a\x01\x00"), FormatGIF},
+		{"bmp", []byte("BM\x46\x00\x00\x00\x00\x00\x00\x00\x36\x00"), FormatBMP},
+		{"tiff little endian", []byte("II*\x00\x08\x00\x00\x00"), FormatTIFF},
+		{"tiff big endian", []byte("MM\x00*\x00\x00\x00\x08"), FormatTIFF},
+		{"cr2", []byte("II*\x00\x10\x00\x00\x00CR\x02\x00"), FormatCR2},
+		{"orf", []byte("IIRO\x08\x00\x00\x00"), FormatORF},
+		{"rw2", []byte("IIU\x00\x08\x00\x00\x00"), FormatRW2},
+		{"raf", []byte("FUJIFILMCCD-RAW 0201"), FormatRAF},
+		{"heic", ftyp("heic", "mif1", "heic"), FormatHEIC},
+		{"heif generic", ftyp("mif1", "mif1", "heic"), FormatHEIC},
+		{"avif", ftyp("avif", "mif1", "avif"), FormatAVIF},
+		{"avif by compatible brand", ftyp("mif1", "mif1", "avif"), FormatAVIF},
+		{"cr3", ftyp("crx ", "crx ", "isom"), FormatCR3},
+		{"mp4", ftyp("isom", "isom", "mp42"), FormatMP4},
+		{"mov", ftyp("qt  ", "qt  "), FormatMOV},
+		{"m4a", ftyp("M4A ", "M4A ", "isom"), FormatM4A},
+		{"3gp", ftyp("3gp5", "3gp5", "isom"), Format3GP},
+		{"old quicktime", []byte("\x00\x00\x00\x08wide\x00\x00\x00\x10mdat"), FormatMOV},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), FormatWebP},
+		{"avi", []byte("RIFF\x00\x00\x00\x00AVI LIST"), FormatAVI},
+		{"wav", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), FormatWAV},
+		{"mkv", []byte("\x1A\x45\xDF\xA3\x9F\x42\x86\x81\x01\x42\x82\x88matroska"), FormatMKV},
+		{"webm", []byte("\x1A\x45\xDF\xA3\x9F\x42\x86\x81\x01\x42\x82\x84webm"), FormatWebM},
+		{"asf", append([]byte{}, asfHeaderGUID...), FormatASF},
+		{"mpeg-ps", []byte("\x00\x00\x01\xBA\x44\x00\x04"), FormatMPEGPS},
+		{"mpeg-ts", transportStream(3, 0, 188), FormatMPEGTS},
+		{"m2ts", transportStream(3, 4, 192), FormatMPEGTS},
+		{"flv", []byte("FLV\x01\x05\x00\x00\x00\x09"), FormatFLV},
+		{"text", []byte("hello, world"), ""},
+		{"empty", nil, ""},
+		{"one ts packet", transportStream(1, 0, 188), ""},
+	}
+	for _, tt := range tests {
+		if got := SniffFormat(tt.head); got != tt.expected {
+			t.Errorf("SniffFormat(%s) = %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestSniffName(t *testing.T) {
+	jpeg := []byte("\xFF\xD8\xFF\xE0")
+	tests := []struct {
+		name      string
+		head      []byte
+		mediaType string
+		wrongExt  bool
+	}{
+		{"IMG_0001.JPG", jpeg, MediaImage, false},
+		{"IMG_0001.jpeg", jpeg, MediaImage, false},
+		{"IMG_0001.jpg", ftyp("heic", "mif1", "heic"), MediaImage, true},
+		{"clip.mp4", ftyp("qt  ", "qt  "), MediaVideo, true},
+		{"clip.mp4", jpeg, MediaImage, true},
+		{"IMG_0001", jpeg, MediaImage, true},
+		{"DSC_0001.NEF", []byte("MM\x00*\x00\x00\x00\x08"), MediaImage, false},
+		{"song.wma", asfHeaderGUID, MediaAudio, false},
+		{"MVI_0001.THM", jpeg, MediaSidecar, false},
+		{"GL010001.LRV", ftyp("mp41", "mp41"), MediaSidecar, false},
+		{"notes.txt", []byte("hello"), "", false},
+		{"IMG_0001.BMP", []byte("BM"), MediaImage, false},
+	}
+	for _, tt := range tests {
+		s := sniffName(tt.name, tt.head)
+		if s.MediaType != tt.mediaType || s.WrongExt != tt.wrongExt {
+			t.Errorf("sniffName(%s) = %+v, expected media type %q and wrong extension %v", tt.name, s, tt.mediaType, tt.wrongExt)
+		}
+	}
+}
+
+func TestFixExtension(t *testing.T) {
+	tests := []struct {
+		name, format, expected string
+	}{
+		{"IMG_0001.jpg", FormatHEIC, "IMG_0001.heic"},
+		{"IMG_0001.JPG", FormatHEIC, "IMG_0001.HEIC"},
+		{"clip.mp4", FormatMOV, "clip.mov"},
+		{"IMG_0001", FormatJPEG, "IMG_0001.jpg"},
+		{"IMG_0001.jpg", "", "IMG_0001.jpg"},
+	}
+	for _, tt := range tests {
+		if got := fixExtension(tt.name, tt.format); got != tt.expected {
+			t.Errorf("fixExtension(%s, %s) = %s, expected %s", tt.name, tt.format, got, tt.expected)
+		}
+	}
+
+	fp := &FileProcessor{FixExtensions: true}
+	image := FileObject{Name: "IMG_0001.jpg", Format: FormatHEIC, WrongExt: true}
+	if name := fp.targetName(image, 1); name != "IMG_0001.heic" {
+		t.Errorf("Expected IMG_0001.heic, got %s", name)
+	}
+	fp.FixExtensions = false
+	if name := fp.targetName(image, 1); name != "IMG_0001.jpg" {
+		t.Errorf("Expected the name kept without FixExtensions, got %s", name)
+	}
+}
+
+func TestStreamMediaSniffs(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "shared.jpg"), ftyp("heic", "mif1", "heic"), 0644)
+	os.WriteFile(filepath.Join(src, "IMG_0002"), []byte("\xFF\xD8\xFF\xE0"), 0644)
+	os.WriteFile(filepath.Join(src, "clip.mp4"), ftyp("qt  ", "qt  "), 0644)
+	os.WriteFile(filepath.Join(src, "notes.txt"), []byte("hello"), 0644)
+
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+
+	files, _ := ReadMedia(ctx, db, src, ScanOptions{})
+	found := map[string]FileObject{}
+	for _, f := range files {
+		found[f.Name] = f
+	}
+	if len(found) != 3 {
+		t.Fatalf("Expected the three media files, got %v", found)
+	}
+	if f := found["shared.jpg"]; f.Format != FormatHEIC || !f.WrongExt || f.MediaType != MediaImage {
+		t.Errorf("Expected shared.jpg read as HEIC with a wrong extension, got %+v", f)
+	}
+	if f := found["IMG_0002"]; f.Format != FormatJPEG || f.MediaType != MediaImage {
+		t.Errorf("Expected IMG_0002 read as JPEG, got %+v", f)
+	}
+	if f := found["clip.mp4"]; f.Format != FormatMOV || !f.WrongExt || f.MediaType != MediaVideo {
+		t.Errorf("Expected clip.mp4 read as QuickTime, got %+v", f)
+	}
+
+	// Asked for videos only, an image named .mp4 is left out.
+	os.WriteFile(filepath.Join(src, "still.mp4"), []byte("\xFF\xD8\xFF\xE0"), 0644)
+	files, _ = ReadMedia(ctx, db, src, ScanOptions{MediaTypes: []string{MediaVideo}})
+	if len(files) != 1 || files[0].Name != "clip.mp4" {
+		t.Errorf("Expected only clip.mp4, got %v", files)
+	}
+}
@@ -1,6 +1,17 @@
 package icopy
 
-import "sort"
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+)
+
+// sortSpillSize is how many files SortStreamByDate holds in memory before it
+// spills a sorted run to disk.
+const sortSpillSize = 100000
 
 func SortFilesByDate(files []FileObject) {
 	sort.Slice(files, func(i, j int) bool {
@@ -8,3 +19,142 @@ func SortFilesByDate(files []FileObject) {
 	},
 	)
 }
+
+// SortStreamByDate sends everything received from in to out ordered by date,
+// and closes out when done. Up to spillSize files are sorted in memory; past
+// that, sorted runs are spilled to temporary files and merged at the end, so
+// memory stays bounded however many files there are. If spilling fails the
+// rest is sorted in memory and the error is returned once all files are sent.
+func SortStreamByDate(in <-chan FileObject, out chan<- FileObject, spillSize int) error {
+	defer close(out)
+
+	var runs []*os.File
+	defer func() {
+		for _, f := range runs {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	var spillErr error
+	chunk := []FileObject{}
+	for f := range in {
+		chunk = append(chunk, f)
+		if len(chunk) >= spillSize && spillErr == nil {
+			run, err := spillRun(chunk)
+			if err != nil {
+				spillErr = err
+				continue
+			}
+			runs = append(runs, run)
+			chunk = chunk[:0]
+		}
+	}
+	SortFilesByDate(chunk)
+
+	sources := []func() (FileObject, bool, error){sliceSource(chunk)}
+	for _, run := range runs {
+		if _, err := run.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		sources = append(sources, decoderSource(json.NewDecoder(bufio.NewReader(run))))
+	}
+	if err := mergeByDate(sources, out); err != nil {
+		return err
+	}
+	return spillErr
+}
+
+// spillRun sorts files and writes them to a temporary file, one JSON object
+// per line.
+func spillRun(files []FileObject) (*os.File, error) {
+	SortFilesByDate(files)
+	f, err := os.CreateTemp("", "icopy-sort-*.json")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, file := range files {
+		if err := enc.Encode(file); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+func sliceSource(files []FileObject) func() (FileObject, bool, error) {
+	i := 0
+	return func() (FileObject, bool, error) {
+		if i >= len(files) {
+			return FileObject{}, false, nil
+		}
+		i++
+		return files[i-1], true, nil
+	}
+}
+
+func decoderSource(dec *json.Decoder) func() (FileObject, bool, error) {
+	return func() (FileObject, bool, error) {
+		f := FileObject{}
+		if err := dec.Decode(&f); err != nil {
+			if err == io.EOF {
+				return f, false, nil
+			}
+			return f, false, err
+		}
+		return f, true, nil
+	}
+}
+
+// mergeByDate does a k-way merge of sorted sources into out.
+func mergeByDate(sources []func() (FileObject, bool, error), out chan<- FileObject) error {
+	h := &mergeHeap{}
+	for _, next := range sources {
+		f, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(h, mergeItem{file: f, next: next})
+		}
+	}
+
+	for h.Len() > 0 {
+		item := heap.Pop(h).(mergeItem)
+		out <- item.file
+		f, ok, err := item.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(h, mergeItem{file: f, next: item.next})
+		}
+	}
+	return nil
+}
+
+type mergeItem struct {
+	file FileObject
+	next func() (FileObject, bool, error)
+}
+
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return h[i].file.DateTime.Before(h[j].file.DateTime) }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
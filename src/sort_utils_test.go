@@ -0,0 +1,44 @@
+package icopy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSortStreamByDate(t *testing.T) {
+	base := time.Date(2023, 10, 25, 12, 0, 0, 0, time.UTC)
+	offsets := []int{7, 3, 9, 0, 5, 1, 8, 2, 6, 4}
+
+	in := make(chan FileObject)
+	out := make(chan FileObject)
+	go func() {
+		for _, o := range offsets {
+			in <- FileObject{Name: fmt.Sprintf("%d.jpg", o), DateTime: base.Add(time.Duration(o) * time.Hour)}
+		}
+		close(in)
+	}()
+
+	errChan := make(chan error, 1)
+	go func() {
+		// A spill size of 3 forces several runs to be merged from disk.
+		errChan <- SortStreamByDate(in, out, 3)
+	}()
+
+	got := []FileObject{}
+	for f := range out {
+		got = append(got, f)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("SortStreamByDate returned error: %v", err)
+	}
+
+	if len(got) != len(offsets) {
+		t.Fatalf("Expected %d files, got %d", len(offsets), len(got))
+	}
+	for i, f := range got {
+		if want := fmt.Sprintf("%d.jpg", i); f.Name != want {
+			t.Errorf("Position %d: got %s; want %s", i, f.Name, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package icopy
+
+import "sync"
+
+// summaryListLimit is how many errors and files with a wrong extension a
+// CopySummary lists. Past it they are only counted; each is in the log.
+const summaryListLimit = 1000
+
+// CopyCounts are the files copied, skipped and errored. A file copied to two
+// destinations counts twice.
+type CopyCounts struct {
+	Copied  int
+	Skipped int
+	Errored int
+}
+
+// CopySummary is the outcome of a copy, counted by destination and by media
+// type so that it stays the same size however many files are imported.
+type CopySummary struct {
+	CopyCounts
+	ByDestination map[string]*CopyCounts
+	ByMediaType   map[string]*CopyCounts
+	// Errors and WrongExt list the first summaryListLimit errors and copies
+	// whose content is not what their extension says.
+	Errors   []ErroredFileObject
+	WrongExt []FileObject
+	// WrongExtCount counts the copies with a wrong extension, listed or not.
+	WrongExtCount int
+
+	mu sync.Mutex
+}
+
+// copySink receives the outcome of each file of a copy, from any goroutine.
+type copySink interface {
+	copied(f FileObject)
+	skipped(f FileObject)
+	errored(e ErroredFileObject)
+}
+
+func (s *CopySummary) counts(destination string, mediaType string) []*CopyCounts {
+	if s.ByDestination == nil {
+		s.ByDestination = map[string]*CopyCounts{}
+		s.ByMediaType = map[string]*CopyCounts{}
+	}
+	counts := []*CopyCounts{&s.CopyCounts}
+	if destination != "" {
+		counts = append(counts, countsOf(s.ByDestination, destination))
+	}
+	if mediaType != "" {
+		counts = append(counts, countsOf(s.ByMediaType, mediaType))
+	}
+	return counts
+}
+
+func countsOf(m map[string]*CopyCounts, key string) *CopyCounts {
+	if m[key] == nil {
+		m[key] = &CopyCounts{}
+	}
+	return m[key]
+}
+
+func (s *CopySummary) copied(f FileObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.counts(f.Destination, f.MediaType) {
+		c.Copied++
+	}
+	if f.WrongExt {
+		s.WrongExtCount++
+		if len(s.WrongExt) < summaryListLimit {
+			s.WrongExt = append(s.WrongExt, f)
+		}
+	}
+}
+
+func (s *CopySummary) skipped(f FileObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.counts(f.Destination, f.MediaType) {
+		c.Skipped++
+	}
+}
+
+func (s *CopySummary) errored(e ErroredFileObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.counts(e.Destination, MediaTypeOf(e.Name)) {
+		c.Errored++
+	}
+	if len(s.Errors) < summaryListLimit {
+		s.Errors = append(s.Errors, e)
+	}
+}
+
+// fileLists gathers every file of a copy, for the callers that want them all.
+type fileLists struct {
+	mu           sync.Mutex
+	filesCopied  []FileObject
+	erroredFiles []ErroredFileObject
+	skipedfiles  []FileObject
+}
+
+func newFileLists() *fileLists {
+	return &fileLists{filesCopied: []FileObject{}, erroredFiles: []ErroredFileObject{}, skipedfiles: []FileObject{}}
+}
+
+func (l *fileLists) copied(f FileObject) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.filesCopied = append(l.filesCopied, f)
+}
+
+func (l *fileLists) skipped(f FileObject) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.skipedfiles = append(l.skipedfiles, f)
+}
+
+func (l *fileLists) errored(e ErroredFileObject) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.erroredFiles = append(l.erroredFiles, e)
+}
@@ -0,0 +1,132 @@
+package icopy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestCopySummaryCounts(t *testing.T) {
+	s := &CopySummary{}
+	s.copied(FileObject{Name: "a.jpg", MediaType: MediaImage, Destination: "/lib1"})
+	s.copied(FileObject{Name: "a.jpg", MediaType: MediaImage, Destination: "/lib2", WrongExt: true})
+	s.skipped(FileObject{Name: "b.mov", MediaType: MediaVideo, Destination: "/lib1"})
+	for i := 0; i < summaryListLimit+5; i++ {
+		s.errored(ErroredFileObject{Name: fmt.Sprintf("%d.mov", i)})
+	}
+
+	if s.Copied != 2 || s.Skipped != 1 || s.Errored != summaryListLimit+5 {
+		t.Errorf("Expected 2 copied, 1 skipped and %d errors, got %+v", summaryListLimit+5, s.CopyCounts)
+	}
+	if c := s.ByDestination["/lib1"]; c == nil || c.Copied != 1 || c.Skipped != 1 {
+		t.Errorf("Expected /lib1 to have 1 copied and 1 skipped, got %+v", c)
+	}
+	if c := s.ByMediaType[MediaVideo]; c == nil || c.Skipped != 1 || c.Errored != summaryListLimit+5 {
+		t.Errorf("Expected the videos skipped and errored, got %+v", c)
+	}
+	if len(s.Errors) != summaryListLimit {
+		t.Errorf("Expected the errors listed up to %d, got %d", summaryListLimit, len(s.Errors))
+	}
+	if s.WrongExtCount != 1 || len(s.WrongExt) != 1 {
+		t.Errorf("Expected one wrong extension, got %d", s.WrongExtCount)
+	}
+}
+
+func TestCopyMediaSkipsStatusFile(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	t.Chdir(t.TempDir())
+	src := t.TempDir()
+	out := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		os.WriteFile(filepath.Join(src, name), []byte("\xFF\xD8\xFF\xE0"+name), 0644)
+	}
+	os.WriteFile(".file_status.txt", []byte(filepath.Join(src, "b.jpg")+"\n"), 0644)
+
+	fp := &FileProcessor{DateFmt: "DATE"}
+	summary := fp.CopyMedia(ctx, src, []Destination{{Dir: out}})
+	if summary.Copied != 2 || summary.Errored != 0 {
+		t.Fatalf("Expected a.jpg and c.jpg copied, got %+v", summary.CopyCounts)
+	}
+	if c := summary.ByMediaType[MediaImage]; c == nil || c.Copied != 2 {
+		t.Errorf("Expected two images copied, got %+v", c)
+	}
+
+	// Scrub has the MD5 of the whole file to check each copy against.
+	catalog, err := OpenCatalog(out)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	entries, _ := catalog.entriesAfter("", 10)
+	catalog.Close()
+	if len(entries) != 2 {
+		t.Fatalf("Expected two catalog entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if sum, _ := Md5Sum(catalog.AbsPath(e.Path)); e.FullMd5Sum != sum {
+			t.Errorf("Expected %s recorded with its full MD5 %s, got %q", e.Path, sum, e.FullMd5Sum)
+		}
+	}
+
+	// A second run finds both in the status file and copies nothing.
+	summary = fp.CopyMedia(ctx, src, []Destination{{Dir: out}})
+	if summary.Copied != 0 || summary.Skipped != 0 {
+		t.Errorf("Expected every file already done, got %+v", summary.CopyCounts)
+	}
+}
+
+func TestCopyMediaStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "logger", zerolog.Nop()))
+	t.Chdir(t.TempDir())
+	src := t.TempDir()
+	out := t.TempDir()
+	os.WriteFile(filepath.Join(src, "a.jpg"), []byte("\xFF\xD8\xFF\xE0a"), 0644)
+
+	cancel()
+	fp := &FileProcessor{DateFmt: "DATE"}
+	summary := fp.CopyMedia(ctx, src, []Destination{{Dir: out}})
+	if summary.Copied != 0 {
+		t.Errorf("Expected nothing copied once cancelled, got %+v", summary.CopyCounts)
+	}
+	// The catalog is still closed, so it can be opened again.
+	catalog, err := OpenCatalog(out)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	catalog.Close()
+}
+
+func TestCopyMediaDoneWhenEveryDestinationHasIt(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	t.Chdir(t.TempDir())
+	src := t.TempDir()
+	seeded := t.TempDir()
+	empty := t.TempDir()
+	photo := []byte("\xFF\xD8\xFF\xE0photo")
+	os.WriteFile(filepath.Join(src, "IMG_0001.JPG"), photo, 0644)
+	os.WriteFile(filepath.Join(src, "IMG_0001.xmp"), []byte("<x:xmpmeta/>"), 0644)
+	// One backup drive already has the photo and its sidecar.
+	os.MkdirAll(filepath.Join(seeded, "old"), 0755)
+	os.WriteFile(filepath.Join(seeded, "old", "IMG_0001.JPG"), photo, 0644)
+	os.WriteFile(filepath.Join(seeded, "old", "IMG_0001.xmp"), []byte("<x:xmpmeta/>"), 0644)
+
+	fp := &FileProcessor{DateFmt: "DATE"}
+	summary := fp.CopyMedia(ctx, src, []Destination{{Dir: seeded}, {Dir: empty}})
+	if c := summary.ByDestination[empty]; c == nil || c.Copied != 2 {
+		t.Fatalf("Expected the photo and sidecar copied to the empty drive, got %+v", c)
+	}
+	if c := summary.ByDestination[seeded]; c == nil || c.Copied != 0 {
+		t.Errorf("Expected nothing copied to the drive that has both, got %+v", c)
+	}
+
+	status, _ := os.ReadFile(".file_status.txt")
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0001.xmp"} {
+		if !strings.Contains(string(status), filepath.Join(src, name)+"\n") {
+			t.Errorf("Expected %s done once both drives have it, got %q", name, status)
+		}
+	}
+}
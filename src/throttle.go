@@ -0,0 +1,256 @@
+package icopy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+const (
+	minBurst = 4 * 1024
+	maxBurst = 4 * 1024 * 1024
+)
+
+// Throttle holds the token buckets shared by every worker of a run: one for
+// bytes read, one for bytes written and one for files opened. A nil *Throttle
+// does not limit anything.
+type Throttle struct {
+	read  *rate.Limiter
+	write *rate.Limiter
+	files *rate.Limiter
+}
+
+// NewThrottle returns a Throttle limited to the given bytes per second for
+// reads and writes and files per second. Zero means unlimited.
+func NewThrottle(readRate int64, writeRate int64, fileRate float64) *Throttle {
+	t := &Throttle{
+		read:  rate.NewLimiter(rate.Inf, maxBurst),
+		write: rate.NewLimiter(rate.Inf, maxBurst),
+		files: rate.NewLimiter(rate.Inf, 1),
+	}
+	t.SetReadRate(readRate)
+	t.SetWriteRate(writeRate)
+	t.SetFileRate(fileRate)
+	return t
+}
+
+func (t *Throttle) SetReadRate(bytesPerSec int64) {
+	setByteRate(t.read, bytesPerSec)
+}
+
+func (t *Throttle) SetWriteRate(bytesPerSec int64) {
+	setByteRate(t.write, bytesPerSec)
+}
+
+func (t *Throttle) SetFileRate(filesPerSec float64) {
+	if filesPerSec <= 0 {
+		t.files.SetLimit(rate.Inf)
+		return
+	}
+	t.files.SetLimit(rate.Limit(filesPerSec))
+}
+
+func setByteRate(l *rate.Limiter, bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		l.SetBurst(maxBurst)
+		return
+	}
+	burst := bytesPerSec
+	if burst < minBurst {
+		burst = minBurst
+	} else if burst > maxBurst {
+		burst = maxBurst
+	}
+	l.SetLimit(rate.Limit(bytesPerSec))
+	l.SetBurst(int(burst))
+}
+
+// WaitFile blocks until another file may be opened.
+func (t *Throttle) WaitFile(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.files.Wait(ctx)
+}
+
+// Reader returns r with reads drawn from the shared read bucket.
+func (t *Throttle) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, l: t.read}
+}
+
+// ReaderAt returns r with reads drawn from the shared read bucket.
+func (t *Throttle) ReaderAt(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	if t == nil {
+		return r
+	}
+	return &throttledReaderAt{ctx: ctx, r: r, l: t.read}
+}
+
+// WaitWrite blocks until n more bytes may be written.
+func (t *Throttle) WaitWrite(ctx context.Context, n int) {
+	if t == nil {
+		return
+	}
+	waitBytes(ctx, t.write, n)
+}
+
+func (t *Throttle) String() string {
+	return fmt.Sprintf("read=%s write=%s files=%s", formatLimit(t.read), formatLimit(t.write), formatLimit(t.files))
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if burst := tr.l.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := tr.r.Read(p)
+	waitBytes(tr.ctx, tr.l, n)
+	return n, err
+}
+
+type throttledReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+	l   *rate.Limiter
+}
+
+func (tr *throttledReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := tr.r.ReadAt(p, off)
+	waitBytes(tr.ctx, tr.l, n)
+	return n, err
+}
+
+// waitBytes takes n tokens from l, in pieces no larger than its burst.
+func waitBytes(ctx context.Context, l *rate.Limiter, n int) {
+	for n > 0 {
+		chunk := n
+		if burst := l.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return
+		}
+		n -= chunk
+	}
+}
+
+func formatLimit(l *rate.Limiter) string {
+	if l.Limit() == rate.Inf {
+		return "unlimited"
+	}
+	return strconv.FormatFloat(float64(l.Limit()), 'f', -1, 64)
+}
+
+// ParseRate parses a byte rate such as "50MB/s", "512K" or "1.5GiB/s" into
+// bytes per second. K, M and G are binary multiples whether or not they are
+// followed by "iB" or "B". An empty string or "0" means unlimited.
+func ParseRate(s string) (int64, error) {
+	v := strings.TrimSpace(s)
+	v = strings.TrimSuffix(v, "/s")
+	if v == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	upper := strings.ToUpper(v)
+	upper = strings.TrimSuffix(upper, "IB")
+	upper = strings.TrimSuffix(upper, "B")
+	switch {
+	case strings.HasSuffix(upper, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(upper, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(upper, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		upper = upper[:len(upper)-1]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// ServeControl accepts connections on l and applies one command per line to
+// t, so limits can be changed while a run is in progress:
+//
+//	read 10MB/s
+//	write 0
+//	files 5
+//	status
+func (t *Throttle) ServeControl(ctx context.Context, l net.Listener) {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				reply, err := t.control(scanner.Text())
+				if err != nil {
+					fmt.Fprintf(conn, "error: %v\n", err)
+					continue
+				}
+				logger.Info().Msgf("Throttle: %s", reply)
+				fmt.Fprintln(conn, reply)
+			}
+		}()
+	}
+}
+
+func (t *Throttle) control(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return t.String(), nil
+	}
+	if len(fields) == 1 && fields[0] == "status" {
+		return t.String(), nil
+	}
+	if len(fields) != 2 {
+		return "", fmt.Errorf("expected <read|write|files> <rate>, got %q", line)
+	}
+
+	switch fields[0] {
+	case "read", "write":
+		n, err := ParseRate(fields[1])
+		if err != nil {
+			return "", err
+		}
+		if fields[0] == "read" {
+			t.SetReadRate(n)
+		} else {
+			t.SetWriteRate(n)
+		}
+	case "files":
+		n, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid file rate %q", fields[1])
+		}
+		t.SetFileRate(n)
+	default:
+		return "", fmt.Errorf("unknown limit %q", fields[0])
+	}
+	return t.String(), nil
+}
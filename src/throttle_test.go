@@ -0,0 +1,61 @@
+package icopy
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"100", 100},
+		{"100B/s", 100},
+		{"512K", 512 * 1024},
+		{"50MB/s", 50 * 1024 * 1024},
+		{"1.5GiB/s", 3 * 512 * 1024 * 1024},
+		{"2mb", 2 * 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := ParseRate(tt.input)
+			if err != nil {
+				t.Fatalf("ParseRate(%q) returned error: %v", tt.input, err)
+			}
+			if result != tt.expected {
+				t.Errorf("ParseRate(%q) = %d; want %d", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	for _, input := range []string{"fast", "-1MB/s", "MB/s"} {
+		if _, err := ParseRate(input); err == nil {
+			t.Errorf("ParseRate(%q) expected error, got nil", input)
+		}
+	}
+}
+
+func TestThrottleControl(t *testing.T) {
+	throttle := NewThrottle(0, 0, 0)
+
+	if _, err := throttle.control("read 1MB/s"); err != nil {
+		t.Fatalf("control returned error: %v", err)
+	}
+	if got := throttle.read.Limit(); got != 1024*1024 {
+		t.Errorf("Expected read limit 1048576, got %v", got)
+	}
+
+	if _, err := throttle.control("files 2"); err != nil {
+		t.Fatalf("control returned error: %v", err)
+	}
+	if got := throttle.files.Limit(); got != 2 {
+		t.Errorf("Expected file limit 2, got %v", got)
+	}
+
+	if _, err := throttle.control("iops 2"); err == nil {
+		t.Error("Expected error for unknown limit, got nil")
+	}
+}
@@ -0,0 +1,313 @@
+package icopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// OpUndo is the journal op recording that an operation of an earlier run was
+// reversed.
+const OpUndo = "undo"
+
+// JournalRun summarises the journal entries of one icopy run.
+type JournalRun struct {
+	ID     string
+	Start  time.Time
+	Ops    map[string]int
+	Undone bool
+}
+
+// UndoResult is what Undo reversed.
+type UndoResult struct {
+	Run     string
+	Undone  int
+	Errored []ErroredFileObject
+}
+
+// Runs returns the runs recorded in the journal, oldest first. Undo runs
+// themselves are not listed.
+func (c *Catalog) Runs() ([]JournalRun, error) {
+	entries, err := c.JournalEntries()
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*JournalRun{}
+	undone := map[string]bool{}
+	for _, e := range entries {
+		if e.Op == OpUndo {
+			undone[e.Undoes] = true
+			continue
+		}
+		if e.Run == "" {
+			// Written before runs were recorded; these cannot be undone.
+			continue
+		}
+		run, ok := byID[e.Run]
+		if !ok {
+			run = &JournalRun{ID: e.Run, Start: e.Time, Ops: map[string]int{}}
+			byID[e.Run] = run
+		}
+		run.Ops[e.Op]++
+	}
+	runs := []JournalRun{}
+	for _, run := range byID {
+		run.Undone = undone[run.ID]
+		runs = append(runs, *run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Start.Before(runs[j].Start) })
+	return runs, nil
+}
+
+// Undo reverses the operations of one run recorded in the journal of
+// destdir, newest first, or of the latest run not yet undone when run is "".
+//
+//   - copy, hardlink and symlink remove the file that was placed, as long
+//     as a copy still has the hash it was copied with, and a link is still
+//     the one made to a source that still exists
+//   - move puts the file back where it came from
+//   - version puts back the file a copy or restore replaced, and restore
+//     returns the restored file to the saved versions
+//   - dedupe actions turn the removed or linked duplicate back into an
+//     independent copy of the file that was kept
+func Undo(ctx context.Context, destdir string, run string) (UndoResult, error) {
+	result := UndoResult{}
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return result, err
+	}
+	defer catalog.Close()
+
+	runs, err := catalog.Runs()
+	if err != nil {
+		return result, err
+	}
+	if run == "" {
+		for i := len(runs) - 1; i >= 0; i-- {
+			if !runs[i].Undone {
+				run = runs[i].ID
+				break
+			}
+		}
+		if run == "" {
+			return result, errors.New("nothing to undo")
+		}
+	} else {
+		found := false
+		for _, r := range runs {
+			if r.ID == run {
+				found = true
+				if r.Undone {
+					return result, fmt.Errorf("run %s has already been undone", run)
+				}
+			}
+		}
+		if !found {
+			return result, fmt.Errorf("no run %s in the journal", run)
+		}
+	}
+	result.Run = run
+
+	entries, err := catalog.JournalEntries()
+	if err != nil {
+		return result, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Run != run || e.Op == OpUndo {
+			continue
+		}
+		if err := catalog.undo(ctx, e); err != nil {
+			result.Errored = append(result.Errored, ErroredFileObject{
+				DateTime: e.Time, Name: filepath.Base(e.Dest), Path: filepath.Dir(e.Dest),
+				ErrorMessage: err.Error(),
+			})
+			continue
+		}
+		if err := catalog.Journal(JournalEntry{Op: OpUndo, Source: e.Source, Dest: e.Dest, Undoes: run}); err != nil {
+			return result, err
+		}
+		result.Undone++
+	}
+	return result, catalog.Flush()
+}
+
+func (c *Catalog) undo(ctx context.Context, e JournalEntry) error {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	logger.Debug().Msgf("Undoing %s of %s", e.Op, e.Dest)
+
+	switch {
+	case strings.HasPrefix(e.Op, opDedupe):
+		if err := restoreCopy(e.Source, e.Dest); err != nil {
+			return err
+		}
+		entry, err := c.Get(e.Dest)
+		if err != nil {
+			if entry, err = c.Get(e.Source); err != nil {
+				return err
+			}
+		}
+		entry.Path = e.Dest
+		entry.Mode = ModeCopy
+		entry.LinkTarget = ""
+		return c.Put(entry)
+
+	case e.Op == ModeCopy:
+		entry, err := c.Get(e.Dest)
+		if err == nil {
+			sum, err := computeFileHash(ctx, e.Dest, strings.HasPrefix(entry.Md5Sum, "fast-"), nil)
+			if err != nil {
+				return err
+			}
+			if sum != entry.Md5Sum {
+				return fmt.Errorf("%s has changed since it was copied", e.Dest)
+			}
+		}
+		if err := os.Remove(e.Dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return c.Delete(e.Dest)
+
+	case e.Op == ModeHardlink, e.Op == ModeSymlink:
+		if err := checkLink(e); err != nil {
+			return err
+		}
+		if err := os.Remove(e.Dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return c.Delete(e.Dest)
+
+	case e.Op == ModeMove:
+		if _, err := os.Lstat(e.Source); err == nil {
+			return fmt.Errorf("%s exists, not moving %s back", e.Source, e.Dest)
+		}
+		if err := os.MkdirAll(filepath.Dir(e.Source), 0755); err != nil {
+			return err
+		}
+		if err := moveFile(e.Dest, e.Source); err != nil {
+			return err
+		}
+		return c.Delete(e.Dest)
+
+	case e.Op == OpRestore:
+		if _, err := os.Lstat(e.Dest); err == nil {
+			return fmt.Errorf("%s exists, not saving %s back to it", e.Dest, e.Source)
+		}
+		if err := moveFile(e.Source, e.Dest); err != nil {
+			return err
+		}
+		return c.Delete(e.Source)
+
+	case e.Op == OpVersion:
+		// The copy that replaced the file was undone first.
+		if _, err := os.Lstat(e.Source); err == nil {
+			return fmt.Errorf("%s exists, not restoring its earlier version", e.Source)
+		}
+		if err := moveFile(e.Dest, e.Source); err != nil {
+			return err
+		}
+		entry := CatalogEntry{Path: e.Source, Mode: ModeCopy, CopiedAt: e.Time}
+		if _, sum, ok := strings.Cut(filepath.Base(e.Dest), "-"); ok {
+			entry.Md5Sum = sum
+		}
+		return c.Put(entry)
+	}
+	return fmt.Errorf("cannot undo %q", e.Op)
+}
+
+// checkLink returns an error unless e.Dest is gone or still the link the
+// journal entry e made to e.Source: a symlink pointing at it, or a hardlink
+// to the same file, which must still exist elsewhere so that removing this
+// link loses nothing.
+func checkLink(e JournalEntry) error {
+	fi, err := os.Lstat(e.Dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.Op == ModeSymlink {
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			return fmt.Errorf("%s is no longer a symlink", e.Dest)
+		}
+		target, err := os.Readlink(e.Dest)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(e.Dest), target)
+		}
+		if filepath.Clean(target) != filepath.Clean(e.Source) {
+			return fmt.Errorf("%s now points at %s, not %s", e.Dest, target, e.Source)
+		}
+		return nil
+	}
+
+	src, err := os.Lstat(e.Source)
+	if err != nil {
+		return fmt.Errorf("%s may be the last link to its file: %w", e.Dest, err)
+	}
+	if !os.SameFile(fi, src) {
+		return fmt.Errorf("%s is no longer a hardlink to %s", e.Dest, e.Source)
+	}
+	return nil
+}
+
+// tmpSuffix is added to the name of a file being written in place of another
+// until it is complete.
+const tmpSuffix = ".icopy-tmp"
+
+// restoreCopy makes dst an independent copy of src, replacing whatever link
+// is at dst, with src's permissions and modification time.
+func restoreCopy(src string, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + tmpSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// ListRuns returns the runs recorded in the journal of destdir, oldest first.
+func ListRuns(destdir string) ([]JournalRun, error) {
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return nil, err
+	}
+	defer catalog.Close()
+	return catalog.Runs()
+}
@@ -0,0 +1,257 @@
+package icopy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// VersionsDirName is the directory under CatalogDirName that keeps the files
+// a copy replaced.
+const VersionsDirName = "versions"
+
+// OpVersion is the journal op recording that a file was moved aside into the
+// versions directory before being replaced, and OpRestore that a saved version
+// was moved back.
+const (
+	OpVersion = "version"
+	OpRestore = "restore"
+)
+
+// versionTimeFormat sorts lexically in time order.
+const versionTimeFormat = "20060102T150405.000000000"
+
+// saveVersion moves the file at path, whose hash is sum, to
+// .icopy/versions/<path relative to the root>/<timestamp>-<hash> and journals
+// the move, so that the file about to replace it can be undone. The hash keeps
+// its "fast-" prefix when it is a partial one.
+func (c *Catalog) saveVersion(path string, sum string) (string, error) {
+	rel, err := c.relPath(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(c.root, CatalogDirName, VersionsDirName, filepath.FromSlash(rel))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	vpath := filepath.Join(dir, now.Format(versionTimeFormat)+"-"+sum)
+	if err := moveFile(path, vpath); err != nil {
+		return "", err
+	}
+	abs, _ := filepath.Abs(path)
+	return vpath, c.Journal(JournalEntry{Op: OpVersion, Source: abs, Dest: vpath, Time: now})
+}
+
+// Version is an earlier copy of a library file, kept in the versions
+// directory.
+type Version struct {
+	// Path is the library file it was, relative to the library root.
+	Path string
+	// File is where the version is kept.
+	File   string
+	Saved  time.Time
+	Md5Sum string
+	Size   int64
+}
+
+// VersionRetention limits the versions kept of each file. Zero values keep
+// everything.
+type VersionRetention struct {
+	// Keep is how many versions of each file to keep, newest first.
+	Keep int
+	// MaxAge drops versions saved longer ago than this.
+	MaxAge time.Duration
+}
+
+// versionsDir is where the versions of every file in the catalog are kept.
+func (c *Catalog) versionsDir() string {
+	return filepath.Join(c.root, CatalogDirName, VersionsDirName)
+}
+
+// ListVersions returns the saved versions of path, or of every file when path
+// is "", by file and then newest first.
+func ListVersions(destdir string, path string) ([]Version, error) {
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return nil, err
+	}
+	defer catalog.Close()
+	return catalog.versions(path)
+}
+
+func (c *Catalog) versions(path string) ([]Version, error) {
+	root := c.versionsDir()
+	if path != "" {
+		rel, err := c.relPath(path)
+		if err != nil {
+			return nil, err
+		}
+		root = filepath.Join(root, filepath.FromSlash(rel))
+	}
+
+	versions := []Version{}
+	err := filepath.WalkDir(root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		v, ok := c.parseVersion(fpath)
+		if !ok {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			v.Size = fi.Size()
+		}
+		versions = append(versions, v)
+		return nil
+	})
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].Path != versions[j].Path {
+			return versions[i].Path < versions[j].Path
+		}
+		return versions[i].Saved.After(versions[j].Saved)
+	})
+	return versions, err
+}
+
+// parseVersion reads a version back from the name saveVersion gave it.
+func (c *Catalog) parseVersion(fpath string) (Version, bool) {
+	stamp, sum, ok := strings.Cut(filepath.Base(fpath), "-")
+	if !ok {
+		return Version{}, false
+	}
+	saved, err := time.ParseInLocation(versionTimeFormat, stamp, time.Local)
+	if err != nil {
+		return Version{}, false
+	}
+	rel, err := filepath.Rel(c.versionsDir(), filepath.Dir(fpath))
+	if err != nil {
+		return Version{}, false
+	}
+	return Version{Path: filepath.ToSlash(rel), File: fpath, Saved: saved, Md5Sum: sum}, true
+}
+
+// RestoreVersion puts a saved version of path back in place: the one whose
+// file name is name, or the newest when name is "". The file it replaces is
+// saved as a version in turn, and both moves are journalled so the restore can
+// be undone.
+func RestoreVersion(destdir string, path string, name string) (Version, error) {
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return Version{}, err
+	}
+	defer catalog.Close()
+	return catalog.restoreVersion(path, name)
+}
+
+func (c *Catalog) restoreVersion(path string, name string) (Version, error) {
+	versions, err := c.versions(path)
+	if err != nil {
+		return Version{}, err
+	}
+	var v Version
+	for _, candidate := range versions {
+		if name == "" || filepath.Base(candidate.File) == name {
+			v = candidate
+			break
+		}
+	}
+	if v.File == "" {
+		return v, fmt.Errorf("no saved version of %s", path)
+	}
+
+	dest := c.AbsPath(v.Path)
+	if _, err := os.Lstat(dest); err == nil {
+		entry, _ := c.Get(dest)
+		sum := entry.Md5Sum
+		if sum == "" {
+			if sum, err = Md5Sum(dest); err != nil {
+				return v, err
+			}
+		}
+		if _, err := c.saveVersion(dest, sum); err != nil {
+			return v, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return v, err
+	}
+	if err := moveFile(v.File, dest); err != nil {
+		return v, err
+	}
+	now := time.Now()
+	if err := c.Put(CatalogEntry{Path: dest, Md5Sum: v.Md5Sum, Mode: ModeCopy, CopiedAt: now}); err != nil {
+		return v, err
+	}
+	return v, c.Journal(JournalEntry{Op: OpRestore, Source: dest, Dest: v.File, Time: now})
+}
+
+// PruneVersions removes the saved versions retention does not keep, of path
+// or of every file when path is "", and returns them.
+func PruneVersions(destdir string, path string, retention VersionRetention) ([]Version, error) {
+	catalog, err := OpenCatalog(destdir)
+	if err != nil {
+		return nil, err
+	}
+	defer catalog.Close()
+	return catalog.pruneVersions(path, retention)
+}
+
+func (c *Catalog) pruneVersions(path string, retention VersionRetention) ([]Version, error) {
+	versions, err := c.versions(path)
+	if err != nil {
+		return nil, err
+	}
+	pruned := []Version{}
+	cutoff := time.Now().Add(-retention.MaxAge)
+	kept := map[string]int{}
+	for _, v := range versions {
+		// Newest first within each file.
+		kept[v.Path]++
+		if (retention.Keep <= 0 || kept[v.Path] <= retention.Keep) &&
+			(retention.MaxAge <= 0 || v.Saved.After(cutoff)) {
+			continue
+		}
+		if err := os.Remove(v.File); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, v)
+		removeEmptyDirs(filepath.Dir(v.File), c.versionsDir())
+	}
+	return pruned, nil
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including, root
+// for as long as they are empty.
+func removeEmptyDirs(dir string, root string) {
+	for dir != root && isWithin(root, dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// moveFile renames src to dst, copying when they are on different
+// filesystems.
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		if err = restoreCopy(src, dst); err == nil {
+			err = os.Remove(src)
+		}
+	}
+	return err
+}
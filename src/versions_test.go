@@ -0,0 +1,72 @@
+package icopy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestVersions(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "2023", "a.jpg")
+	os.MkdirAll(filepath.Dir(path), 0755)
+
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	for _, content := range []string{"v1", "v2"} {
+		os.WriteFile(path, []byte(content), 0644)
+		sum, _ := Md5Sum(path)
+		if _, err := catalog.saveVersion(path, sum); err != nil {
+			t.Fatalf("saveVersion returned error: %v", err)
+		}
+	}
+	os.WriteFile(path, []byte("v3"), 0644)
+	catalog.Close()
+
+	versions, err := ListVersions(dir, "")
+	if err != nil {
+		t.Fatalf("ListVersions returned error: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Path != "2023/a.jpg" || !versions[0].Saved.After(versions[1].Saved) {
+		t.Fatalf("Expected two versions of 2023/a.jpg, newest first, got %+v", versions)
+	}
+
+	v, err := RestoreVersion(dir, path, "")
+	if err != nil {
+		t.Fatalf("RestoreVersion returned error: %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "v2" || v.File != versions[0].File {
+		t.Errorf("Expected the newest version, v2, to be restored, got %q", content)
+	}
+	versions, _ = ListVersions(dir, path)
+	if len(versions) != 2 {
+		t.Errorf("Expected v3 to be kept as a version and v1 to remain, got %+v", versions)
+	}
+
+	if _, err := Undo(ctx, dir, ""); err != nil {
+		t.Fatalf("Undo returned error: %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "v3" {
+		t.Errorf("Expected undo to put v3 back, got %q", content)
+	}
+
+	pruned, err := PruneVersions(dir, "", VersionRetention{Keep: 1})
+	if err != nil {
+		t.Fatalf("PruneVersions returned error: %v", err)
+	}
+	versions, _ = ListVersions(dir, "")
+	if len(pruned) != 1 || len(versions) != 1 {
+		t.Errorf("Expected one version pruned and one kept, got %d and %d", len(pruned), len(versions))
+	}
+	pruned, _ = PruneVersions(dir, "", VersionRetention{MaxAge: time.Nanosecond})
+	if _, err := os.Stat(filepath.Join(dir, CatalogDirName, VersionsDirName, "2023")); len(pruned) != 1 || !os.IsNotExist(err) {
+		t.Errorf("Expected the last version pruned by age and its directories removed, got %d", len(pruned))
+	}
+}
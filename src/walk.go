@@ -0,0 +1,133 @@
+package icopy
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+)
+
+// walkSource calls fn for every file under root, in lexical order, skipping
+// catalog directories and what the global ignore file and the .icopyignore
+// files along the way leave out. Subdirectories are only entered when
+// recursive is set.
+// Symbolic links to directories are only followed with followLinks, and then
+// never into a directory already walked, which would walk it twice or, for a
+// link back up the tree, forever. Links to files are passed to fn either way.
+// Errors reading a directory are logged and the walk carries on; it stops
+// early only when ctx is done.
+func walkSource(ctx context.Context, root string, recursive bool, followLinks bool, fn func(path string, d fs.DirEntry)) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		// A single file given as the source.
+		fn(root, fs.FileInfoToDirEntry(info))
+		return nil
+	}
+	w := &sourceWalk{ctx: ctx, root: root, recursive: recursive, followLinks: followLinks, fn: fn}
+	if followLinks {
+		w.visited.add(info)
+	}
+	var ignores []*ignoreList
+	if global := GlobalIgnoreFile(); global != "" {
+		ignores = w.readIgnores(ignores, global, "")
+	}
+	return w.dir(root, "", ignores)
+}
+
+type sourceWalk struct {
+	ctx         context.Context
+	root        string
+	recursive   bool
+	followLinks bool
+	fn          func(path string, d fs.DirEntry)
+	// visited are the directories walked so far, kept when links are
+	// followed, as only they can lead to one a second time.
+	visited visitedDirs
+}
+
+// readIgnores returns ignores with the rules in fpath for paths below base
+// added. A file that cannot be read is logged and what could be read of it
+// is kept.
+func (w *sourceWalk) readIgnores(ignores []*ignoreList, fpath string, base string) []*ignoreList {
+	logger := w.ctx.Value("logger").(zerolog.Logger)
+	list, err := readIgnoreFile(fpath, base)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("Error reading ignore file: %s", fpath)
+	}
+	if list == nil || len(list.rules) == 0 {
+		return ignores
+	}
+	return append(ignores[:len(ignores):len(ignores)], list)
+}
+
+// dir walks dir, which is at rel under the root. ignores are the rules that
+// apply from above it.
+func (w *sourceWalk) dir(dir string, rel string, ignores []*ignoreList) error {
+	ctx := w.ctx
+	logger := ctx.Value("logger").(zerolog.Logger)
+	ignores = w.readIgnores(ignores, filepath.Join(dir, IgnoreFileName), rel)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Error walking path: %s", dir)
+	}
+	for _, d := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, d.Name())
+		if skipCatalogDir(d) || d.Name() == IgnoreFileName {
+			continue
+		}
+		entryRel := d.Name()
+		if rel != "" {
+			entryRel = rel + "/" + d.Name()
+		}
+
+		isDir := d.IsDir()
+		var info os.FileInfo
+		if d.Type()&fs.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil {
+				logger.Warn().Err(err).Msgf("Skipping broken link: %s", path)
+				continue
+			}
+			isDir = info.IsDir()
+			if isDir && !w.followLinks {
+				logger.Debug().Msgf("Not following link to directory: %s", path)
+				continue
+			}
+		}
+		if ignored(ignores, entryRel, isDir) {
+			logger.Debug().Msgf("Ignoring %s", path)
+			continue
+		}
+		if !isDir {
+			w.fn(path, d)
+			continue
+		}
+		if !w.recursive {
+			continue
+		}
+
+		if w.followLinks {
+			if info == nil {
+				if info, err = d.Info(); err != nil {
+					logger.Error().Err(err).Msgf("Error walking path: %s", path)
+					continue
+				}
+			}
+			if w.visited.add(info) {
+				logger.Warn().Msgf("Skipping directory already walked: %s", path)
+				continue
+			}
+		}
+		if err := w.dir(path, entryRel, ignores); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package icopy
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestWalkSource(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "logger", zerolog.Nop())
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "2019 Wedding", "ceremony"), 0755)
+	os.MkdirAll(filepath.Join(root, CatalogDirName), 0755)
+	os.WriteFile(filepath.Join(root, "a.jpg"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "2019 Wedding", "b.jpg"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(root, "2019 Wedding", "ceremony", "c.jpg"), []byte("c"), 0644)
+	os.WriteFile(filepath.Join(root, CatalogDirName, "catalog"), []byte("x"), 0644)
+	// A link back to the root would otherwise be walked forever.
+	if err := os.Symlink(root, filepath.Join(root, "2019 Wedding", "loop")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "d.jpg"), []byte("d"), 0644)
+	os.Symlink(outside, filepath.Join(root, "linked"))
+	// A second link to the same directory does not walk it twice.
+	os.Symlink(outside, filepath.Join(root, "linked again"))
+	os.Symlink(filepath.Join(root, "a.jpg"), filepath.Join(root, "e.jpg"))
+	os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "broken"))
+
+	walk := func(recursive bool, followLinks bool) []string {
+		files := []string{}
+		err := walkSource(ctx, root, recursive, followLinks, func(path string, d fs.DirEntry) {
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(rel))
+		})
+		if err != nil {
+			t.Fatalf("walkSource returned error: %v", err)
+		}
+		return files
+	}
+
+	if files := walk(false, true); !reflect.DeepEqual(files, []string{"a.jpg", "e.jpg"}) {
+		t.Errorf("Expected only the top level without recursion, got %v", files)
+	}
+	expected := []string{"2019 Wedding/b.jpg", "2019 Wedding/ceremony/c.jpg", "a.jpg", "e.jpg"}
+	if files := walk(true, false); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected links to directories left alone, %v, got %v", expected, files)
+	}
+	expected = []string{"2019 Wedding/b.jpg", "2019 Wedding/ceremony/c.jpg", "a.jpg", "e.jpg", "linked/d.jpg"}
+	if files := walk(true, true); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, got %v", expected, files)
+	}
+
+	// A destination is never walked out of through a link.
+	db, err := OpenBadgerDB(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("OpenBadgerDB returned error: %v", err)
+	}
+	defer CloseBadgerDB(db)
+	options := ScanOptions{Recursive: true, FollowLinks: true}
+	ScanAndGenerateMd5sumFiles(ctx, db, root, "dst", options)
+	outsideSum, _ := Md5Sum(filepath.Join(outside, "d.jpg"))
+	if path, err := GetBadgerDBValue(db, "dst-"+outsideSum); err == nil {
+		t.Errorf("Expected d.jpg outside the destination not to be found in it, got %s", path)
+	}
+	insideSum, _ := Md5Sum(filepath.Join(root, "a.jpg"))
+	if _, err := GetBadgerDBValue(db, "dst-"+insideSum); err != nil {
+		t.Errorf("Expected a.jpg in the destination to be found, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package icopy
+
+import (
+	"os"
+	"syscall"
+)
+
+// dirKey identifies a directory by its device and inode.
+type dirKey struct {
+	dev uint64
+	ino uint64
+}
+
+// visitedDirs are the directories a walk has entered.
+type visitedDirs struct {
+	keys map[dirKey]bool
+}
+
+// add records the directory info describes, and reports whether it was
+// already recorded.
+func (v *visitedDirs) add(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	key := dirKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	if v.keys[key] {
+		return true
+	}
+	if v.keys == nil {
+		v.keys = map[dirKey]bool{}
+	}
+	v.keys[key] = true
+	return false
+}
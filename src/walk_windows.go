@@ -0,0 +1,23 @@
+//go:build windows
+
+package icopy
+
+import "os"
+
+// visitedDirs are the directories a walk has entered. FileInfo on Windows
+// carries no file ID to key them by, so each is compared in turn.
+type visitedDirs struct {
+	infos []os.FileInfo
+}
+
+// add records the directory info describes, and reports whether it was
+// already recorded.
+func (v *visitedDirs) add(info os.FileInfo) bool {
+	for _, seen := range v.infos {
+		if os.SameFile(info, seen) {
+			return true
+		}
+	}
+	v.infos = append(v.infos, info)
+	return false
+}
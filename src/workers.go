@@ -0,0 +1,155 @@
+package icopy
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// Worker pools a run sizes separately, since the device being read from and
+// the one being written to rarely want the same parallelism.
+const (
+	PoolSourceRead = "source-read"
+	PoolDestRead   = "dest-read"
+	PoolWrite      = "write"
+)
+
+// defaultWorkers is used when nothing is known about the device.
+const defaultWorkers = 10
+
+// WorkerSizer picks the number of workers for a pool from the block device
+// behind its path: rotational disks and SD cards degrade badly under many
+// parallel readers, while SSDs want more. Overrides, keyed by path prefix,
+// win over everything else.
+type WorkerSizer struct {
+	Overrides map[string]int
+
+	mu      sync.Mutex
+	devices map[uint64]blockDevice
+}
+
+// blockDevice is what icopy knows about the device behind a path.
+type blockDevice struct {
+	name       string
+	known      bool
+	rotational bool
+	removable  bool
+}
+
+// Workers returns the pool size for kind over path. A per-path override wins,
+// then fixed when it is positive, then the size derived from the device.
+func (s *WorkerSizer) Workers(kind string, path string, fixed int) int {
+	if s != nil {
+		if n, ok := s.override(path); ok {
+			return n
+		}
+	}
+	if fixed > 0 {
+		return fixed
+	}
+	if s == nil {
+		return defaultWorkers
+	}
+	return s.device(path).workers(kind)
+}
+
+// Describe names the device behind path and how it was classified, for logs.
+func (s *WorkerSizer) Describe(path string) string {
+	d := s.device(path)
+	switch {
+	case !d.known:
+		return "unknown device"
+	case d.removable:
+		return d.name + " (removable)"
+	case d.rotational:
+		return d.name + " (rotational)"
+	default:
+		return d.name + " (solid state)"
+	}
+}
+
+// override returns the override with the longest path prefix matching path.
+func (s *WorkerSizer) override(path string) (int, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	best, n := -1, 0
+	for prefix, workers := range s.Overrides {
+		p, err := filepath.Abs(prefix)
+		if err != nil {
+			p = prefix
+		}
+		if (abs == p || strings.HasPrefix(abs, p+string(filepath.Separator))) && len(p) > best {
+			best, n = len(p), workers
+		}
+	}
+	return n, best >= 0
+}
+
+func (s *WorkerSizer) device(path string) blockDevice {
+	dev, err := deviceNumber(existingAncestor(path))
+	if err != nil {
+		return blockDevice{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.devices[dev]; ok {
+		return d
+	}
+	if s.devices == nil {
+		s.devices = map[uint64]blockDevice{}
+	}
+	d := probeBlockDevice(dev)
+	s.devices[dev] = d
+	return d
+}
+
+func (d blockDevice) workers(kind string) int {
+	switch {
+	case !d.known:
+		return defaultWorkers
+	case d.rotational || d.removable:
+		return 2
+	case kind == PoolWrite:
+		return 8
+	}
+	n := 4 * runtime.NumCPU()
+	if n < 8 {
+		n = 8
+	} else if n > 32 {
+		n = 32
+	}
+	return n
+}
+
+// existingAncestor returns path, or its closest parent that exists, so that
+// destinations can be sized before their directories are created.
+func existingAncestor(path string) string {
+	p := filepath.Clean(path)
+	for {
+		if _, err := deviceNumber(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
+
+// workers sizes the pool of kind over path for these options.
+func (o ScanOptions) workers(ctx context.Context, kind string, path string) int {
+	logger := ctx.Value("logger").(zerolog.Logger)
+	n := o.Sizer.Workers(kind, path, o.NumWorkers)
+	if o.Sizer != nil {
+		logger.Debug().Msgf("%s pool for %s on %s: %d workers", kind, path, o.Sizer.Describe(path), n)
+	}
+	return n
+}
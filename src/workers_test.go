@@ -0,0 +1,59 @@
+package icopy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkerSizerOverrides(t *testing.T) {
+	root := t.TempDir()
+	sizer := &WorkerSizer{Overrides: map[string]int{
+		root:                        4,
+		filepath.Join(root, "card"): 1,
+	}}
+
+	tests := []struct {
+		name     string
+		path     string
+		fixed    int
+		expected int
+	}{
+		{"Longest prefix wins", filepath.Join(root, "card", "DCIM"), 0, 1},
+		{"Shorter prefix", filepath.Join(root, "library"), 0, 4},
+		{"Override beats fixed", filepath.Join(root, "card"), 20, 1},
+		{"Prefix must end at a separator", root + "-other", 6, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sizer.Workers(PoolSourceRead, tt.path, tt.fixed)
+			if result != tt.expected {
+				t.Errorf("Workers(%s, %d) = %d; want %d", tt.path, tt.fixed, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBlockDeviceWorkers(t *testing.T) {
+	var nilSizer *WorkerSizer
+	if n := nilSizer.Workers(PoolWrite, "/anywhere", 0); n != defaultWorkers {
+		t.Errorf("nil sizer gave %d workers; want %d", n, defaultWorkers)
+	}
+
+	hdd := blockDevice{name: "sda", known: true, rotational: true}
+	sd := blockDevice{name: "mmcblk0", known: true, removable: true}
+	ssd := blockDevice{name: "nvme0n1", known: true}
+
+	if n := hdd.workers(PoolSourceRead); n != 2 {
+		t.Errorf("rotational disk gave %d readers; want 2", n)
+	}
+	if n := sd.workers(PoolSourceRead); n != 2 {
+		t.Errorf("SD card gave %d readers; want 2", n)
+	}
+	if n := ssd.workers(PoolSourceRead); n < 8 {
+		t.Errorf("SSD gave %d readers; want at least 8", n)
+	}
+	if n := (blockDevice{}).workers(PoolSourceRead); n != defaultWorkers {
+		t.Errorf("unknown device gave %d readers; want %d", n, defaultWorkers)
+	}
+}
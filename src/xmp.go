@@ -0,0 +1,54 @@
+package icopy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// xmpSidecarExt is added to the full name of the file a sidecar describes,
+// so that a RAW and a JPEG of the same shot each get their own.
+const xmpSidecarExt = ".xmp"
+
+// writeXMPSidecar writes an XMP sidecar next to fpath recording the name the
+// file had before it was renamed, as xmpMM:PreservedFileName, and records it
+// in catalog. An existing sidecar is left alone.
+func writeXMPSidecar(catalog *Catalog, fpath string, image FileObject) error {
+	sidecar := fpath + xmpSidecarExt
+	if _, err := os.Lstat(sidecar); err == nil {
+		return fmt.Errorf("%s already exists", sidecar)
+	}
+
+	var name bytes.Buffer
+	if err := xml.EscapeText(&name, []byte(image.Name)); err != nil {
+		return err
+	}
+	data := []byte(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+    xmpMM:PreservedFileName="` + name.String() + `"/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`)
+	if err := os.WriteFile(sidecar, data, 0644); err != nil {
+		return err
+	}
+
+	source, _ := filepath.Abs(filepath.Join(image.Path, image.Name))
+	dest, _ := filepath.Abs(sidecar)
+	now := time.Now()
+	if err := catalog.Put(CatalogEntry{
+		Path: sidecar, Source: source, Md5Sum: fmt.Sprintf("%x", md5.Sum(data)),
+		Mode: ModeCopy, DateTime: image.DateTime, CopiedAt: now,
+	}); err != nil {
+		return err
+	}
+	return catalog.Journal(JournalEntry{Op: ModeCopy, Source: source, Dest: dest, Time: now})
+}
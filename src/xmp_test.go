@@ -0,0 +1,37 @@
+package icopy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteXMPSidecar(t *testing.T) {
+	dir := t.TempDir()
+	catalog, err := OpenCatalog(dir)
+	if err != nil {
+		t.Fatalf("OpenCatalog returned error: %v", err)
+	}
+	defer catalog.Close()
+
+	fpath := filepath.Join(dir, "20230205_093015.jpg")
+	image := FileObject{Name: "IMG_0001 <&>.JPG", Path: "/media/card"}
+	if err := writeXMPSidecar(catalog, fpath, image); err != nil {
+		t.Fatalf("writeXMPSidecar returned error: %v", err)
+	}
+	data, err := os.ReadFile(fpath + ".xmp")
+	if err != nil {
+		t.Fatalf("Expected a sidecar: %v", err)
+	}
+	if !strings.Contains(string(data), `xmpMM:PreservedFileName="IMG_0001 &lt;&amp;&gt;.JPG"`) {
+		t.Errorf("Expected the escaped original name in the sidecar, got %s", data)
+	}
+	catalog.Flush()
+	if _, err := catalog.Get(fpath + ".xmp"); err != nil {
+		t.Errorf("Expected the sidecar in the catalog: %v", err)
+	}
+	if err := writeXMPSidecar(catalog, fpath, image); err == nil {
+		t.Error("Expected an existing sidecar to be left alone")
+	}
+}